@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/123cdxcc/vbox/config"
 	"github.com/123cdxcc/vbox/constant"
@@ -93,6 +94,7 @@ func convertContainer(box container.Summary) (*Container, bool) {
 				Status: box.Status,
 				State:  box.State,
 				Ports:  convertPorts(box.Ports),
+				Labels: box.Labels,
 			}, true
 		}
 	}
@@ -107,15 +109,16 @@ type Container struct {
 	Status string
 	State  string
 	Ports  []Port
+	Labels map[string]string
 }
 
 // List 列出所有以"vbox-"开头的Docker容器
 // 返回容器列表，包括运行中和已停止的容器
-func List() ([]Container, error) {
+func List(ctx context.Context) ([]Container, error) {
 	cli := config.GlobalConfig.GetDockerClient()
 
 	// 列出所有容器（包括已停止的）
-	containers, err := cli.ContainerList(context.Background(), container.ListOptions{
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
 		All: true, // 包括已停止的容器
 	})
 	if err != nil {
@@ -149,6 +152,7 @@ func Get(ctx context.Context, containerID string) (*Container, error) {
 		Status: boxInfo.State.Status,
 		State:  boxInfo.State.Status,
 		Ports:  convertPortMapToPorts(boxInfo.NetworkSettings.Ports),
+		Labels: boxInfo.Config.Labels,
 	}
 	return result, nil
 }
@@ -162,6 +166,9 @@ type CreateOption struct {
 	PublicKey    string            // SSH 公钥内容或文件路径
 	Volumes      map[string]string // 卷挂载配置，key为主机路径，value为容器路径
 	Detached     bool              // 是否后台运行，默认 true
+	Labels       map[string]string // 容器标签，如空闲策略
+	Env          []string          // 容器环境变量，格式 KEY=VALUE
+	User         User              // box 用户，决定公钥的挂载路径
 }
 
 // ensureVboxNetwork 确保 vbox 专用网络存在
@@ -198,6 +205,11 @@ func ensureVboxNetwork(ctx context.Context, cli *client.Client) error {
 	return nil
 }
 
+// CleanupContext 返回清理残留资源用的 context：不随 ctx 一起取消，但最多等待 DefaultCleanupTimeout 秒
+func CleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), constant.DefaultCleanupTimeout*time.Second)
+}
+
 func Create(ctx context.Context, opt CreateOption) (*Container, error) {
 	cli := config.GlobalConfig.GetDockerClient()
 	image := fmt.Sprintf("%s%s:%s", constant.VboxImagePrefix, opt.ImageName, opt.ImageVersion)
@@ -224,7 +236,9 @@ func Create(ctx context.Context, opt CreateOption) (*Container, error) {
 
 	// 创建容器配置
 	boxConfig := &container.Config{
-		Image: image,
+		Image:  image,
+		Labels: opt.Labels,
+		Env:    opt.Env,
 	}
 
 	// 配置端口
@@ -288,7 +302,11 @@ func Create(ctx context.Context, opt CreateOption) (*Container, error) {
 				return nil, fmt.Errorf("公钥路径 %s 是一个目录，不是文件", opt.PublicKey)
 			}
 			// 是文件路径，挂载为只读
-			keyBind := fmt.Sprintf("%s:%s:ro", opt.PublicKey, constant.DefaultSSHAuthorizedKeysPath)
+			authorizedKeysPath := constant.DefaultSSHAuthorizedKeysPath
+			if opt.User.Name != "" {
+				authorizedKeysPath = opt.User.AuthorizedKeysPath()
+			}
+			keyBind := fmt.Sprintf("%s:%s:ro", opt.PublicKey, authorizedKeysPath)
 			if hostConfig.Binds == nil {
 				hostConfig.Binds = []string{}
 			}
@@ -302,17 +320,32 @@ func Create(ctx context.Context, opt CreateOption) (*Container, error) {
 	// 创建容器
 	resp, err := cli.ContainerCreate(ctx, boxConfig, hostConfig, nil, nil, opt.Name)
 	if err != nil {
+		// 请求被取消时守护进程可能已经创建了容器，前面已确认同名容器不存在，可以按名称删除
+		if ctx.Err() != nil {
+			cleanupCtx, cancel := CleanupContext(ctx)
+			_ = cli.ContainerRemove(cleanupCtx, opt.Name, container.RemoveOptions{Force: true})
+			cancel()
+		}
 		return nil, fmt.Errorf("创建容器失败: %w", err)
 	}
 
+	// 启动失败或被取消时删除刚创建的容器
+	removeCreated := func() {
+		cleanupCtx, cancel := CleanupContext(ctx)
+		defer cancel()
+		_ = cli.ContainerRemove(cleanupCtx, resp.ID, container.RemoveOptions{Force: true})
+	}
+
 	// 启动容器
 	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		removeCreated()
 		return nil, fmt.Errorf("启动容器失败: %w", err)
 	}
 
 	// 获取容器信息
 	containerInfo, err := cli.ContainerInspect(ctx, resp.ID)
 	if err != nil {
+		removeCreated()
 		return nil, fmt.Errorf("获取容器信息失败: %w", err)
 	}
 	// 构造返回的 Container 结构体
@@ -323,11 +356,40 @@ func Create(ctx context.Context, opt CreateOption) (*Container, error) {
 		Status: containerInfo.State.Status,
 		State:  containerInfo.State.Status,
 		Ports:  convertPortMapToPorts(containerInfo.NetworkSettings.Ports),
+		Labels: containerInfo.Config.Labels,
 	}
 
 	return result, nil
 }
 
+// RootlessDocker 检查 Docker 守护进程是否以 rootless 模式运行
+func RootlessDocker(ctx context.Context) (bool, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return false, fmt.Errorf("获取 Docker 信息失败: %w", err)
+	}
+	for _, opt := range info.SecurityOptions {
+		if strings.Contains(opt, "name=rootless") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Start 启动已停止的容器
+// containerID 可以是容器ID或名称
+func Start(ctx context.Context, containerID string) error {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	if err := cli.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("启动容器失败: %w", err)
+	}
+
+	return nil
+}
+
 // Stop 停止指定的容器
 // containerID 必须是容器ID
 func Stop(ctx context.Context, containerID string) error {
@@ -3,12 +3,16 @@ package box
 import (
 	"context"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
 	"github.com/moby/moby/api/types/container"
 	"github.com/moby/moby/client"
 )
@@ -118,7 +122,7 @@ func TestList(t *testing.T) {
 	}
 
 	// 测试 List 方法
-	containers, err := List()
+	containers, err := List(context.Background())
 	if err != nil {
 		t.Fatalf("List() failed: %v", err)
 	}
@@ -256,3 +260,112 @@ func TestCreate(t *testing.T) {
 		})
 	}
 }
+
+// TestIdlePolicy 测试空闲策略的检查和容器标签的往返
+func TestIdlePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy IdlePolicy
+		ok     bool
+	}{
+		{IdlePolicy{}, true},
+		{IdlePolicy{Timeout: 30 * time.Minute, CPUPercent: 5}, true},
+		{IdlePolicy{Timeout: 90 * time.Second, CPUPercent: 0.5}, true},
+		{IdlePolicy{Timeout: -time.Minute, CPUPercent: 5}, false},
+		{IdlePolicy{Timeout: time.Minute, CPUPercent: 0}, false},
+		{IdlePolicy{Timeout: time.Minute, CPUPercent: -1}, false},
+		{IdlePolicy{Timeout: time.Minute, CPUPercent: math.NaN()}, false},
+	} {
+		if err := tt.policy.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v.Validate() = %v", tt.policy, err)
+		}
+		if !tt.ok {
+			continue
+		}
+		got, ok := ParseIdlePolicy(tt.policy.Labels())
+		if ok != (tt.policy.Timeout > 0) || (ok && got != tt.policy) {
+			t.Errorf("%+v 经标签往返后为 %+v, %v", tt.policy, got, ok)
+		}
+	}
+
+	for _, tt := range []struct {
+		timeout, cpu string
+		want         IdlePolicy
+		ok           bool
+	}{
+		{"30m", "10", IdlePolicy{Timeout: 30 * time.Minute, CPUPercent: 10}, true},
+		{"1h30m", "", IdlePolicy{Timeout: 90 * time.Minute, CPUPercent: constant.DefaultIdleCPUPercent}, true},
+		{"30m", "abc", IdlePolicy{Timeout: 30 * time.Minute, CPUPercent: constant.DefaultIdleCPUPercent}, true},
+		{"30m", "-1", IdlePolicy{Timeout: 30 * time.Minute, CPUPercent: constant.DefaultIdleCPUPercent}, true},
+		{"", "10", IdlePolicy{}, false},
+		{"0s", "10", IdlePolicy{}, false},
+		{"-5m", "10", IdlePolicy{}, false},
+		{"30", "10", IdlePolicy{}, false},
+		{"soon", "10", IdlePolicy{}, false},
+	} {
+		labels := map[string]string{constant.LabelIdleTimeout: tt.timeout, constant.LabelIdleCPU: tt.cpu}
+		if got, ok := ParseIdlePolicy(labels); ok != tt.ok || got != tt.want {
+			t.Errorf("ParseIdlePolicy(%q, %q) = %+v, %v，期望 %+v, %v", tt.timeout, tt.cpu, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestSessions 测试会话记录的计数、结束和遗留记录的清理
+func TestSessions(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+	config.GlobalConfig.SessionsDirPath = t.TempDir()
+
+	if n, last, err := Sessions("demo"); err != nil || n != 0 || !last.IsZero() {
+		t.Fatalf("没有会话时 Sessions = %d, %v, %v", n, last, err)
+	}
+
+	end, err := BeginSession("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, began, err := Sessions("demo")
+	if err != nil || n != 1 || began.IsZero() {
+		t.Fatalf("开始会话后 Sessions = %d, %v, %v", n, began, err)
+	}
+	if n, _, _ := Sessions("other"); n != 0 {
+		t.Fatalf("其他 box 的会话数为 %d", n)
+	}
+
+	// 已退出进程和无法解析的会话记录不计入，并被删除
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("无法启动进程:", err)
+	}
+	dir := filepath.Join(config.GlobalConfig.SessionsDirPath, "demo")
+	stale := []string{fmt.Sprintf("%d.session", cmd.Process.Pid), "abc.session"}
+	for _, name := range stale {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := Sessions("demo"); err != nil || n != 1 {
+		t.Fatalf("有遗留记录时 Sessions = %d, %v", n, err)
+	}
+	for _, name := range stale {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("遗留的会话记录 %s 应被删除", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Error("其他文件不应被删除")
+	}
+
+	// 结束会话后计数归零，最近活动时间更新
+	past := began.Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, lastActivityFileName), past, past); err != nil {
+		t.Fatal(err)
+	}
+	end()
+	n, last, err := Sessions("demo")
+	if err != nil || n != 0 || !last.After(past) {
+		t.Fatalf("结束会话后 Sessions = %d, %v, %v", n, last, err)
+	}
+}
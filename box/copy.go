@@ -0,0 +1,87 @@
+package box
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/123cdxcc/vbox/config"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/moby/moby/api/types/container"
+)
+
+// StatPath 获取容器内路径的信息，路径不存在时返回 false
+func StatPath(ctx context.Context, containerID, path string) (container.PathStat, bool, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	stat, err := cli.ContainerStatPath(ctx, containerID, path)
+	if err != nil {
+		if cerrdefs.IsNotFound(err) {
+			return stat, false, nil
+		}
+		return stat, false, fmt.Errorf("获取容器路径信息失败: %w", err)
+	}
+	return stat, true, nil
+}
+
+// CopyTo 将 tar 流解包到容器内的 dstDir 目录
+func CopyTo(ctx context.Context, containerID, dstDir string, content io.Reader) error {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	if err := cli.CopyToContainer(ctx, containerID, dstDir, content, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("复制到容器失败: %w", err)
+	}
+	return nil
+}
+
+// CopyFrom 以 tar 流的形式读取容器内的 srcPath，调用方负责关闭返回的流
+func CopyFrom(ctx context.Context, containerID, srcPath string) (io.ReadCloser, container.PathStat, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	content, stat, err := cli.CopyFromContainer(ctx, containerID, srcPath)
+	if err != nil {
+		return nil, stat, fmt.Errorf("从容器复制失败: %w", err)
+	}
+	return content, stat, nil
+}
+
+// Chown 将容器内路径的所有者设置为 user，recursive 为 true 时递归处理目录
+func Chown(ctx context.Context, containerID, user string, recursive bool, paths ...string) error {
+	cmd := []string{"chown", "-h"}
+	if recursive {
+		cmd = append(cmd, "-R")
+	}
+	cmd = append(cmd, user+":"+user, "--")
+	result, err := Exec(ctx, containerID, "root", append(cmd, paths...))
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("修改所有者失败: %s", result.Stderr)
+	}
+	return nil
+}
+
+// RemovePaths 删除容器内的路径
+func RemovePaths(ctx context.Context, containerID string, paths ...string) error {
+	result, err := Exec(ctx, containerID, "root", append([]string{"rm", "-rf", "--"}, paths...))
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("删除文件失败: %s", result.Stderr)
+	}
+	return nil
+}
+
+// MkdirAll 在容器内创建目录
+func MkdirAll(ctx context.Context, containerID, path string) error {
+	result, err := Exec(ctx, containerID, "root", []string{"mkdir", "-p", "--", path})
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("创建目录失败: %s", result.Stderr)
+	}
+	return nil
+}
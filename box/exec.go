@@ -0,0 +1,56 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+)
+
+// ExecResult 保存在容器内执行命令的结果
+type ExecResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// Exec 在容器内执行命令并等待结束
+// user 为空时使用容器默认用户（root）
+func Exec(ctx context.Context, containerID, user string, cmd []string) (*ExecResult, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	execResp, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		User:         user,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("创建 exec 失败: %w", err)
+	}
+
+	hijacked, err := cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("连接 exec 失败: %w", err)
+	}
+	defer hijacked.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, hijacked.Reader); err != nil {
+		return nil, fmt.Errorf("读取 exec 输出失败: %w", err)
+	}
+
+	inspect, err := cli.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return nil, fmt.Errorf("获取 exec 结果失败: %w", err)
+	}
+
+	return &ExecResult{
+		ExitCode: inspect.ExitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}, nil
+}
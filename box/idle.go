@@ -0,0 +1,190 @@
+package box
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	"github.com/123cdxcc/vbox/pkg/tools"
+	"github.com/moby/moby/api/types/container"
+)
+
+const (
+	sessionFileSuffix    = ".session"
+	lastActivityFileName = "last-activity"
+)
+
+// IdlePolicy 描述 box 的空闲自动停止策略，保存在容器标签中
+type IdlePolicy struct {
+	Timeout    time.Duration // 无 SSH 会话多久后停止，0 表示不自动停止
+	CPUPercent float64       // CPU 使用率低于该值才视为空闲
+}
+
+// Validate 检查空闲策略的参数
+func (p IdlePolicy) Validate() error {
+	if p.Timeout < 0 {
+		return fmt.Errorf("无效的空闲时间: %s", p.Timeout)
+	}
+	if p.Timeout > 0 && !(p.CPUPercent > 0) {
+		return fmt.Errorf("无效的 CPU 使用率上限: %v，必须大于 0", p.CPUPercent)
+	}
+	return nil
+}
+
+// Labels 将空闲策略转换为容器标签
+func (p IdlePolicy) Labels() map[string]string {
+	if p.Timeout <= 0 {
+		return nil
+	}
+	return map[string]string{
+		constant.LabelIdleTimeout: p.Timeout.String(),
+		constant.LabelIdleCPU:     strconv.FormatFloat(p.CPUPercent, 'f', -1, 64),
+	}
+}
+
+// ParseIdlePolicy 从容器标签解析空闲策略，未配置时返回 false
+func ParseIdlePolicy(labels map[string]string) (IdlePolicy, bool) {
+	timeout, err := time.ParseDuration(labels[constant.LabelIdleTimeout])
+	if err != nil || timeout <= 0 {
+		return IdlePolicy{}, false
+	}
+	policy := IdlePolicy{
+		Timeout:    timeout,
+		CPUPercent: constant.DefaultIdleCPUPercent,
+	}
+	if cpu, err := strconv.ParseFloat(labels[constant.LabelIdleCPU], 64); err == nil && cpu > 0 {
+		policy.CPUPercent = cpu
+	}
+	return policy, true
+}
+
+// sessionDir 返回 box 的会话记录目录
+func sessionDir(name string) string {
+	return filepath.Join(config.GlobalConfig.SessionsDirPath, name)
+}
+
+// BeginSession 记录一个经由 vbox ssh-proxy 建立的 SSH 会话
+// 返回的函数在会话结束时调用，用于删除记录并更新最近活动时间
+func BeginSession(name string) (func(), error) {
+	dir := sessionDir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建会话目录失败: %w", err)
+	}
+
+	sessionPath := filepath.Join(dir, strconv.Itoa(os.Getpid())+sessionFileSuffix)
+	if err := os.WriteFile(sessionPath, nil, 0600); err != nil {
+		return nil, fmt.Errorf("记录会话失败: %w", err)
+	}
+	touchLastActivity(dir)
+
+	return func() {
+		os.Remove(sessionPath)
+		touchLastActivity(dir)
+	}, nil
+}
+
+// touchLastActivity 更新最近活动时间
+func touchLastActivity(dir string) {
+	os.WriteFile(filepath.Join(dir, lastActivityFileName), []byte(time.Now().Format(time.RFC3339)), 0600)
+}
+
+// Sessions 返回 box 当前活跃的会话数以及最近一次活动时间
+// 已退出进程遗留的会话记录会被清理
+func Sessions(name string) (int, time.Time, error) {
+	dir := sessionDir(name)
+
+	var lastActivity time.Time
+	if info, err := os.Stat(filepath.Join(dir, lastActivityFileName)); err == nil {
+		lastActivity = info.ModTime()
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, lastActivity, nil
+		}
+		return 0, lastActivity, fmt.Errorf("读取会话目录失败: %w", err)
+	}
+
+	active := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), sessionFileSuffix) {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), sessionFileSuffix))
+		if err != nil || !tools.ProcessAlive(pid) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		active++
+	}
+
+	return active, lastActivity, nil
+}
+
+// StartedAt 返回容器最近一次启动的时间
+func StartedAt(ctx context.Context, containerID string) (time.Time, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	boxInfo, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("获取容器信息失败: %w", err)
+	}
+	return time.Parse(time.RFC3339Nano, boxInfo.State.StartedAt)
+}
+
+// CPUPercent 返回容器当前的 CPU 使用率（百分比，按 docker stats 的算法计算）
+func CPUPercent(ctx context.Context, containerID string) (float64, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	resp, err := cli.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return 0, fmt.Errorf("获取容器状态失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var stats container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, fmt.Errorf("解析容器状态失败: %w", err)
+	}
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0, nil
+	}
+	return cpuDelta / systemDelta * onlineCPUs * 100, nil
+}
+
+// WaitSSHReady 等待容器内的 sshd 开始监听，此时 setup.sh 已经完成
+func WaitSSHReady(ctx context.Context, containerID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		result, err := Exec(ctx, containerID, "", []string{"nc", "-z", "127.0.0.1", "22"})
+		if err == nil && result.ExitCode == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("等待 sshd 就绪超时: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+)
+
+// sshProxyExecCmd 在容器内把 exec 的标准输入输出转发到 sshd
+var sshProxyExecCmd = []string{"nc", "127.0.0.1", "22"}
+
+// Proxy 将 stdin/stdout 连接到 box 内的 sshd，供 ssh 的 ProxyCommand 使用
+// box 已停止时会先启动并等待 sshd 就绪
+// Linux 下优先直连容器在 vbox 网络中的 IP，失败时回退到 docker exec 转发
+func Proxy(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer) error {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	boxInfo, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("获取容器信息失败: %w", err)
+	}
+	if !boxInfo.State.Running {
+		if err := Start(ctx, boxInfo.ID); err != nil {
+			return err
+		}
+		if err := WaitSSHReady(ctx, boxInfo.ID, constant.DefaultSSHWaitTimeout*time.Second); err != nil {
+			return err
+		}
+		// 重新获取启动后分配的网络信息
+		if boxInfo, err = cli.ContainerInspect(ctx, boxInfo.ID); err != nil {
+			return fmt.Errorf("获取容器信息失败: %w", err)
+		}
+	}
+
+	if runtime.GOOS == "linux" {
+		if endpoint, ok := boxInfo.NetworkSettings.Networks[constant.VboxNetwork]; ok && endpoint.IPAddress != "" {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(endpoint.IPAddress, "22"), 3*time.Second)
+			if err == nil {
+				return pipeConn(conn, stdin, stdout)
+			}
+		}
+	}
+
+	return proxyExec(ctx, boxInfo.ID, stdin, stdout)
+}
+
+// pipeConn 在 conn 与 stdin/stdout 之间双向拷贝数据，直到任意一端关闭
+func pipeConn(conn net.Conn, stdin io.Reader, stdout io.Writer) error {
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, stdin)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(stdout, conn)
+	return err
+}
+
+// proxyExec 通过 docker exec 在容器内运行 nc 转发 sshd 的数据流
+func proxyExec(ctx context.Context, containerID string, stdin io.Reader, stdout io.Writer) error {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	execResp, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          sshProxyExecCmd,
+	})
+	if err != nil {
+		return fmt.Errorf("创建 exec 失败: %w", err)
+	}
+
+	hijacked, err := cli.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return fmt.Errorf("连接 exec 失败: %w", err)
+	}
+	defer hijacked.Close()
+
+	go func() {
+		io.Copy(hijacked.Conn, stdin)
+		hijacked.CloseWrite()
+	}()
+
+	if _, err := stdcopy.StdCopy(stdout, os.Stderr, hijacked.Reader); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("转发 SSH 数据失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package box
+
+import (
+	"path"
+
+	"github.com/123cdxcc/vbox/constant"
+)
+
+// User 描述 box 中的登录用户
+type User struct {
+	Name  string
+	Shell string
+	Home  string
+}
+
+// UserFromLabels 从镜像或容器标签中读取 box 用户，旧镜像没有这些标签时使用默认的 devbox
+func UserFromLabels(labels map[string]string) User {
+	u := User{
+		Name:  labels[constant.LabelUser],
+		Shell: labels[constant.LabelShell],
+		Home:  labels[constant.LabelHome],
+	}
+	if u.Name == "" {
+		u.Name = constant.VboxUser
+	}
+	if u.Shell == "" {
+		u.Shell = constant.DefaultUserShell
+	}
+	if u.Home == "" {
+		u.Home = path.Join("/home", u.Name)
+	}
+	return u
+}
+
+// AuthorizedKeysPath 返回 authorized_keys 在 box 中的路径
+func (u User) AuthorizedKeysPath() string {
+	return path.Join(u.Home, constant.SSHAuthorizedKeysRelPath)
+}
+
+// User 返回容器的 box 用户
+func (c *Container) User() User {
+	return UserFromLabels(c.Labels)
+}
@@ -4,13 +4,14 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/123cdxcc/vbox/box"
+	"github.com/123cdxcc/vbox/constant"
 	"github.com/123cdxcc/vbox/service"
 
 	"github.com/spf13/cobra"
@@ -34,7 +35,7 @@ var listCmd = &cobra.Command{
 	Short: "列出所有 box",
 	Long:  `列出所有 box`,
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 		params := service.BoxListParams{}
 
 		if err := boxService.ListBoxes(ctx, params); err != nil {
@@ -51,7 +52,7 @@ var getCmd = &cobra.Command{
 	Long:  `根据 box ID 获取单个 box 的详细信息`,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 		params := service.BoxGetParams{
 			BoxID: args[0],
 		}
@@ -67,10 +68,16 @@ var getCmd = &cobra.Command{
 var runCmd = &cobra.Command{
 	Use:   "run [OPTIONS] IMAGE",
 	Short: "运行一个新的 box",
-	Long:  `运行一个新的 box`,
-	Args:  cobra.ExactArgs(1),
+	Long: `运行一个新的 box。
+
+IMAGE 的版本可以是 latest、部分版本 (golang:1.25) 或范围 (golang:">=1.24 <1.26"、golang:^1.24)，
+从环境模板声明的版本和已经构建的镜像中选择最高的匹配版本，解析结果记录在 box 标签中。
+
+--rebuild 决定何时构建镜像：auto 在镜像不存在或构建后模板被修改过时构建，
+always 总是重新构建，never 从不构建，模板修改过时只给出警告。`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 
 		// 获取命令行参数
 		name, _ := cmd.Flags().GetString("name")
@@ -79,6 +86,14 @@ var runCmd = &cobra.Command{
 		publicKey, _ := cmd.Flags().GetString("public-key")
 		volumeMappings, _ := cmd.Flags().GetStringSlice("volume")
 		detach, _ := cmd.Flags().GetBool("detach")
+		sshProxy, _ := cmd.Flags().GetBool("ssh-proxy")
+		idleTimeout, _ := cmd.Flags().GetDuration("idle-timeout")
+		idleCPU, _ := cmd.Flags().GetFloat64("idle-cpu")
+		userMapping, _ := cmd.Flags().GetString("user-mapping")
+		uid, _ := cmd.Flags().GetInt("uid")
+		gid, _ := cmd.Flags().GetInt("gid")
+		base, _ := cmd.Flags().GetString("base")
+		rebuild, _ := cmd.Flags().GetString("rebuild")
 
 		// 解析端口映射
 		ports, err := parsePorts(portMappings)
@@ -103,11 +118,21 @@ var runCmd = &cobra.Command{
 		params := service.BoxRunParams{
 			Name:      name,
 			Image:     args[0], // 镜像名称:版本
+			Base:      base,
+			Rebuild:   rebuild,
 			Ports:     ports,
 			SSHPort:   sshPort,
 			PublicKey: publicKey,
 			Volumes:   volumes,
 			Detached:  detach,
+			SSHProxy:  sshProxy,
+			Idle: box.IdlePolicy{
+				Timeout:    idleTimeout,
+				CPUPercent: idleCPU,
+			},
+			UserMapping: userMapping,
+			UID:         uid,
+			GID:         gid,
 		}
 
 		container, err := boxService.Run(ctx, params)
@@ -211,6 +236,61 @@ func parseVolumes(volumeMappings []string) (map[string]string, error) {
 	return volumes, nil
 }
 
+// cpCmd represents the cp command
+var cpCmd = &cobra.Command{
+	Use:   "cp <src> <box>:<dst> | <box>:<src> <dst>",
+	Short: "在主机和 box 之间复制文件",
+	Long: `在主机和 box 之间复制文件或目录，保留文件权限，复制到 box 的文件所有者为 box 用户。
+源路径为 - 时从 stdin 读取 tar 流，目标路径为 - 时向 stdout 写出 tar 流。`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		quiet, _ := cmd.Flags().GetBool("quiet")
+		params := service.BoxCopyParams{
+			Src:   args[0],
+			Dst:   args[1],
+			Quiet: quiet,
+		}
+
+		if err := boxService.Copy(ctx, params); err != nil {
+			fmt.Fprintf(os.Stderr, "复制失败: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// stopIdleCmd represents the stop-idle command
+var stopIdleCmd = &cobra.Command{
+	Use:   "stop-idle",
+	Short: "停止已空闲的 box",
+	Long: `停止通过 --idle-timeout 配置了空闲策略、且没有 SSH 会话、
+CPU 使用率低于阈值并超时的 box。使用 --watch 时在前台持续检查，按 Ctrl+C 退出。`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		watch, _ := cmd.Flags().GetDuration("watch")
+		params := service.BoxStopIdleParams{
+			DryRun: dryRun,
+		}
+
+		if watch <= 0 {
+			return boxService.StopIdleBoxes(ctx, params)
+		}
+		for {
+			// 持续检查时单次失败不退出
+			if err := boxService.StopIdleBoxes(ctx, params); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watch):
+			}
+		}
+	},
+}
+
 // stopCmd represents the stop command
 var stopCmd = &cobra.Command{
 	Use:   "stop <box-id>",
@@ -218,7 +298,7 @@ var stopCmd = &cobra.Command{
 	Long:  `根据 box ID 停止运行中的 box`,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 		params := service.BoxStopParams{
 			BoxID: args[0],
 		}
@@ -239,7 +319,7 @@ var rmCmd = &cobra.Command{
 	Long:  `根据 box ID 停止并删除指定的 box`,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 		params := service.BoxRemoveParams{
 			BoxID: args[0],
 		}
@@ -259,12 +339,16 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(stopCmd)
 	rootCmd.AddCommand(rmCmd)
+	rootCmd.AddCommand(stopIdleCmd)
+	rootCmd.AddCommand(cpCmd)
 
 	boxCmd.AddCommand(listCmd)
 	boxCmd.AddCommand(getCmd)
 	boxCmd.AddCommand(runCmd)
 	boxCmd.AddCommand(stopCmd)
 	boxCmd.AddCommand(rmCmd)
+	boxCmd.AddCommand(stopIdleCmd)
+	boxCmd.AddCommand(cpCmd)
 
 	// 为 run 命令添加 flags
 	runCmd.Flags().StringP("name", "", "", "指定容器名称")
@@ -273,4 +357,19 @@ func init() {
 	runCmd.Flags().StringP("public-key", "", "", "SSH 公钥文件路径或公钥内容")
 	runCmd.Flags().StringSliceP("volume", "v", []string{}, "卷映射 (格式: host_path:container_path)")
 	runCmd.Flags().BoolP("detach", "d", true, "后台运行容器")
+	runCmd.Flags().BoolP("ssh-proxy", "", false, "通过 vbox ssh-proxy 连接 SSH，不发布 SSH 端口")
+	runCmd.Flags().DurationP("idle-timeout", "", 0, "无 SSH 会话多久后由 stop-idle 自动停止 (如 30m，0 表示不自动停止)")
+	runCmd.Flags().Float64P("idle-cpu", "", constant.DefaultIdleCPUPercent, "判定空闲的 CPU 使用率上限 (百分比)")
+	runCmd.Flags().StringP("user-mapping", "", constant.UserMappingAuto, "将 box 用户映射为主机 UID/GID (auto|host|none，rootless Docker 下 auto 不映射)")
+	runCmd.Flags().IntP("uid", "", -1, "显式指定 box 用户的 UID")
+	runCmd.Flags().IntP("gid", "", -1, "显式指定 box 用户组的 GID")
+	runCmd.Flags().StringP("rebuild", "", constant.RebuildAuto, "何时构建镜像 (auto|always|never，auto 在镜像不存在或模板修改过时构建)")
+	runCmd.Flags().StringP("base", "", "", "镜像不存在时使用的基础镜像 (debian|ubuntu|fedora|alpine，可带版本如 ubuntu:22.04，默认 debian)")
+
+	// 为 cp 命令添加 flags
+	cpCmd.Flags().BoolP("quiet", "q", false, "不显示复制进度")
+
+	// 为 stop-idle 命令添加 flags
+	stopIdleCmd.Flags().BoolP("dry-run", "", false, "只打印将被停止的 box")
+	stopIdleCmd.Flags().DurationP("watch", "w", 0, "按该间隔持续检查 (如 1m，0 表示只检查一次)")
 }
@@ -4,10 +4,12 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/123cdxcc/vbox/constant"
+	"github.com/123cdxcc/vbox/image"
 	"github.com/123cdxcc/vbox/service"
 	"github.com/spf13/cobra"
 )
@@ -23,35 +25,270 @@ var imageCmd = &cobra.Command{
 
 // buildCmd represents the build command
 var buildCmd = &cobra.Command{
-	Use:   "build",
+	Use:   "build [name:version[+name:version...]]",
 	Short: "从 Dockerfile 构建镜像",
-	Long:  `从指定的 Dockerfile 构建 vbox 镜像。`,
+	Long: `从指定的 Dockerfile 构建 vbox 镜像。
+
+可以用 -n/-v 指定单个环境，也可以用 "golang:1.25.0+node:22" 组合多个环境，
+各环境的脚本按顺序执行。
+
+--base 选择基础镜像 (debian、ubuntu、fedora、alpine)，非默认基础镜像的标签带后缀，
+如 vbox-golang:1.25.0-alpine。
+
+--buildkit 通过 docker buildx 使用 BuildKit 构建，软件包和环境脚本的下载在多次构建之间缓存，
+设置 VBOX_BUILDKIT=1 时默认启用；--secret 传入的构建密钥只在构建时挂载，不会写入镜像。
+
+--all 构建所有环境模板的所有版本，--env 构建指定环境的所有版本，--matrix 从文件读取要构建的镜像：
+
+  bases: [debian, alpine]
+  builds:
+    - golang                 # 所有版本
+    - golang:1.25.0+node:22
+
+批量构建时 --jobs 个镜像同时构建，输出带有镜像前缀，--base 可以用逗号分隔多个基础镜像，
+同一个镜像只构建一次，最后打印每个镜像的结果和用时。`,
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 
 		// 获取flag值
 		name, _ := cmd.Flags().GetString("name")
 		version, _ := cmd.Flags().GetString("version")
+		user, _ := cmd.Flags().GetString("user")
+		shell, _ := cmd.Flags().GetString("shell")
+		home, _ := cmd.Flags().GetString("home")
+		base, _ := cmd.Flags().GetString("base")
+		buildArgList, _ := cmd.Flags().GetStringArray("build-arg")
+		labelList, _ := cmd.Flags().GetStringArray("label")
+		noCache, _ := cmd.Flags().GetBool("no-cache")
+		pull, _ := cmd.Flags().GetBool("pull")
+		platform, _ := cmd.Flags().GetString("platform")
+		buildkit, _ := cmd.Flags().GetBool("buildkit")
+		secrets, _ := cmd.Flags().GetStringArray("secret")
+		all, _ := cmd.Flags().GetBool("all")
+		envs, _ := cmd.Flags().GetStringArray("env")
+		matrix, _ := cmd.Flags().GetString("matrix")
+		jobs, _ := cmd.Flags().GetInt("jobs")
+
+		buildArgs, err := parseKeyValues(buildArgList, true)
+		if err != nil {
+			fmt.Printf("错误：--build-arg %v\n", err)
+			os.Exit(1)
+		}
+		labels, err := parseKeyValues(labelList, false)
+		if err != nil {
+			fmt.Printf("错误：--label %v\n", err)
+			os.Exit(1)
+		}
 
 		params := service.ImageBuildParams{
-			EnvName: name,
-			Version: version,
+			User:      user,
+			Shell:     shell,
+			Home:      home,
+			Base:      base,
+			BuildArgs: buildArgs,
+			Labels:    labels,
+			NoCache:   noCache,
+			Pull:      pull,
+			Platform:  platform,
+			BuildKit:  buildkit,
+			Secrets:   secrets,
+		}
+
+		// 批量构建
+		if all || len(envs) > 0 || matrix != "" {
+			if len(args) > 0 || name != "" || version != "" {
+				fmt.Printf("错误：--all、--env 和 --matrix 不能与镜像描述或 --name/--version 同时使用\n")
+				os.Exit(1)
+			}
+			var bases []string
+			if base != "" {
+				bases = strings.Split(base, ",")
+			}
+			if err := imageService.BuildMany(ctx, service.ImageBuildManyParams{
+				All:     all,
+				Envs:    envs,
+				Matrix:  matrix,
+				Bases:   bases,
+				Jobs:    jobs,
+				Options: params,
+			}); err != nil {
+				fmt.Printf("错误：%v\n", err)
+				os.Exit(1)
+			}
+			return
 		}
 
-		if err := imageService.BuildImage(ctx, params); err != nil {
+		var specStr string
+		switch {
+		case len(args) == 1 && (name != "" || version != ""):
+			fmt.Printf("错误：不能同时指定镜像描述和 --name/--version\n")
+			os.Exit(1)
+		case len(args) == 1:
+			specStr = args[0]
+		case name == "" || version == "":
+			fmt.Printf("错误：请指定镜像描述，或同时指定 --name 和 --version\n")
+			os.Exit(1)
+		default:
+			specStr = name + ":" + version
+		}
+
+		params.Spec, err = image.ParseSpec(specStr)
+		if err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+
+		if _, err := imageService.BuildImage(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// parseKeyValues 解析 KEY=VALUE 格式的参数
+// fromEnv 为 true 时只写 KEY 表示使用主机上同名环境变量的值，未设置的变量被忽略，与 docker build 一致
+func parseKeyValues(values []string, fromEnv bool) (map[string]string, error) {
+	result := make(map[string]string, len(values))
+	for _, kv := range values {
+		key, value, ok := strings.Cut(kv, "=")
+		if key == "" {
+			return nil, fmt.Errorf("格式错误: %s，正确格式为 KEY=VALUE", kv)
+		}
+		if !ok {
+			if !fromEnv {
+				return nil, fmt.Errorf("格式错误: %s，正确格式为 KEY=VALUE", kv)
+			}
+			if value, ok = os.LookupEnv(key); !ok {
+				continue
+			}
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// imageBuildLogCmd represents the build-log command
+var imageBuildLogCmd = &cobra.Command{
+	Use:   "build-log [name:version[+name:version...]]",
+	Short: "查看构建日志",
+	Long: `显示镜像最近一次的构建日志，--list 列出该镜像保存的所有构建日志。
+
+不指定镜像时列出所有构建日志。日志保存在 ~/.config/vbox/logs/builds，
+每个镜像保留最近 10 次构建。`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		base, _ := cmd.Flags().GetString("base")
+		list, _ := cmd.Flags().GetBool("list")
+		params := service.ImageBuildLogParams{Base: base, List: list}
+		if len(args) == 1 {
+			params.Image = args[0]
+		}
+
+		if err := imageService.BuildLog(ctx, params); err != nil {
 			fmt.Printf("错误：%v\n", err)
 			os.Exit(1)
 		}
 	},
 }
 
+// imageOutdatedCmd represents the outdated command
+var imageOutdatedCmd = &cobra.Command{
+	Use:   "outdated",
+	Short: "列出模板修改后过时的镜像和 box",
+	Long: `比较镜像构建时记录的模板哈希和当前模板，列出过时的镜像和使用过时镜像创建的 box。
+
+模板哈希包括 Dockerfile、setup.sh、环境脚本和模板目录（按 .vboxignore 过滤），
+旧版本 vbox 构建的镜像没有记录模板哈希，状态为未知。`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		all, _ := cmd.Flags().GetBool("all")
+		if err := imageService.Outdated(ctx, service.ImageOutdatedParams{All: all}); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// imageSaveCmd represents the save command
+var imageSaveCmd = &cobra.Command{
+	Use:   "save [name:version[+name:version...] | vbox-<tag>]... -o <file>",
+	Short: "导出镜像到归档文件",
+	Long: `把 box 镜像导出到一个归档文件，在没有网络的机器上用 vbox image load 导入。
+
+可以导出多个镜像，--all 导出所有 vbox 镜像。压缩方式根据文件扩展名选择
+(.tar.gz/.tgz 使用 gzip，.tar.zst/.tzst 使用 zstd)，也可以用 --compress 指定，
+zstd 需要主机上的 zstd 命令。-o - 写入标准输出。
+
+镜像的 vbox 标签和模板哈希随镜像一起导出，导入后 vbox image list 可以正常识别。`,
+	Example: `  vbox image save golang:1.25.0 node:22 -o envs.tar.gz
+  vbox image save --all -o all.tar.zst
+  vbox image save golang:1.25.0 -o - | ssh host vbox image load`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		output, _ := cmd.Flags().GetString("output")
+		compress, _ := cmd.Flags().GetString("compress")
+		base, _ := cmd.Flags().GetString("base")
+		all, _ := cmd.Flags().GetBool("all")
+		quiet, _ := cmd.Flags().GetBool("quiet")
+		params := service.ImageSaveParams{
+			Images:      args,
+			Base:        base,
+			All:         all,
+			Output:      output,
+			Compression: compress,
+			Quiet:       quiet,
+		}
+
+		// 归档可能写入标准输出，错误输出到 stderr
+		if output == "" {
+			fmt.Fprintf(os.Stderr, "错误：需要使用 -o 指定归档文件\n")
+			os.Exit(1)
+		}
+		if len(args) == 0 && !all {
+			fmt.Fprintf(os.Stderr, "错误：需要指定镜像或使用 --all\n")
+			os.Exit(1)
+		}
+		if err := imageService.Save(ctx, params); err != nil {
+			fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// imageLoadCmd represents the load command
+var imageLoadCmd = &cobra.Command{
+	Use:   "load -i <file>",
+	Short: "从归档文件导入镜像",
+	Long: `导入 vbox image save 导出的归档文件，自动识别 gzip 和 zstd 压缩。
+
+-i - 或不指定 -i 时从标准输入读取。`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		input, _ := cmd.Flags().GetString("input")
+		quiet, _ := cmd.Flags().GetBool("quiet")
+		// 与 save 一致，错误和进度都输出到 stderr
+		if err := imageService.Load(ctx, service.ImageLoadParams{Input: input, Quiet: quiet}); err != nil {
+			fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
 // imageListCmd represents the list command
 var imageListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "列出所有 box 镜像",
 	Long:  `列出所有 box 镜像。`,
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 		params := service.ImageListParams{}
 
 		if err := imageService.ListImages(ctx, params); err != nil {
@@ -67,7 +304,7 @@ var imagesCmd = &cobra.Command{
 	Short: "列出所有 box 镜像",
 	Long:  `列出所有 box 镜像`,
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 		imageService := service.NewImageService()
 		params := service.ImageListParams{}
 
@@ -85,7 +322,7 @@ var rmiCmd = &cobra.Command{
 	Long:  `根据镜像ID删除指定的 box 镜像。`,
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
+		ctx := cmd.Context()
 
 		params := service.ImageRmiParams{
 			ImageID: args[0],
@@ -112,16 +349,45 @@ func init() {
 	// 添加子命令
 	imageCmd.AddCommand(buildCmd)
 	imageCmd.AddCommand(imageListCmd)
+	imageCmd.AddCommand(imageBuildLogCmd)
+	imageCmd.AddCommand(imageOutdatedCmd)
+	imageCmd.AddCommand(imageSaveCmd)
+	imageCmd.AddCommand(imageLoadCmd)
 	imageCmd.AddCommand(rmiCmd)
 
 	// 为build命令添加flags
-	buildCmd.Flags().StringP("name", "n", "", "镜像名称 (必需)")
-	buildCmd.Flags().StringP("version", "v", "", "镜像版本 (必需)")
-
-	// 标记为必需参数
-	buildCmd.MarkFlagRequired("name")
-	buildCmd.MarkFlagRequired("version")
+	buildCmd.Flags().StringP("name", "n", "", "镜像名称")
+	buildCmd.Flags().StringP("version", "v", "", "镜像版本")
+	buildCmd.Flags().StringP("user", "u", "", "box 用户名 (默认使用主机用户名)")
+	buildCmd.Flags().StringP("shell", "", "", "box 用户的登录 shell (bash|zsh|fish，默认 bash)")
+	buildCmd.Flags().StringP("home", "", "", "box 用户目录 (默认 /home/<user>)")
+	buildCmd.Flags().StringArray("build-arg", nil, "构建参数 (格式: KEY=VALUE，只写 KEY 时使用同名环境变量)")
+	buildCmd.Flags().StringArray("label", nil, "额外的镜像标签 (格式: KEY=VALUE)")
+	buildCmd.Flags().Bool("no-cache", false, "不使用构建缓存")
+	buildCmd.Flags().Bool("pull", false, "总是拉取基础镜像的最新版本")
+	buildCmd.Flags().String("platform", "", "目标平台，如 linux/arm64 (默认使用 Docker 的平台)")
+	buildCmd.Flags().Bool("buildkit", false, "使用 BuildKit 构建并缓存软件包 (需要 docker buildx，不可用时使用经典构建器)")
+	buildCmd.Flags().StringArray("secret", nil, "BuildKit 构建密钥，环境脚本从 /run/secrets/<id> 读取 (格式: id=npm,src=~/.npmrc 或 id=token,env=TOKEN)")
+	buildCmd.Flags().StringP("base", "", "", "基础镜像 (debian|ubuntu|fedora|alpine，可带版本如 ubuntu:22.04，默认 debian)")
+	buildCmd.Flags().Bool("all", false, "构建所有环境模板的所有版本")
+	buildCmd.Flags().StringArray("env", nil, "构建该环境的所有版本，可以指定多次")
+	buildCmd.Flags().String("matrix", "", "从矩阵文件读取要构建的镜像和基础镜像")
+	buildCmd.Flags().IntP("jobs", "j", constant.DefaultBuildJobs, "批量构建时同时构建的镜像数")
 
 	// 为rmi命令添加flags
+	imageBuildLogCmd.Flags().String("base", "", "基础镜像 (debian|ubuntu|fedora|alpine，默认 debian)")
+	imageBuildLogCmd.Flags().BoolP("list", "l", false, "列出该镜像的所有构建日志")
+
+	imageOutdatedCmd.Flags().BoolP("all", "a", false, "同时列出最新的镜像和 box")
+
+	imageSaveCmd.Flags().StringP("output", "o", "", "归档文件路径，- 表示标准输出")
+	imageSaveCmd.Flags().String("compress", "", "压缩方式 (none|gzip|zstd，默认根据文件扩展名选择)")
+	imageSaveCmd.Flags().String("base", "", "基础镜像 (debian|ubuntu|fedora|alpine，默认 debian)")
+	imageSaveCmd.Flags().BoolP("all", "a", false, "导出所有 vbox 镜像")
+	imageSaveCmd.Flags().BoolP("quiet", "q", false, "不显示进度")
+
+	imageLoadCmd.Flags().StringP("input", "i", "-", "归档文件路径，- 表示标准输入")
+	imageLoadCmd.Flags().BoolP("quiet", "q", false, "不显示进度")
+
 	rmiCmd.Flags().BoolP("force", "f", false, "强制删除")
 }
@@ -4,7 +4,11 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -26,9 +30,17 @@ to quickly create a Cobra application.`,
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// 收到 Ctrl+C 或 SIGTERM 时取消命令的 context，构建、运行等操作据此中止并清理
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// RunE 返回的错误与其他命令的错误使用相同的格式输出
+	rootCmd.SilenceErrors = true
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "错误：%v\n", err)
+		stop()
 		os.Exit(1)
 	}
 }
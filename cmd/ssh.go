@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/123cdxcc/vbox/service"
+	"github.com/spf13/cobra"
+)
+
+// sshProxyCmd represents the ssh-proxy command
+var sshProxyCmd = &cobra.Command{
+	Use:   "ssh-proxy <box-name>",
+	Short: "作为 SSH ProxyCommand 连接 box 内的 sshd",
+	Long: `将标准输入输出转发到 box 内的 sshd，供 SSH 配置中的
+ProxyCommand vbox ssh-proxy %n 使用，box 无需发布 SSH 端口。`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.BoxProxyParams{
+			Name: args[0],
+		}
+
+		// stdout 是 SSH 数据通道，错误只能输出到 stderr
+		if err := boxService.Proxy(ctx, params); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshProxyCmd)
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/123cdxcc/vbox/service"
+	"github.com/spf13/cobra"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync <host-dir> <box>:<dir>",
+	Short: "将主机目录持续单向同步到 box",
+	Long: `先完整复制主机目录到 box，然后监听主机目录的变更并增量推送，包括删除。
+遵循主机目录下 .gitignore 和 .vboxignore 中的规则。
+box 中被修改过的文件会报告冲突并跳过，使用 --force 覆盖。`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		force, _ := cmd.Flags().GetBool("force")
+		detach, _ := cmd.Flags().GetBool("detach")
+		params := service.BoxSyncParams{
+			HostDir: args[0],
+			Target:  args[1],
+			Force:   force,
+			Detach:  detach,
+		}
+
+		if err := boxService.Sync(ctx, params); err != nil {
+			fmt.Printf("同步失败: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// syncListCmd represents the sync list command
+var syncListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "列出后台运行的同步",
+	Long:  `列出通过 vbox sync -d 启动的后台同步`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.BoxSyncListParams{}
+
+		if err := boxService.ListSyncs(ctx, params); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// syncStopCmd represents the sync stop command
+var syncStopCmd = &cobra.Command{
+	Use:   "stop <sync-id>",
+	Short: "停止后台同步",
+	Long:  `根据同步 ID 停止后台运行的同步`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.BoxSyncStopParams{
+			ID: args[0],
+		}
+
+		if err := boxService.StopSync(ctx, params); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("成功停止同步: %s\n", params.ID)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	// 添加子命令
+	syncCmd.AddCommand(syncListCmd)
+	syncCmd.AddCommand(syncStopCmd)
+
+	// 为 sync 命令添加 flags
+	syncCmd.Flags().BoolP("force", "f", false, "box 中的文件被修改时仍然覆盖")
+	syncCmd.Flags().BoolP("detach", "d", false, "在后台运行同步")
+}
@@ -3,36 +3,287 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
-	"github.com/123cdxcc/vbox/config"
-	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+	"github.com/123cdxcc/vbox/service"
 	"github.com/spf13/cobra"
 )
 
+var templateService = service.NewTemplateService()
+
 // templateCmd represents the template command
 var templateCmd = &cobra.Command{
 	Use:   "template",
 	Short: "管理 box 模板",
-	Long:  `管理 box 模板的工具，包括初始化模板。`,
+	Long:  `管理 box 模板的工具，包括初始化、查看、创建、检查和测试模板。`,
 }
 
 // templateInitCmd represents the init command
 var templateInitCmd = &cobra.Command{
 	Use:   "init",
 	Short: "初始化模板目录",
-	Long:  `初始化模板目录，创建默认的环境模板和配置文件。`,
+	Long:  `初始化模板目录，创建默认的环境模板和配置文件。已被修改的文件不会被覆盖。`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// 获取目标目录
-		targetDir := config.GlobalConfig.TemplatesDirPath
+		ctx := cmd.Context()
 
-		fmt.Printf("正在初始化模板到目录: %s\n", targetDir)
+		force, _ := cmd.Flags().GetBool("force")
+		params := service.TemplateInitParams{
+			Force: force,
+		}
 
-		if err := template.Init(targetDir); err != nil {
+		if err := templateService.Init(ctx, params); err != nil {
 			fmt.Printf("错误：%v\n", err)
 			os.Exit(1)
 		}
+	},
+}
 
-		fmt.Printf("模板初始化完成！\n")
+// templateDiffCmd represents the template diff command
+var templateDiffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "比较内置模板和模板目录",
+	Long:  `显示 vbox 内置模板与模板目录中文件的差异。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.TemplateDiffParams{}
+
+		if err := templateService.Diff(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateUpgradeCmd represents the template upgrade command
+var templateUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "升级模板目录",
+	Long:  `用新的内置模板更新模板目录。未修改的文件直接更新，已修改的文件旁边写入 .new 文件供手动合并。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.TemplateUpgradeParams{}
+
+		if err := templateService.Upgrade(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateListCmd represents the template list command
+var templateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "列出环境模板",
+	Long:  `列出内置模板和模板目录中的环境模板，以及它们的来源。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.TemplateListParams{}
+
+		if err := templateService.List(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateShowCmd represents the template show command
+var templateShowCmd = &cobra.Command{
+	Use:   "show <name>[:version]",
+	Short: "显示环境模板",
+	Long: `显示环境模板的 template.yaml 描述、版本别名、依赖、验证命令和文件来源。
+指定版本时显示该版本构建时使用的脚本内容。`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		name, version, _ := strings.Cut(args[0], ":")
+		params := service.TemplateShowParams{
+			Name:    name,
+			Version: version,
+		}
+
+		if err := templateService.Show(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateNewCmd represents the template new command
+var templateNewCmd = &cobra.Command{
+	Use:   "new <name> <version>",
+	Short: "生成环境脚本骨架",
+	Long:  `在模板目录中为 name:version 生成环境脚本骨架。`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		params := service.TemplateNewParams{
+			Name:    args[0],
+			Version: args[1],
+		}
+
+		if err := templateService.New(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateRmCmd represents the template rm command
+var templateRmCmd = &cobra.Command{
+	Use:   "rm <name>[:version]",
+	Short: "删除环境模板",
+	Long:  `删除模板目录中的环境脚本，不指定版本时删除整个环境。`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		name, version, _ := strings.Cut(args[0], ":")
+		params := service.TemplateRmParams{
+			Name:    name,
+			Version: version,
+		}
+
+		if err := templateService.Rm(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateValidateCmd represents the template validate command
+var templateValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "检查模板目录",
+	Long:  `检查模板目录的结构、Dockerfile 和 setup.sh 是否存在、脚本是否可执行并以 shebang 开头，以及 template.yaml 是否有效。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.TemplateValidateParams{}
+
+		if err := templateService.Validate(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateTestCmd represents the template test command
+var templateTestCmd = &cobra.Command{
+	Use:   "test <name:version[+name:version...]>",
+	Short: "测试环境模板",
+	Long:  `构建镜像，并在临时 box 中执行 template.yaml 中的 verify 命令，结束后删除临时 box。`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		spec, err := image.ParseSpec(args[0])
+		if err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+
+		base, _ := cmd.Flags().GetString("base")
+		params := service.TemplateTestParams{
+			Spec: spec,
+			Base: base,
+		}
+
+		if err := templateService.Test(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateSourceCmd represents the template source command
+var templateSourceCmd = &cobra.Command{
+	Use:   "source",
+	Short: "管理模板来源",
+	Long: `管理外部模板来源（git 仓库或本地目录）。
+
+查找环境模板的优先级：模板目录中添加或修改过的环境 > 模板来源（按添加顺序）> 内置模板。
+git 来源被克隆到 ~/.config/vbox/sources 并固定在添加或更新时的提交。`,
+}
+
+// templateSourceAddCmd represents the template source add command
+var templateSourceAddCmd = &cobra.Command{
+	Use:   "add <name> <git-url|path>",
+	Short: "添加模板来源",
+	Long:  `添加模板来源。来源中的环境目录可以位于根目录或 template 子目录下。`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		ref, _ := cmd.Flags().GetString("ref")
+		params := service.TemplateSourceAddParams{
+			Name: args[0],
+			URL:  args[1],
+			Ref:  ref,
+		}
+
+		if err := templateService.SourceAdd(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateSourceUpdateCmd represents the template source update command
+var templateSourceUpdateCmd = &cobra.Command{
+	Use:   "update [name]",
+	Short: "更新模板来源",
+	Long:  `拉取 git 来源的最新提交并重新固定，不指定名称时更新全部来源。`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		params := service.TemplateSourceUpdateParams{}
+		if len(args) == 1 {
+			params.Name = args[0]
+		}
+
+		if err := templateService.SourceUpdate(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateSourceRemoveCmd represents the template source remove command
+var templateSourceRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "删除模板来源",
+	Long:  `删除模板来源，git 来源的克隆目录也会被删除。`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		params := service.TemplateSourceRemoveParams{
+			Name: args[0],
+		}
+
+		if err := templateService.SourceRemove(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// templateSourceListCmd represents the template source list command
+var templateSourceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "列出模板来源",
+	Long:  `按优先级列出模板来源及其固定的提交。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+		params := service.TemplateSourceListParams{}
+
+		if err := templateService.SourceList(ctx, params); err != nil {
+			fmt.Printf("错误：%v\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -41,4 +292,23 @@ func init() {
 
 	// 添加子命令
 	templateCmd.AddCommand(templateInitCmd)
+	templateCmd.AddCommand(templateDiffCmd)
+	templateCmd.AddCommand(templateUpgradeCmd)
+	templateCmd.AddCommand(templateListCmd)
+	templateCmd.AddCommand(templateShowCmd)
+	templateCmd.AddCommand(templateNewCmd)
+	templateCmd.AddCommand(templateRmCmd)
+	templateCmd.AddCommand(templateValidateCmd)
+	templateCmd.AddCommand(templateTestCmd)
+	templateCmd.AddCommand(templateSourceCmd)
+
+	templateSourceCmd.AddCommand(templateSourceAddCmd)
+	templateSourceCmd.AddCommand(templateSourceUpdateCmd)
+	templateSourceCmd.AddCommand(templateSourceRemoveCmd)
+	templateSourceCmd.AddCommand(templateSourceListCmd)
+
+	templateSourceAddCmd.Flags().String("ref", "", "跟踪的分支或标签 (默认使用仓库的默认分支)")
+
+	templateInitCmd.Flags().BoolP("force", "f", false, "覆盖已被修改的文件")
+	templateTestCmd.Flags().String("base", "", "基础镜像 (debian|ubuntu|fedora|alpine，默认 debian)")
 }
@@ -15,6 +15,12 @@ type Config struct {
 	AppSSHConfigPath string
 	AppSSHDirPath    string
 	TemplatesDirPath string
+	SourcesDirPath   string
+	SessionsDirPath  string
+	SyncDirPath      string
+	BuildLogsDirPath string
+	CacheDirPath     string
+	LocksDirPath     string
 	DockerClient     *client.Client
 }
 
@@ -32,6 +38,12 @@ func init() {
 		AppSSHDirPath:    appSSHDirPath,
 		AppSSHConfigPath: filepath.Join(appSSHDirPath, "config"),
 		TemplatesDirPath: filepath.Join(appConfigDirPath, "env"),
+		SourcesDirPath:   filepath.Join(appConfigDirPath, "sources"),
+		SessionsDirPath:  filepath.Join(appConfigDirPath, "sessions"),
+		SyncDirPath:      filepath.Join(appConfigDirPath, "sync"),
+		BuildLogsDirPath: filepath.Join(appConfigDirPath, "logs", "builds"),
+		CacheDirPath:     filepath.Join(appConfigDirPath, "cache"),
+		LocksDirPath:     filepath.Join(appConfigDirPath, "locks"),
 	}
 	userHomeSSHConfigPath := filepath.Join(userHomeDir, ".ssh", "config")
 
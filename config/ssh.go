@@ -23,6 +23,7 @@ type SSHHostConfig struct {
 	IdentityFile          string
 	IdentitiesOnly        bool
 	StrictHostKeyChecking bool
+	ProxyCommand          string // 非空时通过 ProxyCommand 连接，不再需要 HostName/Port
 }
 
 // String 格式化SSH配置为字符串
@@ -36,20 +37,35 @@ func (c *SSHHostConfig) String() string {
 		strictHostKeyChecking = "yes"
 	}
 
-	return fmt.Sprintf(`Host %s
-    HostName %s
-    Port %s
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s", c.Name)
+	if c.HostName != "" {
+		fmt.Fprintf(&b, "\n    HostName %s", c.HostName)
+	}
+	if c.Port != "" {
+		fmt.Fprintf(&b, "\n    Port %s", c.Port)
+	}
+	if c.ProxyCommand != "" {
+		fmt.Fprintf(&b, "\n    ProxyCommand %s", c.ProxyCommand)
+	}
+	fmt.Fprintf(&b, `
     User %s
     IdentityFile %s
     IdentitiesOnly %s
     StrictHostKeyChecking %s`,
-		c.Name, c.HostName, c.Port, c.User, c.IdentityFile, identitiesOnly, strictHostKeyChecking)
+		c.User, c.IdentityFile, identitiesOnly, strictHostKeyChecking)
+	return b.String()
 }
 
-func UpdateSSH(name, host, user, port, privateKey, publicKey string) (string, error) {
-	configPath := GlobalConfig.AppSSHConfigPath
+// sshKeyPaths 返回名为 name 的私钥和公钥文件路径
+func sshKeyPaths(name string) (string, string) {
 	privateKeyPath := filepath.Join(GlobalConfig.AppSSHDirPath, name)
-	publicKeyPath := filepath.Join(GlobalConfig.AppSSHDirPath, name+".pub")
+	return privateKeyPath, privateKeyPath + ".pub"
+}
+
+// WriteSSHKeys 保存名为 name 的密钥文件，返回公钥文件路径
+func WriteSSHKeys(name, privateKey, publicKey string) (string, error) {
+	privateKeyPath, publicKeyPath := sshKeyPaths(name)
 
 	// 确保SSH配置目录存在
 	if err := os.MkdirAll(GlobalConfig.AppSSHDirPath, 0700); err != nil {
@@ -66,6 +82,15 @@ func UpdateSSH(name, host, user, port, privateKey, publicKey string) (string, er
 		return "", fmt.Errorf("failed to write public key: %w", err)
 	}
 
+	return publicKeyPath, nil
+}
+
+// UpdateSSHHost 写入/更新名为 name 的 Host 配置，使用 WriteSSHKeys 保存的私钥
+// proxyCommand 非空时写入 ProxyCommand，此时 host 和 port 可以为空
+func UpdateSSHHost(name, host, user, port, proxyCommand string) error {
+	configPath := GlobalConfig.AppSSHConfigPath
+	privateKeyPath, _ := sshKeyPaths(name)
+
 	// 创建新的SSH配置
 	newConfig := &SSHHostConfig{
 		Name:                  name,
@@ -75,12 +100,13 @@ func UpdateSSH(name, host, user, port, privateKey, publicKey string) (string, er
 		IdentityFile:          privateKeyPath,
 		IdentitiesOnly:        true,
 		StrictHostKeyChecking: false,
+		ProxyCommand:          proxyCommand,
 	}
 
 	// 读取现有配置
 	configs, err := readSSHConfigs(configPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read SSH config: %w", err)
+		return fmt.Errorf("failed to read SSH config: %w", err)
 	}
 
 	// 检查是否存在同名配置，如果存在则更新，否则添加
@@ -97,12 +123,79 @@ func UpdateSSH(name, host, user, port, privateKey, publicKey string) (string, er
 	}
 
 	// 写入配置文件
-	err = writeSSHConfigs(configPath, configs)
+	if err := writeSSHConfigs(configPath, configs); err != nil {
+		return fmt.Errorf("failed to write SSH config: %w", err)
+	}
+	return nil
+}
+
+// SnapshotSSHKeys 记录名为 name 的密钥文件的当前状态
+// 返回的函数把它们恢复到记录时的状态：原来不存在的文件被删除，存在的被还原
+func SnapshotSSHKeys(name string) (func() error, error) {
+	privateKeyPath, publicKeyPath := sshKeyPaths(name)
+	keyPaths := []string{privateKeyPath, publicKeyPath}
+
+	keys := make([][]byte, len(keyPaths))
+	for i, path := range keyPaths {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		keys[i] = data
+	}
+
+	return func() error {
+		for i, path := range keyPaths {
+			if keys[i] == nil {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to remove key file: %w", err)
+				}
+			} else if err := os.WriteFile(path, keys[i], 0600); err != nil {
+				return fmt.Errorf("failed to restore key file: %w", err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// SnapshotSSHHost 记录名为 name 的 Host 配置的当前状态
+// 返回的函数把它恢复到记录时的状态：原来不存在的配置被删除，存在的放回原来的位置
+func SnapshotSSHHost(name string) (func() error, error) {
+	configPath := GlobalConfig.AppSSHConfigPath
+
+	configs, err := readSSHConfigs(configPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to write SSH config: %w", err)
+		return nil, fmt.Errorf("failed to read SSH config: %w", err)
+	}
+	var previous *SSHHostConfig
+	for _, config := range configs {
+		if config.Name == name {
+			previous = config
+			break
+		}
 	}
 
-	return publicKeyPath, nil
+	return func() error {
+		configs, err := readSSHConfigs(configPath)
+		if err != nil {
+			return fmt.Errorf("failed to read SSH config: %w", err)
+		}
+		// 原来存在的配置放回原来的位置，没有同名配置时追加到末尾
+		pending := previous
+		restored := make([]*SSHHostConfig, 0, len(configs)+1)
+		for _, config := range configs {
+			if config.Name != name {
+				restored = append(restored, config)
+			} else if pending != nil {
+				restored = append(restored, pending)
+				pending = nil
+			}
+		}
+		if pending != nil {
+			restored = append(restored, pending)
+		}
+		return writeSSHConfigs(configPath, restored)
+	}, nil
 }
 
 // RemoveSSH 删除SSH配置
@@ -241,6 +334,8 @@ func readSSHConfigs(configPath string) ([]*SSHHostConfig, error) {
 				currentConfig.IdentitiesOnly = value == "yes"
 			case "StrictHostKeyChecking":
 				currentConfig.StrictHostKeyChecking = value == "yes"
+			case "ProxyCommand":
+				currentConfig.ProxyCommand = value
 			}
 		}
 	}
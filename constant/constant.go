@@ -14,4 +14,73 @@ const (
 	DefaultDockerfileName        = "Dockerfile"
 	DefaultNetworkDriver         = "bridge"
 	DefaultSSHAuthorizedKeysPath = "/home/devbox/.ssh/authorized_keys"
+	DefaultUserShell             = "bash"
+	SSHAuthorizedKeysRelPath     = ".ssh/authorized_keys" // 相对于 box 用户目录
+)
+
+// 容器标签
+const (
+	LabelIdleTimeout = VboxCommonPrefix + ".idle-timeout" // 无 SSH 会话多久后自动停止，如 30m
+	LabelIdleCPU     = VboxCommonPrefix + ".idle-cpu"     // 判定空闲的 CPU 使用率上限（百分比）
+	LabelRequest     = VboxCommonPrefix + ".request"      // run 时指定的环境，如 golang:latest，解析后的版本记录在 LabelSpec
+)
+
+// 镜像标签，由 Dockerfile 根据构建参数写入，容器会继承这些标签
+const (
+	LabelUser  = VboxCommonPrefix + ".user"  // box 用户名
+	LabelShell = VboxCommonPrefix + ".shell" // 登录 shell
+	LabelHome  = VboxCommonPrefix + ".home"  // 用户目录
+
+	LabelSpec  = VboxCommonPrefix + ".spec"  // 镜像包含的环境，如 golang:1.25.0+node:22，由构建时写入
+	LabelPorts = VboxCommonPrefix + ".ports" // 环境声明的常用端口，逗号分隔，由构建时写入
+	LabelBase  = VboxCommonPrefix + ".base"  // 构建时使用的基础镜像，如 alpine:3.20，旧镜像没有该标签
+
+	LabelTemplateHash = VboxCommonPrefix + ".template-hash" // 构建时模板内容的哈希，与当前模板不同时镜像已过时
+
+	// 构建选项，重新构建过时的镜像时使用相同的选项
+	LabelBuildArgs = VboxCommonPrefix + ".build-args" // --build-arg，JSON 对象
+	LabelLabels    = VboxCommonPrefix + ".labels"     // --label 指定的标签名，JSON 数组，值就是镜像中的同名标签
+	LabelPlatform  = VboxCommonPrefix + ".platform"   // --platform
+)
+
+// Dockerfile 构建参数
+const (
+	BuildArgUser  = "VBOX_USER"
+	BuildArgShell = "VBOX_SHELL"
+	BuildArgHome  = "VBOX_HOME"
+
+	// 环境脚本通过这两个构建参数得到目标架构，ARCH 供旧的 Dockerfile 和脚本使用
+	BuildArgTargetArch = "TARGETARCH"
+	BuildArgArch       = "ARCH"
+)
+
+const (
+	DefaultIdleCPUPercent = 5.0
+	DefaultSSHWaitTimeout = 30 // 自动启动后等待 sshd 就绪的秒数
+	DefaultCleanupTimeout = 30 // 操作被取消后清理残留资源的最长秒数
+	DefaultBuildLogKeep   = 10 // 每个镜像保留的构建日志数
+	DefaultBuildJobs      = 2  // 并行构建时同时构建的镜像数
+)
+
+// EnvBuildKit 设置为 1 时默认使用 BuildKit 构建镜像，包括 vbox run 自动构建的镜像
+const EnvBuildKit = "VBOX_BUILDKIT"
+
+// box 运行时环境变量
+const (
+	EnvUID = "VBOX_UID" // setup.sh 将 box 用户的 UID 改为该值
+	EnvGID = "VBOX_GID" // setup.sh 将 box 用户组的 GID 改为该值
+)
+
+// vbox run 重新构建镜像的策略
+const (
+	RebuildAuto   = "auto"   // 镜像不存在或模板修改过时构建
+	RebuildAlways = "always" // 总是重新构建
+	RebuildNever  = "never"  // 从不构建，镜像不存在时报错，过时时只给出警告
+)
+
+// 主机用户映射模式
+const (
+	UserMappingAuto = "auto" // Linux 且非 rootless Docker 时映射主机 UID/GID
+	UserMappingHost = "host" // 总是映射主机 UID/GID
+	UserMappingNone = "none" // 保持镜像中的 UID/GID
 )
@@ -0,0 +1,247 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Artifact 是环境脚本需要的下载文件，vbox 在主机上下载、校验并缓存后放入构建上下文
+// 脚本从 $VBOX_ARTIFACTS/<name> 读取，不需要在构建时联网
+type Artifact struct {
+	Name      string            `yaml:"name"`       // 构建上下文中的文件名
+	URL       string            `yaml:"url"`        // 下载地址，可以使用 {{.Version}} 和 {{.Arch}}
+	SHA256    map[string]string `yaml:"sha256"`     // 校验和，键为 <version>/<arch> 或 <version>
+	SHA256URL string            `yaml:"sha256_url"` // sha256 中没有对应版本时从这里读取校验和，可以使用模板变量
+	Optional  bool              `yaml:"optional"`   // 没有对应版本的校验和时跳过，由脚本自行下载
+}
+
+// ErrNoChecksum 表示下载文件没有声明该版本和架构的校验和
+var ErrNoChecksum = errors.New("没有声明校验和")
+
+// ArtifactData 是渲染下载地址的数据
+type ArtifactData struct {
+	Version string
+	Arch    string
+}
+
+// ResolvedArtifact 是某个版本和架构的下载文件
+type ResolvedArtifact struct {
+	Name      string
+	URL       string
+	SHA256    string // 为空时从 SHA256URL 读取
+	SHA256URL string
+}
+
+var (
+	validArtifactName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	validSHA256       = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// validate 检查下载文件的声明
+func (a Artifact) validate() error {
+	if !validArtifactName.MatchString(a.Name) {
+		return fmt.Errorf("无效的下载文件名: %q", a.Name)
+	}
+	for _, s := range []string{a.URL, a.SHA256URL} {
+		if _, err := template.New("url").Parse(s); err != nil {
+			return fmt.Errorf("下载文件 %s 的地址无效: %w", a.Name, err)
+		}
+	}
+	if a.URL == "" {
+		return fmt.Errorf("下载文件 %s 没有指定 url", a.Name)
+	}
+	if len(a.SHA256) == 0 && a.SHA256URL == "" && !a.Optional {
+		return fmt.Errorf("下载文件 %s 需要声明 sha256 或 sha256_url", a.Name)
+	}
+	for key, sum := range a.SHA256 {
+		if !validSHA256.MatchString(sum) {
+			return fmt.Errorf("下载文件 %s 中 %s 的 sha256 无效: %s", a.Name, key, sum)
+		}
+	}
+	return nil
+}
+
+// Resolve 渲染下载地址并选择校验和，优先使用 <version>/<arch>，其次是 <version>
+func (a Artifact) Resolve(version, arch string) (ResolvedArtifact, error) {
+	data := ArtifactData{Version: version, Arch: arch}
+	resolved := ResolvedArtifact{Name: a.Name}
+	var err error
+	if resolved.URL, err = renderURL(a.URL, data); err != nil {
+		return ResolvedArtifact{}, fmt.Errorf("下载文件 %s: %w", a.Name, err)
+	}
+	if resolved.SHA256URL, err = renderURL(a.SHA256URL, data); err != nil {
+		return ResolvedArtifact{}, fmt.Errorf("下载文件 %s: %w", a.Name, err)
+	}
+
+	resolved.SHA256 = a.SHA256[version+"/"+arch]
+	if resolved.SHA256 == "" {
+		resolved.SHA256 = a.SHA256[version]
+	}
+	if resolved.SHA256 == "" && resolved.SHA256URL == "" {
+		return ResolvedArtifact{}, fmt.Errorf("下载文件 %s 没有声明 %s/%s 的 sha256: %w", a.Name, version, arch, ErrNoChecksum)
+	}
+	return resolved, nil
+}
+
+// renderURL 渲染地址中的模板变量，只允许 http 和 https
+func renderURL(s string, data ArtifactData) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(b.String())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("无效的下载地址: %s", b.String())
+	}
+	return b.String(), nil
+}
+
+// FetchArtifact 返回缓存中已校验的下载文件，不在缓存中时下载到 cacheDir
+// 从 SHA256URL 得到的校验和和文件一起缓存，之后的构建不需要联网
+// progress 非空时输出下载信息
+func FetchArtifact(ctx context.Context, cacheDir string, a ResolvedArtifact, progress io.Writer) (string, error) {
+	if progress == nil {
+		progress = io.Discard
+	}
+	key := sha256.Sum256([]byte(a.URL))
+	filePath := filepath.Join(cacheDir, hex.EncodeToString(key[:8])+"-"+path.Base(a.URL))
+	sumPath := filePath + ".sha256"
+
+	expected := a.SHA256
+	if expected == "" {
+		if data, err := os.ReadFile(sumPath); err == nil {
+			expected = strings.TrimSpace(string(data))
+		}
+	}
+	if expected != "" {
+		if actual, err := fileSHA256(filePath); err == nil {
+			if actual == expected {
+				fmt.Fprintf(progress, "使用缓存的 %s\n", a.URL)
+				return filePath, nil
+			}
+			// 缓存损坏或声明的校验和变了，重新下载
+			fmt.Fprintf(progress, "缓存的 %s 校验失败，重新下载\n", a.URL)
+		}
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", fmt.Errorf("创建缓存目录失败: %w", err)
+	}
+	if a.SHA256 == "" {
+		sum, err := download(ctx, a.SHA256URL, 1024)
+		if err != nil {
+			return "", fmt.Errorf("下载 %s 的校验和失败: %w", a.URL, err)
+		}
+		fields := strings.Fields(string(sum))
+		if len(fields) == 0 || !validSHA256.MatchString(strings.ToLower(fields[0])) {
+			return "", fmt.Errorf("%s 中没有有效的 sha256", a.SHA256URL)
+		}
+		expected = strings.ToLower(fields[0])
+	}
+
+	fmt.Fprintf(progress, "正在下载 %s\n", a.URL)
+	tmp, err := os.CreateTemp(cacheDir, ".download-*")
+	if err != nil {
+		return "", fmt.Errorf("创建临时文件失败: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	actual, err := downloadTo(ctx, a.URL, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("下载 %s 失败: %w", a.URL, err)
+	}
+	if actual != expected {
+		return "", fmt.Errorf("%s 校验失败: 期望 sha256 %s，实际 %s", a.URL, expected, actual)
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return "", fmt.Errorf("保存 %s 失败: %w", a.URL, err)
+	}
+	if err := os.WriteFile(sumPath, []byte(expected+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("保存 %s 的校验和失败: %w", a.URL, err)
+	}
+	return filePath, nil
+}
+
+// download 读取小文件的内容，超过 limit 字节时返回错误
+func download(ctx context.Context, rawURL string, limit int64) ([]byte, error) {
+	var b bytes.Buffer
+	resp, err := get(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(&b, io.LimitReader(resp.Body, limit+1)); err != nil {
+		return nil, err
+	}
+	if int64(b.Len()) > limit {
+		return nil, fmt.Errorf("%s 超过 %d 字节", rawURL, limit)
+	}
+	return b.Bytes(), nil
+}
+
+// downloadTo 把文件下载到 w，返回内容的 sha256
+func downloadTo(ctx context.Context, rawURL string, w io.Writer) (string, error) {
+	resp, err := get(ctx, rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("服务器返回 %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// fileSHA256 计算文件内容的 sha256
+func fileSHA256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,113 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 基础镜像的软件包管理方式，Dockerfile 模板据此选择安装命令
+const (
+	FamilyDebian = "debian" // apt-get
+	FamilyFedora = "fedora" // dnf
+	FamilyAlpine = "alpine" // apk，busybox 环境
+)
+
+// families 是所有软件包类型，template.yaml 的 packages 可以按这些类型分别列出包名
+var families = []string{FamilyDebian, FamilyFedora, FamilyAlpine}
+
+// DefaultBase 是默认的基础镜像，使用它构建的镜像标签不带后缀
+const DefaultBase = "debian"
+
+// Base 是构建镜像时使用的基础镜像
+type Base struct {
+	Name   string // debian、ubuntu、fedora、alpine
+	Image  string // FROM 使用的镜像，如 alpine:3.20
+	Family string // 软件包管理方式
+}
+
+// bases 是支持的基础镜像及其默认版本
+var bases = []Base{
+	{Name: "debian", Image: "debian:bullseye-slim", Family: FamilyDebian},
+	{Name: "ubuntu", Image: "ubuntu:24.04", Family: FamilyDebian},
+	{Name: "fedora", Image: "fedora:41", Family: FamilyFedora},
+	{Name: "alpine", Image: "alpine:3.20", Family: FamilyAlpine},
+}
+
+// Bases 返回支持的基础镜像
+func Bases() []Base {
+	return bases
+}
+
+// ParseBase 解析 --base 参数，格式为 name 或 name:tag，如 alpine、ubuntu:22.04，为空时使用默认基础镜像
+func ParseBase(s string) (Base, error) {
+	if s == "" {
+		s = DefaultBase
+	}
+	name, tag, hasTag := strings.Cut(s, ":")
+	for _, base := range bases {
+		if base.Name != name {
+			continue
+		}
+		if hasTag {
+			if !validVersion.MatchString(tag) {
+				return Base{}, fmt.Errorf("无效的基础镜像版本: %s", tag)
+			}
+			base.Image = name + ":" + tag
+		}
+		return base, nil
+	}
+
+	names := make([]string, len(bases))
+	for i, base := range bases {
+		names[i] = base.Name
+	}
+	return Base{}, fmt.Errorf("不支持的基础镜像 %s，可选: %s", name, strings.Join(names, ", "))
+}
+
+// Default 是否为默认基础镜像的默认版本
+func (b Base) Default() bool {
+	return b == bases[0]
+}
+
+// ID 返回追加到镜像标签中的基础镜像标识，默认基础镜像为空，如 alpine、ubuntu-22.04
+func (b Base) ID() string {
+	if b.Default() {
+		return ""
+	}
+	for _, base := range bases {
+		if base == b {
+			return b.Name
+		}
+	}
+	return strings.ReplaceAll(b.Image, ":", "-")
+}
+
+func (b Base) String() string {
+	return b.Image
+}
+
+// DockerfileData 是渲染 Dockerfile 模板的数据
+type DockerfileData struct {
+	Base
+	BuildKit bool     // 使用 BuildKit 构建，可以使用 RUN --mount 缓存软件包和下载的文件
+	Secrets  []string // 构建密钥的 id，BuildKit 构建时环境脚本可以从 /run/secrets/<id> 读取
+}
+
+// RenderDockerfile 用基础镜像渲染 Dockerfile 模板
+// 不是模板的旧 Dockerfile 只能用于默认基础镜像
+func RenderDockerfile(path string, data DockerfileData) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !data.Base.Default() && !bytes.Contains(content, []byte("{{")) {
+		return nil, fmt.Errorf("%s 不是模板，无法使用基础镜像 %s，请执行 vbox template upgrade", path, data.Base)
+	}
+	rendered, err := render(path, content, data)
+	if err != nil {
+		return nil, fmt.Errorf("渲染 Dockerfile 失败: %w", err)
+	}
+	return rendered, nil
+}
@@ -0,0 +1,422 @@
+package template
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Origin 表示模板文件的来源
+type Origin string
+
+const (
+	OriginEmbedded  Origin = "embedded"  // 只存在于 vbox 内置模板中，尚未 init
+	OriginInstalled Origin = "installed" // 内置模板已安装到模板目录，内容未修改
+	OriginModified  Origin = "modified"  // 内置模板已安装，但内容被修改
+	OriginUser      Origin = "user"      // 用户自己添加的模板
+	OriginSource    Origin = "source"    // 来自外部模板来源
+)
+
+// Entry 是模板列表中的一个脚本或描述文件
+type Entry struct {
+	Name    string
+	Version string // 通用脚本和 template.yaml 为空
+	Script  string
+	Path    string // 在模板目录中的路径，OriginEmbedded 时为空
+	Origin  Origin
+	Source  string // 来源名称，只对 OriginSource 有意义
+}
+
+// Layer 返回该文件所属的模板层
+func (e Entry) Layer() string {
+	switch e.Origin {
+	case OriginSource:
+		return Layer{Kind: LayerSource, Name: e.Source}.String()
+	case OriginUser, OriginModified:
+		return LayerLocal
+	default:
+		return LayerEmbedded
+	}
+}
+
+// Generic 是否为适用于所有版本的通用脚本
+func (e Entry) Generic() bool {
+	return Env{Script: e.Script}.Generic()
+}
+
+// Embedded 返回 vbox 内置的模板文件
+func Embedded() []Env {
+	return slices.Clone(envs)
+}
+
+// lookupEmbedded 查找内置模板文件
+func lookupEmbedded(name, script string) (Env, bool) {
+	i := slices.IndexFunc(envs, func(e Env) bool { return e.Name == name && e.Script == script })
+	if i < 0 {
+		return Env{}, false
+	}
+	return envs[i], true
+}
+
+// isTemplateFile 判断文件名是否为环境脚本或描述文件，其他文件只会放入构建上下文
+func isTemplateFile(name string) bool {
+	return name == ManifestFileName || IsScriptFile(name)
+}
+
+// IsScriptFile 判断文件名是否为环境脚本：<version>.sh、install.sh 或 install.sh.tmpl
+func IsScriptFile(name string) bool {
+	return name == GenericScriptName || name == GenericTemplateName || isVersionScript(name)
+}
+
+// isVersionScript 判断文件名是否为 <version>.sh，版本不合法的 .sh 文件视为辅助脚本
+func isVersionScript(name string) bool {
+	version, ok := strings.CutSuffix(name, ".sh")
+	return ok && name != GenericScriptName && validVersion.MatchString(version)
+}
+
+// List 合并内置模板和模板目录中的模板，按名称和文件名排序
+func List(templatesDir string) ([]Entry, error) {
+	var entries []Entry
+	seen := make(map[string]bool)
+
+	root := filepath.Join(templatesDir, "template")
+	dirs, err := os.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(root, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || !isTemplateFile(file.Name()) {
+				continue
+			}
+			entry := newEntry(dir.Name(), file.Name())
+			entry.Path = filepath.Join(root, dir.Name(), file.Name())
+			data, err := os.ReadFile(entry.Path)
+			if err != nil {
+				return nil, err
+			}
+			embedded, hasEmbedded := lookupEmbedded(entry.Name, entry.Script)
+			entry.Origin = originOf(data, embedded, hasEmbedded)
+			seen[entry.Name+"/"+entry.Script] = true
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, env := range envs {
+		if seen[env.Name+"/"+env.Script] {
+			continue
+		}
+		entry := newEntry(env.Name, env.Script)
+		entry.Origin = OriginEmbedded
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Script, b.Script)
+	})
+	return entries, nil
+}
+
+// ListSource 列出外部模板来源中的模板
+func ListSource(layer Layer) ([]Entry, error) {
+	var entries []Entry
+	dirs, err := os.ReadDir(layer.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || !validName.MatchString(dir.Name()) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(layer.Dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || !isTemplateFile(file.Name()) {
+				continue
+			}
+			entry := newEntry(dir.Name(), file.Name())
+			entry.Path = filepath.Join(layer.Dir, dir.Name(), file.Name())
+			entry.Origin = OriginSource
+			entry.Source = layer.Name
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func newEntry(name, script string) Entry {
+	entry := Entry{Name: name, Script: script}
+	if strings.HasSuffix(script, ".sh") && !entry.Generic() {
+		entry.Version = strings.TrimSuffix(script, ".sh")
+	}
+	return entry
+}
+
+// ReadScript 读取环境脚本的内容，模板目录中没有时读取内置模板
+func ReadScript(templatesDir, name, script string) ([]byte, Origin, error) {
+	embedded, hasEmbedded := lookupEmbedded(name, script)
+	data, err := os.ReadFile(filepath.Join(templatesDir, "template", name, script))
+	switch {
+	case err == nil:
+		return data, originOf(data, embedded, hasEmbedded), nil
+	case os.IsNotExist(err) && hasEmbedded:
+		return embedded.Data, OriginEmbedded, nil
+	case os.IsNotExist(err):
+		return nil, "", fmt.Errorf("环境模板 %s 中没有 %s", name, script)
+	default:
+		return nil, "", err
+	}
+}
+
+// originOf 根据内置模板判断模板目录中文件的来源
+func originOf(data []byte, embedded Env, hasEmbedded bool) Origin {
+	switch {
+	case !hasEmbedded:
+		return OriginUser
+	case bytes.Equal(data, embedded.Data):
+		return OriginInstalled
+	default:
+		return OriginModified
+	}
+}
+
+// validName 匹配环境名称和版本，与镜像标签的规则一致
+var (
+	validName    = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+	validVersion = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// skeleton 是 vbox template new 生成的脚本骨架
+var skeleton = template.Must(template.New("skeleton").Parse(`#!/bin/bash
+
+# {{.Name}} 环境设置脚本
+# 安装 {{.Name}} {{.Version}}，以 root 身份在镜像构建时执行
+# 可用的环境变量: VERSION、ARCH、VBOX_USER、VBOX_HOME
+
+set -e
+
+echo "正在安装 {{.Name}} {{.Version}}..."
+
+# TODO: 下载并安装 {{.Name}}
+
+# 需要导出的环境变量写入 /etc/profile.d，登录 shell 会加载它们
+# echo "export PATH=\$PATH:/opt/{{.Name}}/bin" >> /etc/profile.d/vbox-{{.Name}}.sh
+
+echo "{{.Name}} {{.Version}} 安装完成！"
+`))
+
+// New 在模板目录中为 name:version 生成脚本骨架，返回脚本路径
+func New(templatesDir, name, version string) (string, error) {
+	if !validName.MatchString(name) {
+		return "", fmt.Errorf("无效的环境名称: %s", name)
+	}
+	if !validVersion.MatchString(version) {
+		return "", fmt.Errorf("无效的环境版本: %s", version)
+	}
+
+	envDir := filepath.Join(templatesDir, "template", name)
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		return "", err
+	}
+
+	scriptPath := filepath.Join(envDir, version+".sh")
+	var buf bytes.Buffer
+	if err := skeleton.Execute(&buf, ScriptData{Name: name, Version: version}); err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(scriptPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("环境脚本已存在: %s", scriptPath)
+		}
+		return "", err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return "", err
+	}
+	return scriptPath, f.Close()
+}
+
+// Remove 删除模板目录中 name:version 的脚本，version 为空时删除整个环境
+func Remove(templatesDir, name, version string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("无效的环境名称: %s", name)
+	}
+
+	envDir := filepath.Join(templatesDir, "template", name)
+	if _, err := os.Stat(envDir); err != nil {
+		return fmt.Errorf("环境模板 %s 不存在", name)
+	}
+	if version == "" {
+		return os.RemoveAll(envDir)
+	}
+
+	if !validVersion.MatchString(version) {
+		return fmt.Errorf("无效的环境版本: %s", version)
+	}
+	scriptPath := filepath.Join(envDir, version+".sh")
+	if err := os.Remove(scriptPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("环境脚本不存在: %s", scriptPath)
+		}
+		return err
+	}
+	return nil
+}
+
+// Problem 是 Validate 发现的问题
+type Problem struct {
+	Path    string
+	Message string
+	Warning bool // 只是警告，不影响构建
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// Validate 检查模板目录的结构、脚本和描述文件
+func Validate(templatesDir string) []Problem {
+	var problems []Problem
+	report := func(path string, warning bool, format string, args ...any) {
+		problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: warning})
+	}
+
+	for _, name := range []string{"Dockerfile", "setup.sh"} {
+		path := filepath.Join(templatesDir, name)
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			report(path, false, "文件不存在，请先执行 vbox template init")
+		}
+	}
+
+	// Dockerfile 模板需要能用每个基础镜像渲染，经典构建器和 BuildKit 各渲染一次
+	dockerfilePath := filepath.Join(templatesDir, "Dockerfile")
+	if content, err := os.ReadFile(dockerfilePath); err == nil {
+		if !bytes.Contains(content, []byte("{{")) {
+			report(dockerfilePath, true, "不是模板，只能使用默认基础镜像，可以执行 vbox template upgrade 更新")
+		} else {
+			for _, base := range bases {
+				for _, buildkit := range []bool{false, true} {
+					if _, err := render(dockerfilePath, content, DockerfileData{Base: base, BuildKit: buildkit}); err != nil {
+						report(dockerfilePath, false, "无法用基础镜像 %s 渲染 (BuildKit: %v): %v", base.Name, buildkit, err)
+					}
+				}
+			}
+		}
+	}
+
+	root := filepath.Join(templatesDir, "template")
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		report(root, false, "无法读取模板目录: %v", err)
+		return problems
+	}
+
+	for _, dir := range dirs {
+		dirPath := filepath.Join(root, dir.Name())
+		if !dir.IsDir() {
+			report(dirPath, true, "模板目录中只应包含环境目录")
+			continue
+		}
+		if !validName.MatchString(dir.Name()) {
+			report(dirPath, false, "无效的环境名称")
+		}
+
+		files, err := os.ReadDir(dirPath)
+		if err != nil {
+			report(dirPath, false, "无法读取环境目录: %v", err)
+			continue
+		}
+
+		hasScript, hasGeneric := false, false
+		var versions []string
+		for _, file := range files {
+			path := filepath.Join(dirPath, file.Name())
+			// 子目录、.vboxignore 和辅助文件随构建上下文放入镜像，由环境脚本使用
+			if file.IsDir() || !isTemplateFile(file.Name()) {
+				continue
+			}
+
+			switch {
+			case file.Name() == ManifestFileName:
+				if _, err := LoadManifest(dirPath); err != nil {
+					report(path, false, "%v", err)
+				}
+				continue
+			case file.Name() == GenericTemplateName:
+				hasScript, hasGeneric = true, true
+				if _, err := Render(path, ScriptData{}); err != nil {
+					report(path, false, "%v", err)
+				}
+				continue
+			case file.Name() == GenericScriptName:
+				hasGeneric = true
+			default:
+				versions = append(versions, strings.TrimSuffix(file.Name(), ".sh"))
+			}
+			hasScript = true
+
+			problems = append(problems, validateScript(path)...)
+		}
+
+		if !hasScript {
+			report(dirPath, false, "没有任何环境脚本")
+		}
+
+		// 描述文件中声明的版本必须有对应的脚本
+		if m, err := LoadManifest(dirPath); err == nil && m != nil && !hasGeneric {
+			for _, version := range m.Versions {
+				if !slices.Contains(versions, version) {
+					report(dirPath, false, "版本 %s 在 %s 中声明，但没有 %s.sh 或通用脚本", version, ManifestFileName, version)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// validateScript 检查脚本是否可执行且以 shebang 开头
+func validateScript(path string) []Problem {
+	var problems []Problem
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return []Problem{{Path: path, Message: err.Error()}}
+	}
+	// Windows 上没有可执行权限位
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		problems = append(problems, Problem{Path: path, Message: "脚本不可执行，请执行 chmod +x"})
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return append(problems, Problem{Path: path, Message: err.Error()})
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		problems = append(problems, Problem{Path: path, Message: "脚本应以 shebang 开头，如 #!/bin/bash"})
+	}
+	return problems
+}
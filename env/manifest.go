@@ -0,0 +1,191 @@
+package template
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ManifestFileName 是环境模板的描述文件，可选
+const ManifestFileName = "template.yaml"
+
+// Manifest 描述一个环境模板
+type Manifest struct {
+	Description    string            `yaml:"description"`
+	Versions       []string          `yaml:"versions"`        // 支持的版本，为空时不限制
+	VersionPattern string            `yaml:"version_pattern"` // 正则表达式，匹配的版本即使不在 versions 中也可以使用
+	Aliases        map[string]string `yaml:"aliases"`         // 版本别名，如 stable: 1.25.0
+	Packages       Packages          `yaml:"packages"`        // 执行环境脚本前安装的系统软件包
+	Env            map[string]string `yaml:"env"`             // 导出到登录 shell 的环境变量，值中可以引用其他变量，如 $PATH
+	Ports          []int             `yaml:"ports"`           // 环境中服务常用的端口
+	Verify         []string          `yaml:"verify"`          // 冒烟测试命令，以 box 用户在登录 shell 中执行
+	Artifacts      []Artifact        `yaml:"artifacts"`       // 在主机上下载、校验并缓存的文件
+}
+
+// Packages 是执行环境脚本前安装的系统软件包
+// 可以写成列表（所有基础镜像使用相同的包名），也可以按基础镜像的软件包类型分别列出，如 {debian: [build-essential], alpine: [build-base]}
+type Packages struct {
+	All    []string
+	Family map[string][]string // 软件包类型 (debian、fedora、alpine) -> 包名
+}
+
+// UnmarshalYAML 解析列表或按软件包类型分组的映射
+func (p *Packages) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		return node.Decode(&p.Family)
+	}
+	return node.Decode(&p.All)
+}
+
+// For 返回软件包类型为 family 的基础镜像上要安装的包
+func (p Packages) For(family string) []string {
+	if p.Family != nil {
+		return p.Family[family]
+	}
+	return p.All
+}
+
+// Empty 是否没有声明任何软件包
+func (p Packages) Empty() bool {
+	return len(p.All) == 0 && len(p.Family) == 0
+}
+
+// String 返回用于显示的软件包列表
+func (p Packages) String() string {
+	if p.Family == nil {
+		return strings.Join(p.All, " ")
+	}
+	var parts []string
+	for _, family := range slices.Sorted(maps.Keys(p.Family)) {
+		parts = append(parts, family+": "+strings.Join(p.Family[family], " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+var (
+	validEnvKey      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	validPackageName = regexp.MustCompile(`^[a-z0-9][a-z0-9+.:=~-]*$`)
+)
+
+// ParseManifest 解析 template.yaml，不允许未知字段
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("解析 %s 失败: %w", ManifestFileName, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// LoadManifest 读取环境目录中的 template.yaml，不存在时返回 nil
+func LoadManifest(envDir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(envDir, ManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m, err := ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("环境 %s: %w", filepath.Base(envDir), err)
+	}
+	return m, nil
+}
+
+// Validate 检查描述文件中的字段
+func (m *Manifest) Validate() error {
+	if m.VersionPattern != "" {
+		if _, err := regexp.Compile(m.VersionPattern); err != nil {
+			return fmt.Errorf("无效的 version_pattern: %w", err)
+		}
+	}
+	for alias, version := range m.Aliases {
+		if len(m.Versions) > 0 && !m.allows(version) {
+			return fmt.Errorf("别名 %s 指向未声明的版本 %s", alias, version)
+		}
+	}
+	pkgs := slices.Clone(m.Packages.All)
+	for family, names := range m.Packages.Family {
+		if !slices.Contains(families, family) {
+			return fmt.Errorf("未知的软件包类型 %s，可用类型: %s", family, strings.Join(families, ", "))
+		}
+		pkgs = append(pkgs, names...)
+	}
+	for _, pkg := range pkgs {
+		if !validPackageName.MatchString(pkg) {
+			return fmt.Errorf("无效的软件包名: %s", pkg)
+		}
+	}
+	for key := range m.Env {
+		if !validEnvKey.MatchString(key) {
+			return fmt.Errorf("无效的环境变量名: %s", key)
+		}
+	}
+	for _, port := range m.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("无效的端口: %d", port)
+		}
+	}
+	names := make(map[string]bool, len(m.Artifacts))
+	for _, artifact := range m.Artifacts {
+		if err := artifact.validate(); err != nil {
+			return err
+		}
+		if names[artifact.Name] {
+			return fmt.Errorf("重复的下载文件: %s", artifact.Name)
+		}
+		names[artifact.Name] = true
+	}
+	return nil
+}
+
+// ResolveVersion 展开版本别名，在支持的版本中解析 latest、部分版本和范围，并检查版本是否受支持
+func (m *Manifest) ResolveVersion(version string) (string, error) {
+	return m.ResolveVersionIn(version, nil)
+}
+
+// ResolveVersionIn 与 ResolveVersion 相同，描述文件没有声明 versions 时从 available 中选择版本
+func (m *Manifest) ResolveVersionIn(version string, available []string) (string, error) {
+	if m != nil {
+		if v, ok := m.Aliases[version]; ok {
+			version = v
+		}
+		if len(m.Versions) > 0 {
+			available = m.Versions
+		}
+	}
+	version, err := MatchVersion(version, available)
+	if err != nil {
+		return "", err
+	}
+	if m != nil && len(m.Versions) > 0 && !m.allows(version) {
+		return "", fmt.Errorf("不支持的版本 %s，可用版本: %v", version, m.Versions)
+	}
+	return version, nil
+}
+
+// allows 判断版本是否在 versions 中或匹配 version_pattern
+func (m *Manifest) allows(version string) bool {
+	if slices.Contains(m.Versions, version) {
+		return true
+	}
+	if m.VersionPattern == "" {
+		return false
+	}
+	matched, err := regexp.MatchString(m.VersionPattern, version)
+	return err == nil && matched
+}
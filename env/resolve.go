@@ -0,0 +1,82 @@
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// Script 表示为某个环境版本解析出的安装脚本
+type Script struct {
+	Name     string
+	Version  string
+	Path     string // 脚本路径
+	Layer    Layer  // 脚本所在的模板层
+	Generic  bool   // 是否为通用脚本
+	Template bool   // 是否需要先用 text/template 渲染
+}
+
+// ScriptData 是通用脚本模板可用的变量
+type ScriptData struct {
+	Name    string
+	Version string
+	Arch    string // Go 风格的架构名，如 amd64、arm64
+	User    string
+	Shell   string
+	Home    string
+}
+
+// ResolveScript 按模板层的优先级为 name:version 查找安装脚本
+// 在环境所在的目录中优先使用 <version>.sh，其次是 install.sh，最后是 install.sh.tmpl
+func ResolveScript(layers []Layer, name, version string) (Script, error) {
+	envDir, layer, err := FindEnv(layers, name)
+	if err != nil {
+		return Script{}, err
+	}
+
+	candidates := []Script{
+		{Path: filepath.Join(envDir, version+".sh")},
+		{Path: filepath.Join(envDir, GenericScriptName), Generic: true},
+		{Path: filepath.Join(envDir, GenericTemplateName), Generic: true, Template: true},
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate.Path); err == nil {
+			candidate.Name = name
+			candidate.Version = version
+			candidate.Layer = layer
+			return candidate, nil
+		}
+	}
+
+	return Script{}, fmt.Errorf("环境脚本不存在: %s，且没有通用脚本 %s 或 %s",
+		candidates[0].Path, GenericScriptName, GenericTemplateName)
+}
+
+// Render 渲染通用脚本模板
+func Render(scriptPath string, data ScriptData) ([]byte, error) {
+	content, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	out, err := render(scriptPath, content, data)
+	if err != nil {
+		return nil, fmt.Errorf("渲染脚本模板失败: %w", err)
+	}
+	return out, nil
+}
+
+// render 用 text/template 渲染 content，引用不存在的字段时返回错误
+func render(path string, content []byte, data any) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
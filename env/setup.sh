@@ -32,38 +32,86 @@ warning_msg() {
 
 echo "正在启动 SSH 开发容器..."
 
+# box 用户信息由镜像的环境变量提供，兼容旧镜像
+VBOX_USER="${VBOX_USER:-devbox}"
+VBOX_HOME="${VBOX_HOME:-/home/${VBOX_USER}}"
+
 # 检查必要的目录是否存在
-if [ ! -d "/home/devbox" ]; then
-    error_exit "用户目录 /home/devbox 不存在"
+if [ ! -d "${VBOX_HOME}" ]; then
+    error_exit "用户目录 ${VBOX_HOME} 不存在"
+fi
+
+if [ ! -d "${VBOX_HOME}/.ssh" ]; then
+    error_exit "SSH 目录 ${VBOX_HOME}/.ssh 不存在"
+fi
+
+# 修改 box 用户组的 GID 和用户的 UID，优先使用 shadow 的 groupmod/usermod，
+# 没有时（如只有 busybox 的 Alpine）直接编辑 /etc/group 和 /etc/passwd
+set_gid() {
+    if command -v groupmod >/dev/null 2>&1; then
+        groupmod -o -g "$1" "$VBOX_USER"
+    else
+        sed -i "s/^\(${VBOX_USER}:[^:]*\):[0-9]*:/\1:$1:/" /etc/group &&
+            sed -i "s/^\(${VBOX_USER}:[^:]*:[0-9]*\):[0-9]*:/\1:$1:/" /etc/passwd
+    fi
+}
+
+set_uid() {
+    if command -v usermod >/dev/null 2>&1; then
+        usermod -o -u "$1" "$VBOX_USER"
+    else
+        sed -i "s/^\(${VBOX_USER}:[^:]*\):[0-9]*:/\1:$1:/" /etc/passwd
+    fi
+}
+
+# 将 box 用户的 UID/GID 映射为主机用户，修复挂载目录的权限
+VBOX_UID="${VBOX_UID:-}"
+VBOX_GID="${VBOX_GID:-}"
+if [ -n "$VBOX_GID" ] && [ "$(id -g "$VBOX_USER")" != "$VBOX_GID" ]; then
+    echo "将 box 用户组的 GID 修改为 $VBOX_GID..."
+    if ! set_gid "$VBOX_GID"; then
+        error_exit "无法修改 box 用户组的 GID"
+    fi
+    success_msg "GID 已修改为 $VBOX_GID"
+fi
+
+if [ -n "$VBOX_UID" ] && [ "$(id -u "$VBOX_USER")" != "$VBOX_UID" ]; then
+    echo "将 box 用户的 UID 修改为 $VBOX_UID..."
+    if ! set_uid "$VBOX_UID"; then
+        error_exit "无法修改 box 用户的 UID"
+    fi
+    success_msg "UID 已修改为 $VBOX_UID"
 fi
 
-if [ ! -d "/home/devbox/.ssh" ]; then
-    error_exit "SSH 目录 /home/devbox/.ssh 不存在"
+if [ -n "$VBOX_UID" ] || [ -n "$VBOX_GID" ]; then
+    # 只修正用户目录和工作目录本身，挂载进来的内容保持主机上的所有者
+    chown -R "${VBOX_USER}:${VBOX_USER}" "${VBOX_HOME}" 2>/dev/null || warning_msg "无法修改用户目录的所有者"
+    chown "${VBOX_USER}:${VBOX_USER}" /workspace 2>/dev/null || warning_msg "无法修改工作目录的所有者"
 fi
 
 # 检查 authorized_keys 文件
-if [ -f /home/devbox/.ssh/authorized_keys ]; then
+if [ -f "${VBOX_HOME}/.ssh/authorized_keys" ]; then
     echo "检测到 authorized_keys 文件..."
     
     # 检查文件是否可读
-    if [ ! -r /home/devbox/.ssh/authorized_keys ]; then
+    if [ ! -r "${VBOX_HOME}/.ssh/authorized_keys" ]; then
         error_exit "authorized_keys 文件不可读，请检查挂载权限"
     fi
     
     # 检查文件是否为空
-    if [ ! -s /home/devbox/.ssh/authorized_keys ]; then
+    if [ ! -s "${VBOX_HOME}/.ssh/authorized_keys" ]; then
         error_exit "authorized_keys 文件为空，无法进行 SSH 认证"
     fi
     
     # 尝试修复权限（允许失败）
     echo "尝试修复 authorized_keys 权限..."
-    if chown devbox:devbox /home/devbox/.ssh/authorized_keys 2>/dev/null; then
+    if chown "${VBOX_USER}:${VBOX_USER}" "${VBOX_HOME}/.ssh/authorized_keys" 2>/dev/null; then
         success_msg "文件所有者已修改"
     else
         warning_msg "无法修改文件所有者（可能是只读挂载）"
     fi
     
-    if chmod 600 /home/devbox/.ssh/authorized_keys 2>/dev/null; then
+    if chmod 600 "${VBOX_HOME}/.ssh/authorized_keys" 2>/dev/null; then
         success_msg "文件权限已修改"
     else
         warning_msg "无法修改文件权限（可能是只读挂载）"
@@ -71,18 +119,18 @@ if [ -f /home/devbox/.ssh/authorized_keys ]; then
     
     success_msg "authorized_keys 处理完成"
 else
-    error_exit "未找到 authorized_keys 文件，请确保正确挂载公钥: -v ~/.ssh/demo.pub:/home/devbox/.ssh/authorized_keys:ro"
+    error_exit "未找到 authorized_keys 文件，请确保正确挂载公钥: -v ~/.ssh/demo.pub:${VBOX_HOME}/.ssh/authorized_keys:ro"
 fi
 
 # 尝试设置 SSH 目录权限（允许失败）
 echo "尝试设置 SSH 目录权限..."
-if chown -R devbox:devbox /home/devbox/.ssh 2>/dev/null; then
+if chown -R "${VBOX_USER}:${VBOX_USER}" "${VBOX_HOME}/.ssh" 2>/dev/null; then
     success_msg "SSH 目录所有者已设置"
 else
     warning_msg "无法修改 SSH 目录所有者"
 fi
 
-if chmod 700 /home/devbox/.ssh 2>/dev/null; then
+if chmod 700 "${VBOX_HOME}/.ssh" 2>/dev/null; then
     success_msg "SSH 目录权限已设置"
 else
     warning_msg "无法修改 SSH 目录权限"
@@ -117,7 +165,7 @@ if [ ! -d "/workspace" ]; then
     if ! mkdir -p /workspace; then
         error_exit "无法创建工作目录 /workspace"
     fi
-    if ! chown devbox:devbox /workspace; then
+    if ! chown "${VBOX_USER}:${VBOX_USER}" /workspace; then
         error_exit "无法设置工作目录所有者"
     fi
 fi
@@ -126,7 +174,7 @@ success_msg "工作目录检查完成"
 
 # 显示容器信息
 echo -e "\n${GREEN}=== 容器启动成功 ===${NC}"
-echo "- 用户: devbox"
+echo "- 用户: ${VBOX_USER}"
 echo "- 工作目录: /workspace"
 echo "- SSH 端口: 22"
 echo "- 配置状态: 所有检查通过"
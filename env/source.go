@@ -0,0 +1,318 @@
+package template
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SourcesFileName 记录已添加的模板来源
+const SourcesFileName = "sources.json"
+
+// 模板来源的类型
+const (
+	SourceGit = "git" // git 仓库，克隆到 sources 目录并固定到某个提交
+	SourceDir = "dir" // 本地目录，直接使用
+)
+
+// Source 是一个外部模板来源
+type Source struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`              // git 地址或本地目录
+	Kind      string    `json:"kind"`             // git | dir
+	Ref       string    `json:"ref,omitempty"`    // 跟踪的分支或标签，为空时使用默认分支
+	Commit    string    `json:"commit,omitempty"` // 当前固定的提交
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Root 返回来源的内容所在目录
+func (s Source) Root(sourcesDir string) string {
+	if s.Kind == SourceDir {
+		return s.URL
+	}
+	return filepath.Join(sourcesDir, s.Name)
+}
+
+// EnvRoot 返回来源中包含环境目录的目录：有 template 子目录时使用它，否则使用根目录
+func (s Source) EnvRoot(sourcesDir string) string {
+	root := s.Root(sourcesDir)
+	if info, err := os.Stat(filepath.Join(root, "template")); err == nil && info.IsDir() {
+		return filepath.Join(root, "template")
+	}
+	return root
+}
+
+// LoadSources 读取已添加的模板来源，按添加顺序返回
+func LoadSources(sourcesDir string) ([]Source, error) {
+	data, err := os.ReadFile(filepath.Join(sourcesDir, SourcesFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sources []Source
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %w", SourcesFileName, err)
+	}
+	return sources, nil
+}
+
+func saveSources(sourcesDir string, sources []Source) error {
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(sourcesDir, SourcesFileName), data, 0644)
+}
+
+// git 在 dir 中执行 git 命令，返回去掉首尾空白的输出
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	subcommand := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s 失败: %w: %s", subcommand, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// isBareDir 判断 url 是否为不受 git 管理的本地目录
+func isBareDir(url string) bool {
+	if strings.Contains(url, "://") {
+		return false
+	}
+	info, err := os.Stat(url)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(url, ".git"))
+	return os.IsNotExist(err)
+}
+
+// AddSource 添加模板来源，git 仓库会被克隆并固定到当前提交
+func AddSource(ctx context.Context, sourcesDir, name, url, ref string) (*Source, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("无效的来源名称: %s", name)
+	}
+
+	sources, err := LoadSources(sourcesDir)
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(sources, func(s Source) bool { return s.Name == name }) {
+		return nil, fmt.Errorf("模板来源 %s 已存在", name)
+	}
+
+	source := Source{Name: name, URL: url, Kind: SourceGit, Ref: ref, UpdatedAt: time.Now()}
+	if isBareDir(url) {
+		if ref != "" {
+			return nil, fmt.Errorf("本地目录不支持指定 ref")
+		}
+		abs, err := filepath.Abs(url)
+		if err != nil {
+			return nil, err
+		}
+		source.Kind, source.URL = SourceDir, abs
+	} else {
+		dest := source.Root(sourcesDir)
+		if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(dest); err == nil {
+			return nil, fmt.Errorf("目录 %s 已存在", dest)
+		}
+
+		args := []string{"clone", "--quiet"}
+		if ref != "" {
+			args = append(args, "--branch", ref)
+		}
+		if _, err := git(ctx, "", append(args, "--", url, dest)...); err != nil {
+			os.RemoveAll(dest)
+			return nil, err
+		}
+		if source.Commit, err = git(ctx, dest, "rev-parse", "HEAD"); err != nil {
+			os.RemoveAll(dest)
+			return nil, err
+		}
+	}
+
+	if info, err := os.Stat(source.EnvRoot(sourcesDir)); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("模板来源 %s 不可访问", url)
+	}
+
+	if err := saveSources(sourcesDir, append(sources, source)); err != nil {
+		return nil, err
+	}
+	return &source, nil
+}
+
+// UpdateSource 拉取 git 来源的最新提交并重新固定，返回更新前的提交
+// 本地目录来源总是使用目录中的当前内容，只更新时间
+func UpdateSource(ctx context.Context, sourcesDir, name string) (*Source, string, error) {
+	sources, err := LoadSources(sourcesDir)
+	if err != nil {
+		return nil, "", err
+	}
+	i := slices.IndexFunc(sources, func(s Source) bool { return s.Name == name })
+	if i < 0 {
+		return nil, "", fmt.Errorf("模板来源 %s 不存在", name)
+	}
+	source := &sources[i]
+	oldCommit := source.Commit
+
+	if source.Kind == SourceGit {
+		dest := source.Root(sourcesDir)
+		if _, err := git(ctx, dest, "fetch", "--quiet", "--tags", "--force", "origin"); err != nil {
+			return nil, "", err
+		}
+
+		// 分支优先，其次是标签
+		targets := []string{"origin/HEAD"}
+		if source.Ref != "" {
+			targets = []string{"origin/" + source.Ref, "refs/tags/" + source.Ref, source.Ref}
+		}
+		var commit string
+		for _, target := range targets {
+			if commit, err = git(ctx, dest, "rev-parse", "--verify", "--quiet", target+"^{commit}"); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("在 %s 中找不到 %s", source.URL, targets[0])
+		}
+		if _, err := git(ctx, dest, "checkout", "--quiet", "--detach", commit); err != nil {
+			return nil, "", err
+		}
+		source.Commit = commit
+	}
+	source.UpdatedAt = time.Now()
+
+	if err := saveSources(sourcesDir, sources); err != nil {
+		return nil, "", err
+	}
+	return source, oldCommit, nil
+}
+
+// RemoveSource 删除模板来源，git 来源的克隆目录也会被删除
+func RemoveSource(sourcesDir, name string) error {
+	sources, err := LoadSources(sourcesDir)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(sources, func(s Source) bool { return s.Name == name })
+	if i < 0 {
+		return fmt.Errorf("模板来源 %s 不存在", name)
+	}
+
+	if sources[i].Kind == SourceGit {
+		if err := os.RemoveAll(sources[i].Root(sourcesDir)); err != nil {
+			return err
+		}
+	}
+	return saveSources(sourcesDir, slices.Delete(sources, i, i+1))
+}
+
+// 模板层的类型，按优先级从高到低
+const (
+	LayerLocal    = "local"    // 模板目录中用户添加或修改过的环境
+	LayerSource   = "source"   // 外部模板来源
+	LayerEmbedded = "embedded" // vbox 内置并由 template init 安装的环境
+)
+
+// Layer 是查找环境模板的一层
+type Layer struct {
+	Kind string
+	Name string // 来源名称，只对 LayerSource 有意义
+	Dir  string // 包含环境目录的目录
+}
+
+func (l Layer) String() string {
+	if l.Kind == LayerSource {
+		return LayerSource + ":" + l.Name
+	}
+	return l.Kind
+}
+
+// Layers 返回按优先级排序的模板层：本地修改 > 外部来源（按添加顺序）> 内置模板
+func Layers(templatesDir, sourcesDir string) ([]Layer, error) {
+	sources, err := LoadSources(sourcesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	envRoot := filepath.Join(templatesDir, "template")
+	layers := []Layer{{Kind: LayerLocal, Dir: envRoot}}
+	for _, source := range sources {
+		layers = append(layers, Layer{Kind: LayerSource, Name: source.Name, Dir: source.EnvRoot(sourcesDir)})
+	}
+	return append(layers, Layer{Kind: LayerEmbedded, Dir: envRoot}), nil
+}
+
+// FindEnv 按优先级查找环境 name 所在的目录
+// 模板目录中的环境只有在包含用户添加或修改过的文件时才属于 local 层，否则视为内置模板
+func FindEnv(layers []Layer, name string) (string, Layer, error) {
+	for _, layer := range layers {
+		envDir := filepath.Join(layer.Dir, name)
+		if info, err := os.Stat(envDir); err != nil || !info.IsDir() {
+			continue
+		}
+		if layer.Kind == LayerLocal && !customized(layer.Dir, name) {
+			continue
+		}
+		return envDir, layer, nil
+	}
+	return "", Layer{}, fmt.Errorf("环境模板 %s 不存在", name)
+}
+
+// customized 判断模板目录中的环境是否包含用户添加或修改过的文件
+// 与当前内置模板或安装时记录的校验和一致的文件都不算修改，升级 vbox 后未更新的旧内置模板不会优先于外部来源
+func customized(envRoot, name string) bool {
+	envDir := filepath.Join(envRoot, name)
+	// 状态文件在模板目录中，envRoot 是其中的 template 子目录
+	st, err := loadState(filepath.Dir(envRoot))
+	if err != nil {
+		st = &state{}
+	}
+	files, err := os.ReadDir(envDir)
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		// 内置模板没有子目录和 .vboxignore，只能是用户添加的
+		if file.IsDir() || file.Name() == IgnoreFileName {
+			return true
+		}
+		if !isTemplateFile(file.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(envDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		embedded, hasEmbedded := lookupEmbedded(name, file.Name())
+		if originOf(data, embedded, hasEmbedded) == OriginInstalled {
+			continue
+		}
+		if !st.installed(path.Join("template", name, file.Name()), checksum(data)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+// StateFileName 记录已安装的内置模板文件的校验和，用于判断文件是否被用户修改
+const StateFileName = ".vbox-state.json"
+
+// NewFileSuffix 是 upgrade 为已修改文件写入新版本时使用的后缀
+const NewFileSuffix = ".new"
+
+// Status 表示模板目录中的文件与内置模板的关系
+type Status string
+
+const (
+	StatusMissing  Status = "missing"  // 模板目录中没有该文件
+	StatusUpToDate Status = "uptodate" // 与内置模板一致
+	StatusOutdated Status = "outdated" // 用户未修改，但内置模板有更新
+	StatusModified Status = "modified" // 用户修改过
+)
+
+// FileState 是一个内置模板文件的安装状态
+type FileState struct {
+	RelPath   string // 相对模板目录的路径，使用 "/" 分隔
+	Status    Status
+	Installed []byte // 模板目录中的内容，StatusMissing 时为 nil
+	Embedded  []byte
+	mode      os.FileMode
+}
+
+// InstallOptions 控制 Install 如何处理已存在的文件
+type InstallOptions struct {
+	Force    bool // 覆盖用户修改过的文件
+	WriteNew bool // 为用户修改过的文件写入 <file>.new
+}
+
+// InstallReport 是 Install 的结果
+type InstallReport struct {
+	Written  []string // 新写入或更新的文件
+	Skipped  []string // 用户修改过、未覆盖的文件
+	NewFiles []string // 写入的 .new 文件
+}
+
+// state 是 StateFileName 的内容
+type state struct {
+	Files map[string]string `json:"files"` // 相对路径 -> 安装时内容的 sha256
+
+	missing bool // 没有状态文件，模板目录由记录校验和之前的 vbox 安装
+}
+
+// shippedChecksums 是记录校验和之前的 vbox 内置的文件，没有状态文件时与这些版本一致的文件视为未修改
+var shippedChecksums = map[string][]string{
+	"Dockerfile":                {"c465656de34de595f82f9668d211c6928079f4b4d78c3ad5174b2f354483c07e"},
+	"setup.sh":                  {"c5a748b16125d62252b1c5bc5c1995ec1738951122f90db23cf84fd121a9be0e"},
+	"template/golang/1.25.0.sh": {"337be66f9167e8addfd58d3db172ef3e1491272633f51d0576efdca841715902"},
+}
+
+// installed 判断内容为 sum 的文件是否是 vbox 安装后未被修改过的
+func (st *state) installed(relPath, sum string) bool {
+	if st.Files[relPath] == sum {
+		return true
+	}
+	return st.missing && slices.Contains(shippedChecksums[relPath], sum)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func loadState(targetDir string) (*state, error) {
+	st := &state{Files: make(map[string]string)}
+	data, err := os.ReadFile(filepath.Join(targetDir, StateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			st.missing = true
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Files == nil {
+		st.Files = make(map[string]string)
+	}
+	return st, nil
+}
+
+func (st *state) save(targetDir string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(targetDir, StateFileName), data, 0644)
+}
+
+// embeddedFile 是要安装到模板目录的一个内置文件
+type embeddedFile struct {
+	relPath string
+	data    []byte
+	mode    os.FileMode
+}
+
+// embeddedFiles 返回所有内置文件：Dockerfile、setup.sh 和各环境的文件
+func embeddedFiles() []embeddedFile {
+	files := []embeddedFile{
+		{relPath: "Dockerfile", data: baseDockerfile, mode: 0644},
+		{relPath: "setup.sh", data: setupScript, mode: 0755},
+	}
+	for _, env := range envs {
+		files = append(files, embeddedFile{
+			relPath: path.Join("template", env.Name, env.Script),
+			data:    env.Data,
+			mode:    env.Mode(),
+		})
+	}
+	return files
+}
+
+// Statuses 比较模板目录和内置模板，返回每个内置文件的状态
+func Statuses(targetDir string) ([]FileState, error) {
+	st, err := loadState(targetDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []FileState
+	for _, file := range embeddedFiles() {
+		fs := FileState{RelPath: file.relPath, Embedded: file.data, mode: file.mode}
+
+		data, err := os.ReadFile(filepath.Join(targetDir, filepath.FromSlash(file.relPath)))
+		switch {
+		case os.IsNotExist(err):
+			fs.Status = StatusMissing
+		case err != nil:
+			return nil, err
+		default:
+			fs.Installed = data
+			sum := checksum(data)
+			switch {
+			case sum == checksum(file.data):
+				fs.Status = StatusUpToDate
+			case st.installed(file.relPath, sum):
+				// 内容与上次安装时或旧版本内置的一致，说明用户没有修改过
+				fs.Status = StatusOutdated
+			default:
+				fs.Status = StatusModified
+			}
+		}
+		states = append(states, fs)
+	}
+	return states, nil
+}
+
+// Install 将内置模板安装到 targetDir
+// 缺失的文件和用户未修改过的文件会被写入，用户修改过的文件默认保留
+func Install(targetDir string, opts InstallOptions) (*InstallReport, error) {
+	if err := os.MkdirAll(filepath.Join(targetDir, "template"), 0755); err != nil {
+		return nil, err
+	}
+
+	st, err := loadState(targetDir)
+	if err != nil {
+		return nil, err
+	}
+	states, err := Statuses(targetDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &InstallReport{}
+	for _, fs := range states {
+		filePath := filepath.Join(targetDir, filepath.FromSlash(fs.RelPath))
+
+		switch {
+		case fs.Status == StatusUpToDate:
+			// 补充记录旧版本安装的或用户手动合并后的文件
+			st.Files[fs.RelPath] = checksum(fs.Embedded)
+			continue
+		case fs.Status == StatusModified && opts.WriteNew:
+			if err := os.WriteFile(filePath+NewFileSuffix, fs.Embedded, fs.mode); err != nil {
+				return nil, err
+			}
+			report.NewFiles = append(report.NewFiles, fs.RelPath+NewFileSuffix)
+			continue
+		case fs.Status == StatusModified && !opts.Force:
+			report.Skipped = append(report.Skipped, fs.RelPath)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filePath, fs.Embedded, fs.mode); err != nil {
+			return nil, err
+		}
+		// WriteFile 不会修改已存在文件的权限
+		if err := os.Chmod(filePath, fs.mode); err != nil {
+			return nil, err
+		}
+		st.Files[fs.RelPath] = checksum(fs.Embedded)
+		report.Written = append(report.Written, fs.RelPath)
+	}
+
+	if err := st.save(targetDir); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -16,12 +16,35 @@ var baseDockerfile []byte
 //go:embed setup.sh
 var setupScript []byte
 
+// 通用脚本文件名，没有 <version>.sh 时使用
+const (
+	GenericScriptName   = "install.sh"      // 通过环境变量 VERSION、ARCH、VBOX_USER 等接收参数
+	GenericTemplateName = "install.sh.tmpl" // Go text/template，在主机上渲染后使用
+)
+
+// IgnoreFileName 列出模板目录中不放入构建上下文的文件，语法与 .gitignore 相同
+const IgnoreFileName = ".vboxignore"
+
 type Env struct {
 	Name    string
-	Version string
+	Version string // 通用脚本和 template.yaml 的 Version 为空
+	Script  string // 文件名，如 1.25.0.sh、install.sh、template.yaml
 	Data    []byte
 }
 
+// Generic 是否为适用于所有版本的通用脚本
+func (e Env) Generic() bool {
+	return e.Script == GenericScriptName || e.Script == GenericTemplateName
+}
+
+// Mode 返回写入模板目录时的文件权限，脚本需要可执行
+func (e Env) Mode() os.FileMode {
+	if strings.HasSuffix(e.Script, ".sh") {
+		return 0755
+	}
+	return 0644
+}
+
 var envs []Env
 
 func init() {
@@ -36,9 +59,12 @@ func init() {
 		}
 		for _, versionFile := range versionFS {
 			env := Env{
-				Name: file.Name(),
+				Name:   file.Name(),
+				Script: versionFile.Name(),
+			}
+			if !env.Generic() && strings.HasSuffix(env.Script, ".sh") {
+				env.Version = strings.TrimSuffix(versionFile.Name(), ".sh")
 			}
-			env.Version = strings.TrimSuffix(versionFile.Name(), ".sh")
 			env.Data, err = envFS.ReadFile(filepath.Join("template", file.Name(), versionFile.Name()))
 			if err != nil {
 				panic(err)
@@ -48,44 +74,8 @@ func init() {
 	}
 }
 
+// Init 安装内置模板，只写入缺失的文件和用户未修改过的文件
 func Init(targetDir string) error {
-	// 创建目标目录
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return err
-	}
-
-	// 写入 Dockerfile
-	dockerfilePath := filepath.Join(targetDir, "Dockerfile")
-	if err := os.WriteFile(dockerfilePath, baseDockerfile, 0644); err != nil {
-		return err
-	}
-
-	// 写入 setup.sh
-	setupScriptPath := filepath.Join(targetDir, "setup.sh")
-	if err := os.WriteFile(setupScriptPath, setupScript, 0644); err != nil {
-		return err
-	}
-
-	// 创建 template 子目录
-	templateDir := filepath.Join(targetDir, "template")
-	if err := os.MkdirAll(templateDir, 0755); err != nil {
-		return err
-	}
-
-	// 遍历 envs 并创建目录结构和文件
-	for _, env := range envs {
-		// 创建环境目录 (如 golang)
-		envDir := filepath.Join(templateDir, env.Name)
-		if err := os.MkdirAll(envDir, 0755); err != nil {
-			return err
-		}
-
-		// 写入版本文件
-		versionFilePath := filepath.Join(envDir, env.Version+".sh")
-		if err := os.WriteFile(versionFilePath, env.Data, 0644); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	_, err := Install(targetDir, InstallOptions{})
+	return err
 }
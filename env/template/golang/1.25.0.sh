@@ -1,25 +1,32 @@
 #!/bin/bash
 
 # Go 环境设置脚本
-# 下载并安装 Go 1.25.0
+# 下载并安装 Go 1.25.0，架构由构建参数 TARGETARCH 传入
 
 set -e
 
-echo "正在下载 Go 1.25.0..."
-wget https://go.dev/dl/go1.25.0.linux-amd64.tar.gz
+ARCH="${TARGETARCH:-${ARCH:-$(uname -m | sed -e 's/x86_64/amd64/' -e 's/aarch64/arm64/')}}"
+TARBALL="go1.25.0.linux-${ARCH}.tar.gz"
 
 echo "正在安装 Go..."
 rm -rf /usr/local/go
-tar -C /usr/local -xzf go1.25.0.linux-amd64.tar.gz
-rm go1.25.0.linux-amd64.tar.gz
+if [ -f "${VBOX_ARTIFACTS:-}/go.tar.gz" ]; then
+    # template.yaml 中声明的安装包已由 vbox 在主机上下载并校验
+    tar -C /usr/local -xzf "${VBOX_ARTIFACTS}/go.tar.gz"
+else
+    echo "正在下载 Go 1.25.0 (${ARCH})..."
+    wget "https://go.dev/dl/${TARBALL}"
+    tar -C /usr/local -xzf "${TARBALL}"
+    rm "${TARBALL}"
+fi
 
 echo "正在配置 Go 环境变量..."
-echo "export PATH=\$PATH:/usr/local/go/bin" >> /home/devbox/.bashrc
-echo "export GOPATH=/home/devbox/go" >> /home/devbox/.bashrc
-echo "export GOBIN=\$GOPATH/bin" >> /home/devbox/.bashrc
+echo "export PATH=\$PATH:/usr/local/go/bin:${VBOX_HOME}/go/bin" >> /etc/profile.d/vbox-golang.sh
+echo "export GOPATH=${VBOX_HOME}/go" >> /etc/profile.d/vbox-golang.sh
+echo "export GOBIN=\$GOPATH/bin" >> /etc/profile.d/vbox-golang.sh
 
 echo "正在创建 Go 工作目录..."
-mkdir -p /home/devbox/go/{bin,src,pkg}
-chown -R devbox:devbox /home/devbox/go
+mkdir -p "${VBOX_HOME}"/go/{bin,src,pkg}
+chown -R "${VBOX_USER}:${VBOX_USER}" "${VBOX_HOME}/go"
 
 echo "Go 1.25.0 安装完成！"
@@ -0,0 +1,52 @@
+#!/bin/bash
+
+# Go 环境通用安装脚本
+# 没有 <version>.sh 时使用，版本由环境变量 VERSION 传入，架构由构建参数 TARGETARCH 传入
+
+set -e
+
+if [ -z "${VERSION:-}" ]; then
+    echo "未指定 Go 版本 (VERSION)" >&2
+    exit 1
+fi
+ARCH="${TARGETARCH:-${ARCH:-$(uname -m | sed -e 's/x86_64/amd64/' -e 's/aarch64/arm64/')}}"
+
+TARBALL="go${VERSION}.linux-${ARCH}.tar.gz"
+# 使用 BuildKit 构建时安装包保存在共享的缓存目录中，下次构建不再下载
+DOWNLOAD_DIR="${VBOX_CACHE_DIR:-/tmp}"
+
+if [ -f "${VBOX_ARTIFACTS:-}/go.tar.gz" ]; then
+    # template.yaml 中声明的安装包已由 vbox 在主机上下载并校验
+    echo "使用 vbox 下载并校验的 ${TARBALL}"
+    TARBALL_PATH="${VBOX_ARTIFACTS}/go.tar.gz"
+elif [ -f "${DOWNLOAD_DIR}/${TARBALL}" ]; then
+    echo "使用缓存的 ${TARBALL}"
+    TARBALL_PATH="${DOWNLOAD_DIR}/${TARBALL}"
+else
+    echo "正在下载 Go ${VERSION} (${ARCH})..."
+    if ! wget -q -O "${DOWNLOAD_DIR}/${TARBALL}.part" "https://go.dev/dl/${TARBALL}"; then
+        rm -f "${DOWNLOAD_DIR}/${TARBALL}.part"
+        echo "下载 ${TARBALL} 失败，请确认版本 ${VERSION} 和架构 ${ARCH} 是否存在" >&2
+        exit 1
+    fi
+    mv "${DOWNLOAD_DIR}/${TARBALL}.part" "${DOWNLOAD_DIR}/${TARBALL}"
+    TARBALL_PATH="${DOWNLOAD_DIR}/${TARBALL}"
+fi
+
+echo "正在安装 Go..."
+rm -rf /usr/local/go
+tar -C /usr/local -xzf "${TARBALL_PATH}"
+if [ "${TARBALL_PATH}" = "/tmp/${TARBALL}" ]; then
+    rm "${TARBALL_PATH}"
+fi
+
+echo "正在配置 Go 环境变量..."
+echo "export PATH=\$PATH:/usr/local/go/bin:${VBOX_HOME}/go/bin" >> /etc/profile.d/vbox-golang.sh
+echo "export GOPATH=${VBOX_HOME}/go" >> /etc/profile.d/vbox-golang.sh
+echo "export GOBIN=\$GOPATH/bin" >> /etc/profile.d/vbox-golang.sh
+
+echo "正在创建 Go 工作目录..."
+mkdir -p "${VBOX_HOME}"/go/{bin,src,pkg}
+chown -R "${VBOX_USER}:${VBOX_USER}" "${VBOX_HOME}/go"
+
+echo "Go ${VERSION} 安装完成！"
@@ -1,6 +1,19 @@
 package template
 
-import "testing"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
 
 func TestInit(t *testing.T) {
 	err := Init("/tmp/vbox/env")
@@ -8,3 +21,835 @@ func TestInit(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestResolveScript 测试版本脚本优先于通用脚本
+func TestResolveScript(t *testing.T) {
+	dir := t.TempDir()
+	envDir := filepath.Join(dir, "template", "golang")
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1.25.0.sh", GenericScriptName} {
+		if err := os.WriteFile(filepath.Join(envDir, name), []byte("#!/bin/bash\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	layers, err := Layers(dir, filepath.Join(dir, "sources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := ResolveScript(layers, "golang", "1.25.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script.Generic || filepath.Base(script.Path) != "1.25.0.sh" {
+		t.Fatalf("应使用版本脚本, 实际为 %s", script.Path)
+	}
+
+	script, err = ResolveScript(layers, "golang", "1.24.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !script.Generic || script.Template || filepath.Base(script.Path) != GenericScriptName {
+		t.Fatalf("应使用通用脚本, 实际为 %s", script.Path)
+	}
+
+	if _, err := ResolveScript(layers, "node", "22"); err == nil {
+		t.Fatal("环境不存在时应返回错误")
+	}
+}
+
+// TestRender 测试通用脚本模板的渲染
+func TestRender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), GenericTemplateName)
+	content := "wget https://go.dev/dl/go{{.Version}}.linux-{{.Arch}}.tar.gz\nchown {{.User}} {{.Home}}\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Render(path, ScriptData{Version: "1.24.6", Arch: "arm64", User: "dev", Home: "/home/dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "wget https://go.dev/dl/go1.24.6.linux-arm64.tar.gz\nchown dev /home/dev\n"
+	if string(data) != want {
+		t.Fatalf("渲染结果不符合预期:\n%s", data)
+	}
+
+	if err := os.WriteFile(path, []byte("{{.Unknown}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Render(path, ScriptData{}); err == nil {
+		t.Fatal("引用未知变量时应返回错误")
+	}
+}
+
+// TestParseManifest 测试 template.yaml 的解析、别名展开和校验
+func TestParseManifest(t *testing.T) {
+	m, err := ParseManifest([]byte(`
+description: Go
+versions: [1.25.0, 1.24.6]
+aliases:
+  stable: 1.25.0
+packages: [build-essential]
+env:
+  GOTOOLCHAIN: local
+ports: [8080]
+verify:
+  - go version
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Description != "Go" || len(m.Verify) != 1 || m.Env["GOTOOLCHAIN"] != "local" || m.Ports[0] != 8080 {
+		t.Fatalf("解析结果不符合预期: %+v", m)
+	}
+	// 列表形式的软件包用于所有基础镜像
+	if got := m.Packages.For(FamilyAlpine); !slices.Equal(got, []string{"build-essential"}) {
+		t.Fatalf("alpine 的软件包为 %v", got)
+	}
+	grouped, err := ParseManifest([]byte("packages: {debian: [build-essential], alpine: [build-base]}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(grouped.Packages.For(FamilyAlpine), []string{"build-base"}) || grouped.Packages.For(FamilyFedora) != nil {
+		t.Fatalf("按类型分组的软件包不符合预期: %+v", grouped.Packages)
+	}
+
+	if v, err := m.ResolveVersion("stable"); err != nil || v != "1.25.0" {
+		t.Fatalf("ResolveVersion(stable) = %s, %v", v, err)
+	}
+	if v, err := m.ResolveVersion("1.24.6"); err != nil || v != "1.24.6" {
+		t.Fatalf("ResolveVersion(1.24.6) = %s, %v", v, err)
+	}
+	if _, err := m.ResolveVersion("1.20.0"); err == nil {
+		t.Fatal("未声明的版本应返回错误")
+	}
+
+	// 没有描述文件时不限制版本
+	var none *Manifest
+	if v, err := none.ResolveVersion("1.20.0"); err != nil || v != "1.20.0" {
+		t.Fatalf("nil Manifest 应原样返回版本: %s, %v", v, err)
+	}
+
+	for _, data := range []string{
+		"unknown: 1",
+		"versions: [1.0]\naliases: {stable: 2.0}",
+		"env: {\"1BAD\": x}",
+		"ports: [70000]",
+		"packages: [\"rm -rf\"]",
+		"packages: {debian: [\"rm -rf\"]}",
+		"packages: {ubuntu: [build-essential]}",
+		"artifacts: [{name: go.tar.gz, url: \"https://example.com/go.tar.gz\"}]",
+		"artifacts: [{name: ../go, url: \"https://example.com/go\", sha256_url: \"https://example.com/go.sha256\"}]",
+		"artifacts: [{name: go, url: \"https://example.com/go\", sha256: {\"1.0\": abc}}]",
+		"artifacts: [{name: go, url: \"https://a/{{.X\", sha256_url: \"https://a/s\"}]",
+		"artifacts: [{name: go, url: \"https://a/go\", sha256_url: \"https://a/s\"}, {name: go, url: \"https://a/go\", sha256_url: \"https://a/s\"}]",
+	} {
+		if _, err := ParseManifest([]byte(data)); err == nil {
+			t.Errorf("ParseManifest(%q) 应返回错误", data)
+		}
+	}
+
+	// 空文件是合法的
+	if _, err := ParseManifest(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestArtifacts 测试下载文件的校验和缓存
+func TestArtifacts(t *testing.T) {
+	content := []byte("go toolchain")
+	h := sha256.Sum256(content)
+	sum := hex.EncodeToString(h[:])
+
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		switch r.URL.Path {
+		case "/go1.25.0.linux-amd64.tar.gz":
+			w.Write(content)
+		case "/go1.25.0.linux-amd64.tar.gz.sha256":
+			w.Write([]byte(sum + "  go1.25.0.linux-amd64.tar.gz\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	artifact := Artifact{
+		Name:      "go.tar.gz",
+		URL:       server.URL + "/go{{.Version}}.linux-{{.Arch}}.tar.gz",
+		SHA256URL: server.URL + "/go{{.Version}}.linux-{{.Arch}}.tar.gz.sha256",
+	}
+	resolved, err := artifact.Resolve("1.25.0", "amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.URL != server.URL+"/go1.25.0.linux-amd64.tar.gz" {
+		t.Fatalf("下载地址不符合预期: %s", resolved.URL)
+	}
+
+	ctx := context.Background()
+	cacheDir := t.TempDir()
+	path, err := FetchArtifact(ctx, cacheDir, resolved, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(content) {
+		t.Fatalf("下载的内容不符合预期: %q, %v", data, err)
+	}
+	if hits != 2 {
+		t.Fatalf("首次下载应请求校验和和文件，实际请求 %d 次", hits)
+	}
+
+	// 缓存命中后不再请求服务器，服务器关闭后也能使用
+	server.Close()
+	if cached, err := FetchArtifact(ctx, cacheDir, resolved, nil); err != nil || cached != path {
+		t.Fatalf("应使用缓存: %s, %v", cached, err)
+	}
+	if hits != 2 {
+		t.Fatalf("缓存命中后不应请求服务器，实际请求 %d 次", hits)
+	}
+
+	// 缓存被改动后重新校验失败，服务器不可用时返回错误
+	if err := os.WriteFile(path, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchArtifact(ctx, cacheDir, resolved, nil); err == nil {
+		t.Fatal("缓存损坏且无法下载时应返回错误")
+	}
+}
+
+// TestArtifactChecksum 测试声明的校验和与下载内容不一致时的处理
+func TestArtifactChecksum(t *testing.T) {
+	content := []byte("node")
+	h := sha256.Sum256(content)
+	sum := hex.EncodeToString(h[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	artifact := Artifact{
+		Name: "node.tar.xz",
+		URL:  server.URL + "/node-v{{.Version}}-{{.Arch}}.tar.xz",
+		SHA256: map[string]string{
+			"22/amd64": sum,
+			"22":       strings.Repeat("0", 64),
+		},
+	}
+	if err := artifact.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// <version>/<arch> 优先于 <version>
+	resolved, err := artifact.Resolve("22", "amd64")
+	if err != nil || resolved.SHA256 != sum {
+		t.Fatalf("Resolve(22, amd64) = %+v, %v", resolved, err)
+	}
+	cacheDir := t.TempDir()
+	if _, err := FetchArtifact(context.Background(), cacheDir, resolved, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err = artifact.Resolve("22", "arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchArtifact(context.Background(), cacheDir, resolved, nil); err == nil || !strings.Contains(err.Error(), "校验失败") {
+		t.Fatalf("校验和不一致时应返回错误: %v", err)
+	}
+	// 校验失败的文件不会留在缓存中
+	entries, _ := os.ReadDir(cacheDir)
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "arm64") {
+			t.Fatalf("校验失败的文件不应保存: %s", entry.Name())
+		}
+	}
+
+	if _, err := artifact.Resolve("20", "amd64"); !errors.Is(err, ErrNoChecksum) {
+		t.Fatalf("没有声明校验和的版本应返回 ErrNoChecksum: %v", err)
+	}
+	if err := (Artifact{Name: "x", URL: "https://a/x", Optional: true}).validate(); err != nil {
+		t.Fatalf("可选的下载文件可以不声明校验和: %v", err)
+	}
+
+	// 内置的 golang 模板为声明的每个版本和架构固定校验和，不从下载地址的同源读取
+	data, err := envFS.ReadFile("template/golang/" + ManifestFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range m.Artifacts {
+		if a.SHA256URL != "" {
+			t.Errorf("内置模板的下载文件 %s 不应使用 sha256_url", a.Name)
+		}
+		for _, version := range m.Versions {
+			for _, arch := range []string{"amd64", "arm64"} {
+				if resolved, err := a.Resolve(version, arch); err != nil || resolved.SHA256 == "" {
+					t.Errorf("下载文件 %s 没有固定 %s/%s 的校验和: %v", a.Name, version, arch, err)
+				}
+			}
+		}
+	}
+	if _, err := (Artifact{Name: "x", URL: "file:///etc/passwd", SHA256URL: "https://a/s"}).Resolve("1", "amd64"); err == nil {
+		t.Fatal("非 http 地址应返回错误")
+	}
+}
+
+// TestListAndValidate 测试模板列表的合并和模板目录的检查
+func TestListAndValidate(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	if problems := Validate(dir); len(problems) != 0 {
+		t.Fatalf("初始化后的模板目录不应有问题: %v", problems)
+	}
+
+	// README 中的模板目录结构：子目录、.vboxignore 和辅助脚本都随构建上下文使用
+	envDir := filepath.Join(dir, "template", "tools")
+	for name, content := range map[string]string{
+		GenericScriptName:    "#!/bin/bash\n. \"$VBOX_TEMPLATE_DIR/.functions.sh\"\n",
+		"files/gitconfig":    "[user]\n",
+		IgnoreFileName:       "*.md\ncache/\n",
+		".functions.sh":      "install_config() { :; }\n",
+		"README.md":          "# tools\n",
+		"lib/common.sh":      "#!/bin/bash\n",
+		"cache/download.bin": "",
+	} {
+		p := filepath.Join(envDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if problems := Validate(dir); len(problems) != 0 {
+		t.Fatalf("README 中的模板目录结构不应有问题: %v", problems)
+	}
+	if err := os.RemoveAll(envDir); err != nil {
+		t.Fatal(err)
+	}
+
+	scriptPath, err := New(dir, "rust", "1.80.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(dir, "rust", "1.80.0"); err == nil {
+		t.Fatal("脚本已存在时应返回错误")
+	}
+
+	// 修改内置脚本
+	installPath := filepath.Join(dir, "template", "golang", GenericScriptName)
+	if err := os.WriteFile(installPath, []byte("#!/bin/bash\necho changed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 删除内置脚本
+	if err := Remove(dir, "golang", "1.25.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := make(map[string]Origin)
+	for _, entry := range entries {
+		origins[entry.Name+"/"+entry.Script] = entry.Origin
+	}
+	want := map[string]Origin{
+		"golang/1.25.0.sh":     OriginEmbedded,
+		"golang/install.sh":    OriginModified,
+		"golang/template.yaml": OriginInstalled,
+		"rust/1.80.0.sh":       OriginUser,
+	}
+	for key, origin := range want {
+		if origins[key] != origin {
+			t.Errorf("%s 的来源为 %q, 期望 %q", key, origins[key], origin)
+		}
+	}
+
+	// 没有 shebang 且不可执行的脚本
+	if err := os.WriteFile(scriptPath, []byte("echo hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "setup.sh")); err != nil {
+		t.Fatal(err)
+	}
+	problems := Validate(dir)
+	if len(problems) < 2 {
+		t.Fatalf("应发现缺少 setup.sh 和脚本格式问题: %v", problems)
+	}
+}
+
+// TestInstall 测试 init 不覆盖用户修改过的文件，upgrade 写入 .new 文件
+func TestInstall(t *testing.T) {
+	dir := t.TempDir()
+	report, err := Install(dir, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Written) != len(embeddedFiles()) {
+		t.Fatalf("首次安装应写入全部 %d 个文件, 实际写入 %d 个", len(embeddedFiles()), len(report.Written))
+	}
+
+	// 用户修改 setup.sh
+	setupPath := filepath.Join(dir, "setup.sh")
+	modified := append(slices.Clone(setupScript), []byte("# 本地修改\n")...)
+	if err := os.WriteFile(setupPath, modified, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟旧版本 vbox 安装的、用户未修改过的 Dockerfile
+	oldDockerfile := []byte("FROM debian:bullseye-slim\n")
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), oldDockerfile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := loadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Files["Dockerfile"] = checksum(oldDockerfile)
+	if err := st.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	states, err := Statuses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range states {
+		want := StatusUpToDate
+		switch fs.RelPath {
+		case "setup.sh":
+			want = StatusModified
+		case "Dockerfile":
+			want = StatusOutdated
+		}
+		if fs.Status != want {
+			t.Errorf("%s 的状态为 %s, 期望 %s", fs.RelPath, fs.Status, want)
+		}
+	}
+
+	report, err = Install(dir, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Written, []string{"Dockerfile"}) || !slices.Equal(report.Skipped, []string{"setup.sh"}) {
+		t.Fatalf("init 结果不符合预期: %+v", report)
+	}
+	if data, _ := os.ReadFile(setupPath); string(data) != string(modified) {
+		t.Fatal("init 不应覆盖用户修改过的文件")
+	}
+
+	report, err = Install(dir, InstallOptions{WriteNew: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.NewFiles, []string{"setup.sh" + NewFileSuffix}) {
+		t.Fatalf("upgrade 结果不符合预期: %+v", report)
+	}
+	if data, _ := os.ReadFile(setupPath + NewFileSuffix); string(data) != string(setupScript) {
+		t.Fatal(".new 文件应包含内置模板的内容")
+	}
+
+	// 用户合并后，文件重新被视为未修改
+	if err := os.Rename(setupPath+NewFileSuffix, setupPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Install(dir, InstallOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	st, _ = loadState(dir)
+	if st.Files["setup.sh"] != checksum(setupScript) {
+		t.Fatal("合并后的文件应重新记录校验和")
+	}
+}
+
+// TestInstallLegacy 测试没有状态文件时，旧版本 vbox 安装的未修改文件会被 init 更新
+func TestInstallLegacy(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "baseline"))); err != nil {
+		t.Fatal(err)
+	}
+	// 用户修改过的旧文件仍然保留
+	setupPath := filepath.Join(dir, "setup.sh")
+	data, err := os.ReadFile(setupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := append(data, []byte("# 本地修改\n")...)
+	if err := os.WriteFile(setupPath, modified, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧的 golang 模板没有被修改，不属于 local 层
+	layers, err := Layers(dir, filepath.Join(dir, "sources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, layer, err := FindEnv(layers, "golang"); err != nil || layer.Kind != LayerEmbedded {
+		t.Fatalf("旧版本安装的 golang 应视为内置模板, 实际为 %s, %v", layer, err)
+	}
+
+	states, err := Statuses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range states {
+		want := StatusMissing
+		switch fs.RelPath {
+		case "Dockerfile", "template/golang/1.25.0.sh":
+			want = StatusOutdated
+		case "setup.sh":
+			want = StatusModified
+		}
+		if fs.Status != want {
+			t.Errorf("%s 的状态为 %s, 期望 %s", fs.RelPath, fs.Status, want)
+		}
+	}
+
+	report, err := Install(dir, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Skipped, []string{"setup.sh"}) || len(report.Written) != len(embeddedFiles())-1 {
+		t.Fatalf("init 结果不符合预期: %+v", report)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "Dockerfile")); string(data) != string(baseDockerfile) {
+		t.Fatal("未修改的旧 Dockerfile 应被更新")
+	}
+	if data, _ := os.ReadFile(setupPath); string(data) != string(modified) {
+		t.Fatal("init 不应覆盖用户修改过的文件")
+	}
+
+	// 写入状态文件后，旧版本的内容不再视为未修改
+	baseline, err := os.ReadFile(filepath.Join("testdata", "baseline", "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), baseline, 0644); err != nil {
+		t.Fatal(err)
+	}
+	states, err = Statuses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.IndexFunc(states, func(fs FileState) bool { return fs.RelPath == "Dockerfile" }); states[i].Status != StatusModified {
+		t.Fatalf("有状态文件时 Dockerfile 的状态为 %s, 期望 %s", states[i].Status, StatusModified)
+	}
+}
+
+// TestSources 测试从 git 仓库和本地目录添加、更新、删除模板来源
+func TestSources(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("未找到 git")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	templatesDir := filepath.Join(dir, "env")
+	sourcesDir := filepath.Join(dir, "sources")
+	if err := Init(templatesDir); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(dir, "repo")
+	script := filepath.Join(repo, "template", "golang", "1.25.0.sh")
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("#!/bin/bash\necho company\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(message string) {
+		for _, args := range [][]string{
+			{"add", "-A"},
+			{"-c", "user.name=vbox", "-c", "user.email=vbox@example.com", "commit", "--quiet", "-m", message},
+		} {
+			if _, err := git(ctx, repo, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := git(ctx, repo, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	commit("init")
+
+	source, err := AddSource(ctx, sourcesDir, "company", "file://"+repo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := git(ctx, repo, "rev-parse", "HEAD")
+	if source.Kind != SourceGit || source.Commit != head {
+		t.Fatalf("来源不符合预期: %+v", source)
+	}
+	if _, err := AddSource(ctx, sourcesDir, "company", "file://"+repo, ""); err == nil {
+		t.Fatal("重复的来源名称应返回错误")
+	}
+
+	// 外部来源优先于未修改的内置模板
+	layers, err := Layers(templatesDir, sourcesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, layer, err := FindEnv(layers, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.String() != "source:company" {
+		t.Fatalf("应使用外部来源中的 golang, 实际为 %s", layer)
+	}
+
+	// 在模板目录中添加的文件使本地的 golang 优先
+	localFiles := filepath.Join(templatesDir, "template", "golang", "files")
+	if err := os.MkdirAll(localFiles, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, layer, err = FindEnv(layers, "golang"); err != nil || layer.Kind != LayerLocal {
+		t.Fatalf("添加了子目录的模板应属于 local 层, 实际为 %s, %v", layer, err)
+	}
+	if err := os.Remove(localFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧版本安装、用户没有修改过的内置模板不优先于外部来源，修改后才属于 local 层
+	localScript := filepath.Join(templatesDir, "template", "golang", "1.25.0.sh")
+	old := []byte("#!/bin/bash\necho old embedded\n")
+	if err := os.WriteFile(localScript, old, 0755); err != nil {
+		t.Fatal(err)
+	}
+	st, err := loadState(templatesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Files["template/golang/1.25.0.sh"] = checksum(old)
+	if err := st.save(templatesDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, layer, err = FindEnv(layers, "golang"); err != nil || layer.String() != "source:company" {
+		t.Fatalf("未修改的旧内置模板不应优先于外部来源, 实际为 %s, %v", layer, err)
+	}
+	if err := os.WriteFile(localScript, []byte("#!/bin/bash\necho edited\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, layer, err = FindEnv(layers, "golang"); err != nil || layer.Kind != LayerLocal {
+		t.Fatalf("修改过的模板应属于 local 层, 实际为 %s, %v", layer, err)
+	}
+	if _, err := Install(templatesDir, InstallOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(script, []byte("#!/bin/bash\necho company v2\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	commit("v2")
+	updated, oldCommit, err := UpdateSource(ctx, sourcesDir, "company")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ = git(ctx, repo, "rev-parse", "HEAD")
+	if oldCommit != source.Commit || updated.Commit != head {
+		t.Fatalf("更新后的提交不符合预期: %s -> %s", oldCommit, updated.Commit)
+	}
+	data, err := os.ReadFile(filepath.Join(updated.EnvRoot(sourcesDir), "golang", "1.25.0.sh"))
+	if err != nil || string(data) != "#!/bin/bash\necho company v2\n" {
+		t.Fatalf("更新后的脚本不符合预期: %q, %v", data, err)
+	}
+
+	// 本地目录直接使用，不需要 template 子目录
+	bare := filepath.Join(dir, "bare")
+	if err := os.MkdirAll(filepath.Join(bare, "rust"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	local, err := AddSource(ctx, sourcesDir, "local", bare, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.Kind != SourceDir || local.EnvRoot(sourcesDir) != bare {
+		t.Fatalf("本地目录来源不符合预期: %+v", local)
+	}
+
+	if err := RemoveSource(sourcesDir, "company"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(sourcesDir, "company")); !os.IsNotExist(err) {
+		t.Fatal("删除来源后应删除克隆目录")
+	}
+	sources, err := LoadSources(sourcesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].Name != "local" {
+		t.Fatalf("剩余来源不符合预期: %+v", sources)
+	}
+}
+
+// TestMatchVersion 测试 latest、部分版本和范围的解析
+func TestMatchVersion(t *testing.T) {
+	available := []string{"1.23.12", "1.24.6", "1.25.0", "1.25.1", "1.9.0"}
+	for _, tt := range []struct{ query, want string }{
+		{"1.24.6", "1.24.6"},
+		{"latest", "1.25.1"},
+		{"1.25", "1.25.1"},
+		{"1.24.x", "1.24.6"},
+		{"1", "1.25.1"},
+		{">=1.24 <1.25", "1.24.6"},
+		{">=1.24,<1.25", "1.24.6"},
+		{"^1.9", "1.25.1"},
+		{"~1.24.1", "1.24.6"},
+		{"~1.25", "1.25.1"},
+		{"<1.10", "1.9.0"},
+		{"=1.25", "1.25.0"},
+		{"1.26.0", "1.26.0"}, // 普通版本没有匹配时原样使用
+	} {
+		if got, err := MatchVersion(tt.query, available); err != nil || got != tt.want {
+			t.Errorf("MatchVersion(%q) = %s, %v, 期望 %s", tt.query, got, err, tt.want)
+		}
+	}
+
+	for _, query := range []string{">=2", "1.26.x", ">=", "^abc!"} {
+		if got, err := MatchVersion(query, available); err == nil {
+			t.Errorf("MatchVersion(%q) = %s, 应返回错误", query, got)
+		}
+	}
+	if _, err := MatchVersion("latest", nil); err == nil {
+		t.Error("没有可用版本时 latest 应返回错误")
+	}
+
+	if CompareVersions("1.10.0", "1.9.9") <= 0 || CompareVersions("1.25", "1.25.0") != 0 || CompareVersions("22.1.0", "22.1.0-rc1") <= 0 {
+		t.Error("CompareVersions 结果不符合预期")
+	}
+
+	// 描述文件声明了 versions 时只在其中选择
+	m := &Manifest{Versions: []string{"1.25.0", "1.24.6"}, Aliases: map[string]string{"stable": "1.25.0"}}
+	if v, err := m.ResolveVersionIn("1.24", []string{"1.24.9"}); err != nil || v != "1.24.6" {
+		t.Fatalf("ResolveVersionIn(1.24) = %s, %v", v, err)
+	}
+	var none *Manifest
+	if v, err := none.ResolveVersionIn("latest", []string{"20", "22"}); err != nil || v != "22" {
+		t.Fatalf("ResolveVersionIn(latest) = %s, %v", v, err)
+	}
+
+	// 没有 version_pattern 时 versions 之外的版本不可用，声明后匹配的版本原样使用
+	if _, err := m.ResolveVersion("1.23.4"); err == nil {
+		t.Fatal("不在 versions 中的版本应返回错误")
+	}
+	m.VersionPattern = `^1\.[0-9]+\.[0-9]+$`
+	if v, err := m.ResolveVersion("1.23.4"); err != nil || v != "1.23.4" {
+		t.Fatalf("ResolveVersion(1.23.4) = %s, %v", v, err)
+	}
+	if v, err := m.ResolveVersion("~1.24.0"); err != nil || v != "1.24.6" {
+		t.Fatalf("范围仍在 versions 中选择: ResolveVersion(~1.24.0) = %s, %v", v, err)
+	}
+	if _, err := m.ResolveVersion("2.0"); err == nil {
+		t.Fatal("不匹配 version_pattern 的版本应返回错误")
+	}
+	if _, err := ParseManifest([]byte("version_pattern: '(['\n")); err == nil {
+		t.Fatal("无效的 version_pattern 应返回错误")
+	}
+}
+
+// TestEmbeddedPackages 测试内置模板在每个基础镜像上都使用该发行版的包名
+func TestEmbeddedPackages(t *testing.T) {
+	want := map[string]map[string][]string{
+		"golang": {
+			FamilyDebian: {"build-essential"},
+			FamilyFedora: {"gcc", "make"},
+			FamilyAlpine: {"build-base"},
+		},
+	}
+	for name, byFamily := range want {
+		data, err := envFS.ReadFile("template/" + name + "/" + ManifestFileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseManifest(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, base := range Bases() {
+			if got := m.Packages.For(base.Family); !slices.Equal(got, byFamily[base.Family]) {
+				t.Errorf("%s 在 %s 上的软件包为 %v, 期望 %v", name, base.Name, got, byFamily[base.Family])
+			}
+		}
+	}
+}
+
+// TestRenderDockerfile 测试用各基础镜像渲染 Dockerfile 模板
+func TestRenderDockerfile(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "Dockerfile")
+
+	// zprofile 是 zsh 登录时读取的全局配置，Fedora 的默认配置已经加载 /etc/profile
+	for _, tt := range []struct{ base, from, install, id, zprofile string }{
+		{"", "FROM debian:bullseye-slim\n", "apt-get install", "", "/etc/zsh/zprofile"},
+		{"ubuntu:22.04", "FROM ubuntu:22.04\n", "apt-get install", "ubuntu-22.04", "/etc/zsh/zprofile"},
+		{"fedora", "FROM fedora:41\n", "dnf install", "fedora", ""},
+		{"alpine", "FROM alpine:3.20\n", "apk add", "alpine", "/etc/zprofile"},
+	} {
+		base, err := ParseBase(tt.base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base.ID() != tt.id {
+			t.Errorf("%q 的 ID 为 %q, 期望 %q", tt.base, base.ID(), tt.id)
+		}
+		data, err := RenderDockerfile(path, DockerfileData{Base: base})
+		if err != nil {
+			t.Fatalf("渲染 %s 失败: %v", base, err)
+		}
+		if !strings.HasPrefix(string(data), tt.from) || !strings.Contains(string(data), tt.install) {
+			t.Errorf("%s 的 Dockerfile 不符合预期:\n%s", base, data)
+		}
+		if strings.Contains(string(data), "{{") {
+			t.Errorf("%s 的 Dockerfile 中残留模板语法", base)
+		}
+		var zprofile string
+		if _, rest, ok := strings.Cut(string(data), "source /etc/profile'\" >> "); ok {
+			zprofile, _, _ = strings.Cut(rest, " ")
+		}
+		if zprofile != tt.zprofile {
+			t.Errorf("%s 的 zsh 配置写入 %q, 期望 %q", base, zprofile, tt.zprofile)
+		}
+		if strings.Contains(string(data), "--mount") {
+			t.Errorf("%s 的经典构建器 Dockerfile 不应使用 --mount", base)
+		}
+
+		// BuildKit 构建时挂载软件包缓存和构建密钥
+		data, err = RenderDockerfile(path, DockerfileData{Base: base, BuildKit: true, Secrets: []string{"npm"}})
+		if err != nil {
+			t.Fatalf("用 BuildKit 渲染 %s 失败: %v", base, err)
+		}
+		if !strings.Contains(string(data), "--mount=type=cache,id=vbox-") || !strings.Contains(string(data), "--mount=type=secret,id=npm") {
+			t.Errorf("%s 的 BuildKit Dockerfile 不符合预期:\n%s", base, data)
+		}
+	}
+
+	if _, err := ParseBase("arch"); err == nil {
+		t.Fatal("不支持的基础镜像应返回错误")
+	}
+
+	// 旧的 Dockerfile 不是模板，只能用于默认基础镜像
+	if err := os.WriteFile(path, []byte("FROM debian:bullseye-slim\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RenderDockerfile(path, DockerfileData{}); err == nil {
+		t.Fatal("非默认基础镜像应要求 Dockerfile 是模板")
+	}
+	debian, _ := ParseBase("")
+	if _, err := RenderDockerfile(path, DockerfileData{Base: debian}); err != nil {
+		t.Fatal(err)
+	}
+}
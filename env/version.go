@@ -0,0 +1,194 @@
+package template
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// VersionLatest 选择可用版本中最高的版本
+const VersionLatest = "latest"
+
+// versionParts 把版本按 "." 和 "-" 拆分，如 1.25.0-rc1 -> [1 25 0 rc1]
+func versionParts(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' })
+}
+
+// comparePart 比较版本的一段，数字按数值比较，数字高于非数字（预发布标记）
+func comparePart(a, b string) int {
+	ai, aerr := strconv.Atoi(a)
+	bi, berr := strconv.Atoi(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return ai - bi
+	case aerr == nil:
+		return 1
+	case berr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// CompareVersions 按段比较两个版本，缺少的段视为 0，因此 1.25 与 1.25.0 相等
+func CompareVersions(a, b string) int {
+	ap, bp := versionParts(a), versionParts(b)
+	for i := range max(len(ap), len(bp)) {
+		x, y := "0", "0"
+		if i < len(ap) {
+			x = ap[i]
+		}
+		if i < len(bp) {
+			y = bp[i]
+		}
+		if c := comparePart(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// isWildcard 判断版本的一段是否为通配符，如 1.x、1.25.*
+func isWildcard(part string) bool {
+	return part == "x" || part == "X" || part == "*"
+}
+
+// hasPrefix 判断 version 的各段是否以 prefix 的各段开头，通配符之后的段不参与比较
+func hasPrefix(version, prefix string) bool {
+	vp, pp := versionParts(version), versionParts(prefix)
+	for i, part := range pp {
+		if isWildcard(part) {
+			return true
+		}
+		if i >= len(vp) || comparePart(vp[i], part) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bump 返回把第 i 段加一并去掉之后各段的版本，用于计算 ^ 和 ~ 的上限
+func bump(version string, i int) string {
+	parts := versionParts(version)
+	for len(parts) <= i {
+		parts = append(parts, "0")
+	}
+	n, _ := strconv.Atoi(parts[i])
+	parts = append(parts[:i], strconv.Itoa(n+1))
+	return strings.Join(parts, ".")
+}
+
+// constraint 是版本范围中的一个条件
+type constraint func(version string) bool
+
+// parseConstraint 解析单个条件：>=1.24、<1.26、=1.25.0、^1.24、~1.24.1、1.25、1.x
+func parseConstraint(s string) (constraint, error) {
+	for _, op := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		v, ok := strings.CutPrefix(s, op)
+		if !ok {
+			continue
+		}
+		if v == "" || !validVersion.MatchString(v) {
+			return nil, fmt.Errorf("无效的版本条件: %s", s)
+		}
+		switch op {
+		case ">=":
+			return func(x string) bool { return CompareVersions(x, v) >= 0 }, nil
+		case "<=":
+			return func(x string) bool { return CompareVersions(x, v) <= 0 }, nil
+		case ">":
+			return func(x string) bool { return CompareVersions(x, v) > 0 }, nil
+		case "<":
+			return func(x string) bool { return CompareVersions(x, v) < 0 }, nil
+		case "=":
+			return func(x string) bool { return CompareVersions(x, v) == 0 }, nil
+		case "^":
+			// 不改变最左边的非零段：^1.24 -> [1.24, 2)，^0.3 -> [0.3, 0.4)
+			parts, i := versionParts(v), 0
+			for i < len(parts)-1 && parts[i] == "0" {
+				i++
+			}
+			upper := bump(v, i)
+			return func(x string) bool { return CompareVersions(x, v) >= 0 && CompareVersions(x, upper) < 0 }, nil
+		case "~":
+			// 只允许次版本之后的段变化：~1.24.1 -> [1.24.1, 1.25)，~1 -> [1, 2)
+			upper := bump(v, min(len(versionParts(v))-1, 1))
+			return func(x string) bool { return CompareVersions(x, v) >= 0 && CompareVersions(x, upper) < 0 }, nil
+		}
+	}
+	if !validVersion.MatchString(strings.ReplaceAll(s, "*", "x")) {
+		return nil, fmt.Errorf("无效的版本条件: %s", s)
+	}
+	return func(x string) bool { return hasPrefix(x, s) }, nil
+}
+
+// isVersionQuery 判断 query 是否只能从可用版本中选择：latest、通配符或范围
+// 形如 1.25 的普通版本在没有匹配时原样使用，以便通用脚本构建任意版本
+func isVersionQuery(query string) bool {
+	if query == VersionLatest || strings.ContainsAny(query, "<>=^~, ") {
+		return true
+	}
+	return slices.ContainsFunc(versionParts(query), isWildcard)
+}
+
+// MatchVersion 在 available 中为 query 选择版本：
+//   - 与某个可用版本相同时直接使用
+//   - latest 选择最高版本
+//   - 1.25、1.25.x 选择前缀相同的最高版本
+//   - 范围如 ">=1.24 <1.26"、"^1.24"、"~1.24.1"，多个条件用空格或逗号分隔，需要同时满足
+//
+// query 是普通版本且没有匹配时原样返回；latest、通配符和范围没有匹配时返回错误
+func MatchVersion(query string, available []string) (string, error) {
+	if slices.Contains(available, query) {
+		return query, nil
+	}
+
+	var constraints []constraint
+	if query != VersionLatest {
+		for _, field := range strings.FieldsFunc(query, func(r rune) bool { return r == ' ' || r == ',' }) {
+			c, err := parseConstraint(field)
+			if err != nil {
+				return "", err
+			}
+			constraints = append(constraints, c)
+		}
+		if len(constraints) == 0 {
+			return "", fmt.Errorf("无效的版本: %q", query)
+		}
+	}
+
+	best := ""
+	for _, version := range available {
+		if !slices.ContainsFunc(constraints, func(c constraint) bool { return !c(version) }) &&
+			(best == "" || CompareVersions(version, best) > 0) {
+			best = version
+		}
+	}
+	switch {
+	case best != "":
+		return best, nil
+	case !isVersionQuery(query):
+		return query, nil
+	case len(available) == 0:
+		return "", fmt.Errorf("无法解析版本 %s：没有可用的版本", query)
+	}
+	return "", fmt.Errorf("没有满足 %s 的版本，可用版本: %v", query, available)
+}
+
+// ScriptVersions 返回环境目录中 <version>.sh 对应的版本
+func ScriptVersions(envDir string) []string {
+	files, err := os.ReadDir(envDir)
+	if err != nil {
+		return nil
+	}
+	var versions []string
+	for _, file := range files {
+		version, ok := strings.CutSuffix(file.Name(), ".sh")
+		if file.IsDir() || !ok || file.Name() == GenericScriptName || !validVersion.MatchString(version) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
@@ -0,0 +1,240 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/moby/moby/client"
+)
+
+// 镜像归档的压缩方式
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd" // 需要主机上的 zstd 命令
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// CompressionFromPath 根据文件扩展名选择压缩方式：.tar.gz/.tgz 使用 gzip，.tar.zst/.tzst 使用 zstd，其他不压缩
+func CompressionFromPath(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"), strings.HasSuffix(path, ".tgz"):
+		return CompressionGzip
+	case strings.HasSuffix(path, ".zst"), strings.HasSuffix(path, ".tzst"):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// ParseCompression 检查 --compress 参数
+func ParseCompression(s string) (string, error) {
+	switch s {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return s, nil
+	default:
+		return "", fmt.Errorf("不支持的压缩方式: %s，可选 none、gzip、zstd", s)
+	}
+}
+
+// Save 把镜像导出为 docker save 格式的归档并按 compression 压缩后写入 w
+// 镜像必须用标签指定，归档中才会记录标签，导入后 List 才能识别为 vbox 镜像；镜像标签随镜像配置一起保存
+func Save(ctx context.Context, w io.Writer, tags []string, compression string) error {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	body, err := cli.ImageSave(ctx, tags)
+	if err != nil {
+		return fmt.Errorf("导出镜像失败: %w", err)
+	}
+	defer body.Close()
+
+	cw, err := compressWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, body); err != nil {
+		cw.Close()
+		return fmt.Errorf("导出镜像失败: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("压缩镜像失败: %w", err)
+	}
+	return nil
+}
+
+// Load 从 docker save 格式的归档导入镜像，自动识别 gzip 和 zstd 压缩，返回导入的镜像标签
+func Load(ctx context.Context, r io.Reader) ([]string, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	dr, err := decompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+
+	resp, err := cli.ImageLoad(ctx, dr, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return nil, fmt.Errorf("导入镜像失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	loaded, err := decodeLoadStream(resp.Body)
+	if err != nil {
+		return loaded, fmt.Errorf("导入镜像失败: %w", err)
+	}
+	// zstd 进程的错误在读完后才能得到
+	if err := dr.Close(); err != nil {
+		return loaded, fmt.Errorf("解压镜像失败: %w", err)
+	}
+	return loaded, nil
+}
+
+// decodeLoadStream 读取 ImageLoad 的输出，返回导入的镜像
+// 按标签导出的镜像输出 "Loaded image: <tag>"，没有标签的输出 "Loaded image ID: <id>"
+func decodeLoadStream(r io.Reader) ([]string, error) {
+	var loaded []string
+	decoder := json.NewDecoder(r)
+	for {
+		var message BuildResponse
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(err, io.EOF) {
+				return loaded, nil
+			}
+			return loaded, fmt.Errorf("无法读取导入输出: %w", err)
+		}
+		if message.Error != nil {
+			return loaded, errors.New(*message.Error)
+		}
+		if message.ErrorDetail.Message != "" {
+			return loaded, errors.New(message.ErrorDetail.Message)
+		}
+		for _, line := range strings.Split(message.Stream, "\n") {
+			if ref, ok := strings.CutPrefix(line, "Loaded image: "); ok {
+				loaded = append(loaded, strings.TrimSpace(ref))
+			} else if id, ok := strings.CutPrefix(line, "Loaded image ID: "); ok {
+				loaded = append(loaded, strings.TrimSpace(id))
+			}
+		}
+	}
+}
+
+// compressWriter 返回按 compression 压缩后写入 w 的 WriteCloser，Close 不会关闭 w
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		zstd, err := exec.LookPath("zstd")
+		if err != nil {
+			return nil, fmt.Errorf("使用 zstd 压缩需要安装 zstd 命令")
+		}
+		cmd := exec.Command(zstd, "-q", "-c", "-T0")
+		cmd.Stdout = w
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("启动 zstd 失败: %w", err)
+		}
+		return &cmdWriteCloser{WriteCloser: stdin, cmd: cmd, stderr: &stderr}, nil
+	default:
+		return nil, fmt.Errorf("不支持的压缩方式: %s", compression)
+	}
+}
+
+// decompressReader 根据开头的字节识别压缩方式并返回解压后的内容，没有压缩时原样返回
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("读取镜像归档失败: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("解压镜像归档失败: %w", err)
+		}
+		return gr, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		zstd, err := exec.LookPath("zstd")
+		if err != nil {
+			return nil, fmt.Errorf("归档使用 zstd 压缩，需要安装 zstd 命令")
+		}
+		cmd := exec.Command(zstd, "-q", "-d", "-c")
+		cmd.Stdin = br
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("启动 zstd 失败: %w", err)
+		}
+		return &cmdReadCloser{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// cmdWriteCloser 写入子进程的标准输入，Close 等待子进程结束
+type cmdWriteCloser struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *cmdWriteCloser) Close() error {
+	c.WriteCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// cmdReadCloser 读取子进程的标准输出，Close 等待子进程结束，可以多次调用
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	done   bool
+	err    error
+}
+
+func (c *cmdReadCloser) Close() error {
+	if c.done {
+		return c.err
+	}
+	c.done = true
+	// 没有读完时关闭管道，子进程因写入失败退出
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		c.err = fmt.Errorf("%v: %s", err, strings.TrimSpace(c.stderr.String()))
+	}
+	return c.err
+}
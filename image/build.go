@@ -0,0 +1,178 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BuildResponse 是 Docker 构建输出流中的一条消息
+type BuildResponse struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Error *string         `json:"error"`
+	Aux   json.RawMessage `json:"aux"`
+}
+
+// BuildStep 是 Dockerfile 中的一条指令
+type BuildStep struct {
+	Instruction string        // 如 RUN ssh-keygen -A
+	Cached      bool          // 是否使用了构建缓存
+	Duration    time.Duration // 从该步骤开始到下一步骤开始的时间
+}
+
+// BuildResult 是一次构建的结果
+type BuildResult struct {
+	ImageID  string        // 镜像 ID，如 sha256:...
+	Tag      string        // 镜像标签
+	Steps    []BuildStep   // 按顺序执行的步骤
+	Warnings []string      // 构建过程中的警告
+	Log      string        // 完整的构建输出
+	Duration time.Duration // 构建总用时
+}
+
+// CachedSteps 返回使用了构建缓存的步骤数
+func (r *BuildResult) CachedSteps() int {
+	n := 0
+	for _, step := range r.Steps {
+		if step.Cached {
+			n++
+		}
+	}
+	return n
+}
+
+// BuildError 是 Docker 守护进程报告的构建错误，Result 中包含出错前的输出
+type BuildError struct {
+	Message string
+	Result  *BuildResult
+}
+
+func (e *BuildError) Error() string {
+	return "构建错误: " + e.Message
+}
+
+var (
+	stepPattern    = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)$`)
+	builtPattern   = regexp.MustCompile(`^Successfully built ([0-9a-f]+)$`)
+	warningPattern = regexp.MustCompile(`^\[(?i:warning)\]:? ?(.*)$`)
+)
+
+// ParseStep 解析构建输出中的步骤行，如 Step 2/9 : RUN ssh-keygen -A 或 BuildKit 的 #7 [2/9] RUN ssh-keygen -A
+func ParseStep(line string) (index, total int, instruction string, ok bool) {
+	line = strings.TrimSpace(line)
+	var m []string
+	if m = stepPattern.FindStringSubmatch(line); m == nil {
+		if m = buildKitStepPattern.FindStringSubmatch(line); m == nil {
+			return 0, 0, "", false
+		}
+		m = m[1:]
+	}
+	index, _ = strconv.Atoi(m[1])
+	total, _ = strconv.Atoi(m[2])
+	return index, total, m[3], true
+}
+
+// decodeBuildStream 读取 Docker 构建输出流，把日志写入 out（可以为 nil）并汇总为 BuildResult
+// 无法解析的消息、守护进程报告的错误以及没有得到镜像 ID 都作为错误返回
+func decodeBuildStream(r io.Reader, out io.Writer) (*BuildResult, error) {
+	result := &BuildResult{}
+	var log strings.Builder
+	if out == nil {
+		out = io.Discard
+	}
+
+	start := time.Now()
+	stepStart := start
+	finishStep := func(now time.Time) {
+		if n := len(result.Steps); n > 0 && result.Steps[n-1].Duration == 0 {
+			result.Steps[n-1].Duration = now.Sub(stepStart)
+		}
+	}
+	defer func() {
+		now := time.Now()
+		finishStep(now)
+		result.Duration = now.Sub(start)
+		result.Log = log.String()
+	}()
+
+	dec := json.NewDecoder(r)
+	for {
+		var msg BuildResponse
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return result, fmt.Errorf("无法解析构建输出: %w", err)
+		}
+
+		if msg.Error != nil || msg.ErrorDetail.Message != "" {
+			message := msg.ErrorDetail.Message
+			if message == "" {
+				message = *msg.Error
+			}
+			return result, &BuildError{Message: message, Result: result}
+		}
+
+		if len(msg.Aux) > 0 {
+			var aux struct {
+				ID string `json:"ID"`
+			}
+			// 镜像 ID 之外的 aux 消息（如 BuildKit 的跟踪信息）不影响结果
+			if err := json.Unmarshal(msg.Aux, &aux); err == nil && aux.ID != "" {
+				result.ImageID = aux.ID
+			}
+		}
+
+		text := msg.Stream
+		if text == "" && msg.Status != "" {
+			// 拉取基础镜像时的进度消息
+			text = msg.Status
+			if msg.ID != "" {
+				text = msg.ID + ": " + text
+			}
+			text += "\n"
+		}
+		if text == "" {
+			continue
+		}
+		log.WriteString(text)
+		fmt.Fprint(out, text)
+
+		for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+			line = strings.TrimSpace(line)
+			_, _, instruction, isStep := ParseStep(line)
+			switch {
+			case isStep:
+				now := time.Now()
+				finishStep(now)
+				stepStart = now
+				result.Steps = append(result.Steps, BuildStep{Instruction: instruction})
+			case line == "---> Using cache":
+				if n := len(result.Steps); n > 0 {
+					result.Steps[n-1].Cached = true
+				}
+			case builtPattern.MatchString(line):
+				if result.ImageID == "" {
+					result.ImageID = builtPattern.FindStringSubmatch(line)[1]
+				}
+			case warningPattern.MatchString(line):
+				result.Warnings = append(result.Warnings, warningPattern.FindStringSubmatch(line)[1])
+			}
+		}
+	}
+
+	if result.ImageID == "" {
+		return result, fmt.Errorf("构建结束但没有得到镜像 ID")
+	}
+	return result, nil
+}
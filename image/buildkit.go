@@ -0,0 +1,272 @@
+package image
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moby/moby/api/types/build"
+)
+
+// Secret 是 BuildKit 构建密钥，构建时挂载到 /run/secrets/<ID>，不会写入镜像
+type Secret struct {
+	ID  string
+	Src string // 密钥文件路径
+	Env string // 从环境变量读取密钥，与 Src 二选一
+}
+
+var validSecretID = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ParseSecret 解析 --secret 参数，格式与 docker build 相同：id=npm,src=~/.npmrc 或 id=token,env=GITHUB_TOKEN
+// 只写 id 时从同名环境变量读取
+func ParseSecret(s string) (Secret, error) {
+	var secret Secret
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return Secret{}, fmt.Errorf("无效的构建密钥 %q，格式为 id=...,src=...", s)
+		}
+		switch key {
+		case "id":
+			secret.ID = value
+		case "src", "source":
+			secret.Src = value
+		case "env":
+			secret.Env = value
+		case "type":
+			if value != "file" && value != "env" {
+				return Secret{}, fmt.Errorf("不支持的构建密钥类型: %s", value)
+			}
+		default:
+			return Secret{}, fmt.Errorf("构建密钥中未知的字段: %s", key)
+		}
+	}
+	if !validSecretID.MatchString(secret.ID) {
+		return Secret{}, fmt.Errorf("无效的构建密钥 id: %q", secret.ID)
+	}
+	if secret.Src != "" && secret.Env != "" {
+		return Secret{}, fmt.Errorf("构建密钥 %s 不能同时指定 src 和 env", secret.ID)
+	}
+	if secret.Src == "" && secret.Env == "" {
+		secret.Env = secret.ID
+	}
+
+	if strings.HasPrefix(secret.Src, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Secret{}, err
+		}
+		secret.Src = filepath.Join(home, secret.Src[2:])
+	}
+	if secret.Src != "" {
+		if _, err := os.Stat(secret.Src); err != nil {
+			return Secret{}, fmt.Errorf("构建密钥 %s 的文件不可用: %w", secret.ID, err)
+		}
+	} else if _, ok := os.LookupEnv(secret.Env); !ok {
+		return Secret{}, fmt.Errorf("构建密钥 %s 的环境变量 %s 未设置", secret.ID, secret.Env)
+	}
+	return secret, nil
+}
+
+// flag 返回传给 docker buildx build 的 --secret 参数
+func (s Secret) flag() string {
+	if s.Src != "" {
+		return fmt.Sprintf("id=%s,src=%s", s.ID, s.Src)
+	}
+	return fmt.Sprintf("id=%s,env=%s", s.ID, s.Env)
+}
+
+// BuildKitAvailable 检查能否通过 docker buildx 使用 BuildKit 构建，不可用时返回原因
+func BuildKitAvailable(ctx context.Context) error {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return fmt.Errorf("找不到 docker 命令")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, docker, "buildx", "version").CombinedOutput(); err != nil {
+		return fmt.Errorf("docker buildx 不可用: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// buildKitArgs 返回 docker buildx build 的参数，构建上下文从标准输入读取
+func buildKitArgs(opts build.ImageBuildOptions, secrets []Secret, iidFile string) []string {
+	args := []string{"buildx", "build", "--load", "--progress=plain", "--iidfile", iidFile, "--file", opts.Dockerfile}
+	for _, tag := range opts.Tags {
+		args = append(args, "--tag", tag)
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if opts.PullParent {
+		args = append(args, "--pull")
+	}
+	if opts.Platform != "" {
+		args = append(args, "--platform", opts.Platform)
+	}
+	// 按名称排序，同样的选项总是得到同样的命令
+	for _, key := range sortedKeys(opts.BuildArgs) {
+		if value := opts.BuildArgs[key]; value != nil {
+			args = append(args, "--build-arg", key+"="+*value)
+		} else {
+			args = append(args, "--build-arg", key)
+		}
+	}
+	for _, key := range sortedKeys(opts.Labels) {
+		args = append(args, "--label", key+"="+opts.Labels[key])
+	}
+	for _, secret := range secrets {
+		args = append(args, "--secret", secret.flag())
+	}
+	return append(args, "-")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// buildWithBuildKit 通过 docker buildx build 构建镜像
+// host 是 SDK 客户端连接的守护进程地址，docker 命令可能使用另一个 context，这里显式指定同一个守护进程
+func buildWithBuildKit(ctx context.Context, host string, buildContext io.Reader, opts build.ImageBuildOptions, secrets []Secret, out io.Writer) (*BuildResult, error) {
+	iidFile, err := os.CreateTemp("", "vbox-iid-*")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败: %w", err)
+	}
+	iidFile.Close()
+	defer os.Remove(iidFile.Name())
+
+	cmd := exec.CommandContext(ctx, "docker", buildKitArgs(opts, secrets, iidFile.Name())...)
+	cmd.Env = append(os.Environ(), "DOCKER_HOST="+host)
+	cmd.Stdin = buildContext
+	result, err := runBuildKit(cmd, out)
+	if err != nil {
+		return result, err
+	}
+
+	id, err := os.ReadFile(iidFile.Name())
+	if err != nil || len(id) == 0 {
+		return result, fmt.Errorf("构建结束但没有得到镜像 ID")
+	}
+	result.ImageID = strings.TrimSpace(string(id))
+	return result, nil
+}
+
+// runBuildKit 执行 docker buildx build 并解析它的输出
+func runBuildKit(cmd *exec.Cmd, out io.Writer) (*BuildResult, error) {
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("启动 docker buildx 失败: %w", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		waitErr <- err
+	}()
+
+	result, decodeErr := decodeBuildKitProgress(pr, out)
+	// 解析可能提前结束（如一行超过缓冲区），剩余的输出也要读完，否则 docker 写满管道后阻塞，Wait 永远不会返回
+	if out == nil {
+		out = io.Discard
+	}
+	io.Copy(out, pr)
+	if err := <-waitErr; err != nil {
+		message := decodeErr
+		if message == nil {
+			message = err
+		}
+		return result, &BuildError{Message: message.Error(), Result: result}
+	}
+	return result, decodeErr
+}
+
+var (
+	// BuildKit plain 输出中的步骤行，如 #7 [3/9] RUN ssh-keygen -A 或多阶段构建中的 #7 [builder 3/9] ...
+	buildKitStepPattern   = regexp.MustCompile(`^#(\d+) \[(?:\S+ )?(\d+)/(\d+)\] (.*)$`)
+	buildKitDonePattern   = regexp.MustCompile(`^#(\d+) DONE ([0-9.]+)s$`)
+	buildKitCachedPattern = regexp.MustCompile(`^#(\d+) CACHED$`)
+	buildKitErrorPattern  = regexp.MustCompile(`^(?:#\d+ )?ERROR: (.*)$`)
+	buildKitWarnPattern   = regexp.MustCompile(`^(?:WARNING|WARN): (.*)$`)
+	buildKitCheckPattern  = regexp.MustCompile(`^ - (\S+: .*)$`)
+)
+
+// decodeBuildKitProgress 读取 docker buildx build --progress=plain 的输出，把日志写入 out（可以为 nil）并汇总为 BuildResult
+// BuildKit 的步骤可以并行执行，同一步骤的输出可能分几段出现，按步骤编号汇总
+func decodeBuildKitProgress(r io.Reader, out io.Writer) (*BuildResult, error) {
+	result := &BuildResult{}
+	var log strings.Builder
+	if out == nil {
+		out = io.Discard
+	}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		result.Log = log.String()
+	}()
+
+	steps := make(map[string]int) // BuildKit 的步骤编号 -> result.Steps 中的下标
+	var lastError string
+	inWarnings := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.WriteString(line + "\n")
+		fmt.Fprintln(out, line)
+
+		switch {
+		case buildKitStepPattern.MatchString(line):
+			m := buildKitStepPattern.FindStringSubmatch(line)
+			if _, ok := steps[m[1]]; !ok {
+				steps[m[1]] = len(result.Steps)
+				result.Steps = append(result.Steps, BuildStep{Instruction: m[4]})
+			}
+		case buildKitCachedPattern.MatchString(line):
+			if i, ok := steps[buildKitCachedPattern.FindStringSubmatch(line)[1]]; ok {
+				result.Steps[i].Cached = true
+			}
+		case buildKitDonePattern.MatchString(line):
+			m := buildKitDonePattern.FindStringSubmatch(line)
+			if i, ok := steps[m[1]]; ok {
+				if d, err := time.ParseDuration(m[2] + "s"); err == nil {
+					result.Steps[i].Duration = d
+				}
+			}
+		case buildKitErrorPattern.MatchString(line):
+			lastError = buildKitErrorPattern.FindStringSubmatch(line)[1]
+		case buildKitWarnPattern.MatchString(line):
+			result.Warnings = append(result.Warnings, buildKitWarnPattern.FindStringSubmatch(line)[1])
+		case strings.Contains(line, "warning found") || strings.Contains(line, "warnings found"):
+			// Dockerfile 检查发现的问题以 " - 名称: 说明" 的形式列在后面
+			inWarnings = true
+			continue
+		case inWarnings && buildKitCheckPattern.MatchString(line):
+			result.Warnings = append(result.Warnings, buildKitCheckPattern.FindStringSubmatch(line)[1])
+			continue
+		}
+		inWarnings = false
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("无法读取构建输出: %w", err)
+	}
+	if lastError != "" {
+		return result, errors.New(lastError)
+	}
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/123cdxcc/vbox/pkg/tools"
+)
+
+// buildLockPoll 是等待其他构建释放锁时的检查间隔
+const buildLockPoll = 500 * time.Millisecond
+
+// LockBuild 获取镜像 tag 的构建锁，同一个镜像同时只有一个构建，包括其他 vbox 进程中的构建
+// 锁被占用时每隔一段时间重试，直到获得锁或 ctx 被取消；onWait 在开始等待时调用一次，参数为持有锁的进程号
+// 锁是锁文件上的文件锁，持有者退出时由系统释放，不会遗留；锁文件中记录持有者的进程号，只用于提示
+// 返回释放锁的函数和是否等待过其他构建
+func LockBuild(ctx context.Context, dir, tag string, onWait func(pid int)) (func(), bool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, false, fmt.Errorf("创建锁目录失败: %w", err)
+	}
+	lockPath := filepath.Join(dir, buildLogPrefix(tag)+".lock")
+	// 锁文件不删除，删除后其他进程可能锁住另一个同名文件
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("创建构建锁失败: %w", err)
+	}
+
+	waited := false
+	for {
+		locked, err := tools.TryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, false, fmt.Errorf("获取构建锁失败: %w", err)
+		}
+		if locked {
+			if err := file.Truncate(0); err == nil {
+				file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+			}
+			return func() {
+				file.Truncate(0)
+				tools.UnlockFile(file)
+				file.Close()
+			}, waited, nil
+		}
+
+		// 持有者刚获得锁时可能还没有写入进程号
+		if !waited && onWait != nil {
+			data, _ := os.ReadFile(lockPath)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			onWait(pid)
+		}
+		waited = true
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, waited, fmt.Errorf("等待 %s 的构建锁时取消: %w", tag, ctx.Err())
+		case <-time.After(buildLockPoll):
+		}
+	}
+}
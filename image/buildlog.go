@@ -0,0 +1,139 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildLogTimeFormat 是日志文件名中的时间格式，精确到毫秒避免同一秒内的构建互相覆盖
+const buildLogTimeFormat = "20060102-150405.000"
+
+// BuildLog 是一次构建保存的日志文件
+type BuildLog struct {
+	Tag  string    // 镜像标签，如 vbox-golang:1.25.0
+	Time time.Time // 构建开始时间
+	Path string
+
+	seq int // 同一毫秒内的第几个日志，文件名为 <image>-<timestamp>-<seq>.log，第一个没有 -<seq>
+}
+
+// buildLogPrefix 返回镜像标签在日志文件名中的形式，: 替换为 _
+// 环境名称中不允许 _，第一个 _ 总是标签中的 :
+func buildLogPrefix(tag string) string {
+	return strings.Replace(tag, ":", "_", 1)
+}
+
+// parseBuildLog 从文件名 <image>-<timestamp>[-<seq>].log 中解析出镜像标签、时间和序号
+func parseBuildLog(dir, name string) (BuildLog, bool) {
+	stem, ok := strings.CutSuffix(name, ".log")
+	if !ok {
+		return BuildLog{}, false
+	}
+	if log, ok := parseBuildLogStem(dir, name, stem); ok {
+		return log, true
+	}
+	i := strings.LastIndexByte(stem, '-')
+	if i < 0 {
+		return BuildLog{}, false
+	}
+	seq, err := strconv.Atoi(stem[i+1:])
+	if err != nil || seq <= 0 {
+		return BuildLog{}, false
+	}
+	log, ok := parseBuildLogStem(dir, name, stem[:i])
+	log.seq = seq
+	return log, ok
+}
+
+// parseBuildLogStem 解析不带序号的 <image>-<timestamp>
+func parseBuildLogStem(dir, name, stem string) (BuildLog, bool) {
+	if len(stem) < len(buildLogTimeFormat)+2 {
+		return BuildLog{}, false
+	}
+	prefix, timestamp := stem[:len(stem)-len(buildLogTimeFormat)-1], stem[len(stem)-len(buildLogTimeFormat):]
+	if stem[len(prefix)] != '-' {
+		return BuildLog{}, false
+	}
+	t, err := time.ParseInLocation(buildLogTimeFormat, timestamp, time.Local)
+	if err != nil {
+		return BuildLog{}, false
+	}
+	return BuildLog{
+		Tag:  strings.Replace(prefix, "_", ":", 1),
+		Time: t,
+		Path: filepath.Join(dir, name),
+	}, true
+}
+
+// CreateBuildLog 在 dir 中为镜像 tag 创建新的构建日志文件
+// keep 大于 0 时只保留该镜像最近 keep 次构建的日志
+func CreateBuildLog(dir, tag string, keep int) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建日志目录失败: %w", err)
+	}
+
+	if keep > 0 {
+		logs, err := BuildLogs(dir, tag)
+		if err != nil {
+			return nil, err
+		}
+		// 新日志也算在内
+		for i := keep - 1; i >= 0 && i < len(logs); i++ {
+			if err := os.Remove(logs[i].Path); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("删除旧日志失败: %w", err)
+			}
+		}
+	}
+
+	// 同一毫秒内的构建依次使用 -1、-2 等序号，文件名不会重复
+	stem := buildLogPrefix(tag) + "-" + time.Now().Format(buildLogTimeFormat)
+	for seq := 0; ; seq++ {
+		name := stem + ".log"
+		if seq > 0 {
+			name = stem + "-" + strconv.Itoa(seq) + ".log"
+		}
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("创建构建日志失败: %w", err)
+		}
+	}
+}
+
+// BuildLogs 返回 dir 中的构建日志，按时间从新到旧排列
+// tag 非空时只返回该镜像的日志，目录不存在时返回空列表
+func BuildLogs(dir, tag string) ([]BuildLog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("读取日志目录失败: %w", err)
+	}
+
+	var logs []BuildLog
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		log, ok := parseBuildLog(dir, entry.Name())
+		if !ok || (tag != "" && log.Tag != tag) {
+			continue
+		}
+		logs = append(logs, log)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if !logs[i].Time.Equal(logs[j].Time) {
+			return logs[i].Time.After(logs[j].Time)
+		}
+		return logs[i].seq > logs[j].seq
+	})
+	return logs, nil
+}
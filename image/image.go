@@ -1,11 +1,12 @@
 package image
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -21,41 +22,150 @@ type BuildOptions struct {
 	Name           string             // 镜像名称
 	Version        string             // 版本
 	Dockerfile     string             // Dockerfile 路径
+	DockerfileData []byte             // 渲染后的 Dockerfile，非空时代替 Dockerfile 指向的文件
+	Base           string             // 基础镜像，如 alpine:3.20，写入 vbox.base 标签
 	SetupScript    string             // 启动脚本路径
-	SetupEnvScript string             // 环境脚本路径
+	SetupEnvScript string             // 环境脚本路径，EnvScripts 为空时作为唯一的环境脚本
+	EnvScripts     []EnvScript        // 按顺序执行的环境脚本
+	Spec           string             // 镜像描述，写入 vbox.spec 标签
+	Labels         map[string]string  // 额外的镜像标签
 	Remove         bool               // 是否删除中间容器
 	ForceRemove    bool               // 强制删除中间容器
 	NoCache        bool               // 不使用缓存
+	Pull           bool               // 总是拉取基础镜像的最新版本
+	Platform       string             // 目标平台，如 linux/arm64，为空时使用 Docker 守护进程的平台
 	BuildArgs      map[string]*string // 构建参数
+	User           string             // box 用户名，为空时使用 Dockerfile 中的默认值
+	Shell          string             // box 用户的登录 shell (bash|zsh|fish)
+	Home           string             // box 用户目录
+	Arch           string             // 目标架构 (amd64|arm64...)，传给环境脚本
+	Output         io.Writer          // 构建输出，为 nil 时只记录在 BuildResult.Log 中
+	BuildKit       bool               // 通过 docker buildx 使用 BuildKit 构建，需要先用 BuildKitAvailable 检查
+	Secrets        []Secret           // BuildKit 构建密钥
 }
 
-type BuildResponse struct {
-	Stream      string `json:"stream"`
-	ErrorDetail struct {
-		Message string `json:"message"`
-	} `json:"errorDetail"`
-	Error *string `json:"error"`
+// EnvScript 是一个环境的安装脚本，内容来自 Path 指向的文件或 Data
+type EnvScript struct {
+	Name      string
+	Version   string
+	Path      string
+	Data      []byte
+	Packages  []string             // 执行脚本前安装的系统软件包
+	Env       map[string]string    // 写入 /etc/profile.d 的环境变量
+	Artifacts map[string]string    // 主机上已下载并校验的文件，文件名 -> 路径，脚本从 $VBOX_ARTIFACTS 读取
+	Dir       string               // 模板目录，整个目录放入构建上下文，脚本从 $VBOX_TEMPLATE_DIR 读取
+	Ignore    *tools.IgnoreMatcher // 按模板目录中的 .vboxignore 过滤 Dir，可为空
 }
 
-// Build 构建 Docker 镜像
-func Build(ctx context.Context, opts BuildOptions) (<-chan BuildResponse, error) {
+// profileQuote 用双引号包裹 profile 中的变量值，保留 $VAR 展开
+var profileQuote = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+
+// envContextFiles 将环境脚本放入构建上下文的 envs 目录
+// 每个环境对应 NN-<name>.sh 和记录版本的 NN-<name>.env，Dockerfile 按文件名顺序执行
+// 模板目录放在 NN-<name>.d，下载文件放在 NN-<name>.artifacts
+func envContextFiles(scripts []EnvScript) []tools.ContextFile {
+	files := make([]tools.ContextFile, 0, len(scripts)*2)
+	for i, script := range scripts {
+		base := fmt.Sprintf("envs/%02d-%s", i+1, script.Name)
+		envFile := fmt.Sprintf("NAME=%s\nVERSION=%s\nPACKAGES=\"%s\"\n", script.Name, script.Version, strings.Join(script.Packages, " "))
+		// Dockerfile 把 envs 复制到 /tmp/vbox-envs
+		if len(script.Artifacts) > 0 {
+			envFile += fmt.Sprintf("VBOX_ARTIFACTS=/tmp/vbox-envs/%02d-%s.artifacts\n", i+1, script.Name)
+		}
+		if script.Dir != "" {
+			envFile += fmt.Sprintf("VBOX_TEMPLATE_DIR=/tmp/vbox-envs/%02d-%s.d\n", i+1, script.Name)
+		}
+		files = append(files,
+			tools.ContextFile{Name: base + ".sh", Path: script.Path, Data: script.Data},
+			tools.ContextFile{Name: base + ".env", Data: []byte(envFile)},
+		)
+		if script.Dir != "" {
+			files = append(files, tools.ContextFile{Name: base + ".d", Path: script.Dir, Ignore: script.Ignore})
+		}
+		for _, name := range slices.Sorted(maps.Keys(script.Artifacts)) {
+			files = append(files, tools.ContextFile{Name: base + ".artifacts/" + name, Path: script.Artifacts[name]})
+		}
+
+		if len(script.Env) > 0 {
+			var profile strings.Builder
+			for _, key := range slices.Sorted(maps.Keys(script.Env)) {
+				fmt.Fprintf(&profile, "export %s=\"%s\"\n", key, profileQuote.Replace(script.Env[key]))
+			}
+			files = append(files, tools.ContextFile{Name: base + ".profile", Data: []byte(profile.String())})
+		}
+	}
+	return files
+}
+
+// Build 构建 Docker 镜像，构建输出实时写入 opts.Output
+func Build(ctx context.Context, opts BuildOptions) (*BuildResult, error) {
 	cli := config.GlobalConfig.GetDockerClient()
 
 	// 创建 tar 构建上下文
-	buildContext, err := tools.CreateBuildContext(opts.Dockerfile, opts.SetupScript, opts.SetupEnvScript)
+	envScripts := opts.EnvScripts
+	if len(envScripts) == 0 && opts.SetupEnvScript != "" {
+		envScripts = []EnvScript{{Name: opts.Name, Version: opts.Version, Path: opts.SetupEnvScript}}
+	}
+	dockerfile, dockerfileName, files := opts.Dockerfile, filepath.Base(opts.Dockerfile), envContextFiles(envScripts)
+	if opts.DockerfileData != nil {
+		dockerfile, dockerfileName = "", constant.DefaultDockerfileName
+		files = append(files, tools.ContextFile{Name: dockerfileName, Data: opts.DockerfileData})
+	}
+	buildContext, err := tools.CreateBuildContext(dockerfile, opts.SetupScript, files)
 	if err != nil {
 		return nil, fmt.Errorf("创建构建上下文失败: %w", err)
 	}
 	defer buildContext.Close()
 
+	// box 用户信息和架构通过构建参数传给 Dockerfile
+	buildArgs := make(map[string]*string, len(opts.BuildArgs)+5)
+	for k, v := range opts.BuildArgs {
+		buildArgs[k] = v
+	}
+	for k, v := range map[string]string{
+		constant.BuildArgUser:       opts.User,
+		constant.BuildArgShell:      opts.Shell,
+		constant.BuildArgHome:       opts.Home,
+		constant.BuildArgTargetArch: opts.Arch,
+		constant.BuildArgArch:       opts.Arch,
+	} {
+		if v != "" {
+			buildArgs[k] = &v
+		}
+	}
+
 	// 准备构建选项
 	buildOptions := build.ImageBuildOptions{
 		Tags:        []string{fmt.Sprintf("%s%s:%s", constant.VboxImagePrefix, opts.Name, opts.Version)},
-		Dockerfile:  filepath.Base(opts.Dockerfile),
+		Dockerfile:  dockerfileName,
 		Remove:      opts.Remove,
 		ForceRemove: opts.ForceRemove,
 		NoCache:     opts.NoCache,
-		BuildArgs:   opts.BuildArgs,
+		PullParent:  opts.Pull,
+		Platform:    opts.Platform,
+		BuildArgs:   buildArgs,
+	}
+	labels := make(map[string]string, len(opts.Labels)+2)
+	maps.Copy(labels, opts.Labels)
+	if opts.Spec != "" {
+		labels[constant.LabelSpec] = opts.Spec
+	}
+	if opts.Base != "" {
+		labels[constant.LabelBase] = opts.Base
+	}
+	if len(labels) > 0 {
+		buildOptions.Labels = labels
+	}
+
+	if opts.BuildKit {
+		result, err := buildWithBuildKit(ctx, cli.DaemonHost(), buildContext, buildOptions, opts.Secrets, opts.Output)
+		if result != nil {
+			result.Tag = buildOptions.Tags[0]
+		}
+		return result, err
+	}
+	if len(opts.Secrets) > 0 {
+		return nil, fmt.Errorf("构建密钥需要 BuildKit")
 	}
 
 	// 执行构建
@@ -63,27 +173,43 @@ func Build(ctx context.Context, opts BuildOptions) (<-chan BuildResponse, error)
 	if err != nil {
 		return nil, fmt.Errorf("构建镜像失败: %w", err)
 	}
-	ch := make(chan BuildResponse)
-	go func() {
-		defer close(ch)
-		defer resp.Body.Close()
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			var resp BuildResponse
-			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
-				return
-			}
-			ch <- resp
-		}
-	}()
+	defer resp.Body.Close()
 
-	return ch, nil
+	result, err := decodeBuildStream(resp.Body, opts.Output)
+	result.Tag = buildOptions.Tags[0]
+	return result, err
+}
+
+// PlatformArch 返回 os/arch[/variant] 格式平台中的架构，使用 Go 风格的名称
+func PlatformArch(platform string) (string, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("无效的平台 %s，正确格式为 os/arch[/variant]，如 linux/arm64", platform)
+	}
+	if parts[0] != "linux" {
+		return "", fmt.Errorf("不支持的平台 %s，只支持 linux", platform)
+	}
+	return tools.NormalizeArch(parts[1]), nil
+}
+
+// ServerArch 返回 Docker 守护进程的架构，使用 Go 风格的名称 (amd64、arm64 等)
+func ServerArch(ctx context.Context) (string, error) {
+	cli := config.GlobalConfig.GetDockerClient()
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return "", fmt.Errorf("获取 Docker 信息失败: %w", err)
+	}
+	return tools.NormalizeArch(info.Architecture), nil
 }
 
 type Image struct {
 	ID      string    // 镜像ID
 	Name    string    // 名称
 	Version string    // 版本
+	Spec    string    // 镜像包含的环境，如 golang:1.25.0+node:22
+	Base    string    // 基础镜像，旧镜像为空
+	Hash    string    // 构建时的模板哈希，旧镜像为空
 	Size    int64     // 镜像大小
 	Created time.Time // 创建时间
 }
@@ -121,10 +247,19 @@ func List(ctx context.Context) ([]Image, error) {
 				// 去掉 ID 中的 "sha256:" 前缀
 				imageID := strings.TrimPrefix(img.ID, "sha256:")
 
+				// 组合镜像的标签是哈希，从标签中读取可读的镜像描述
+				spec := img.Labels[constant.LabelSpec]
+				if spec == "" {
+					spec = name + ":" + version
+				}
+
 				vboxImage := Image{
 					ID:      imageID,
 					Name:    name,
 					Version: version,
+					Spec:    spec,
+					Base:    img.Labels[constant.LabelBase],
+					Hash:    img.Labels[constant.LabelTemplateHash],
 					Size:    img.Size,
 					Created: createdTime,
 				}
@@ -1,14 +1,24 @@
 package image
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // TestBuildFromDockerfile 测试从单个 Dockerfile 构建
 func TestBuildFromDockerfile(t *testing.T) {
-	ch, err := Build(
+	result, err := Build(
 		context.Background(),
 		BuildOptions{
 			Name:           "golang",
@@ -18,17 +28,13 @@ func TestBuildFromDockerfile(t *testing.T) {
 			SetupEnvScript: "/Users/hongfuz/development/code/Golang/vbox/env/template/golang/1.25.0.sh",
 			Remove:         true,
 			NoCache:        false,
+			Output:         os.Stdout,
 		},
 	)
 	if err != nil {
 		t.Fatalf("构建失败: %v", err)
 	}
-	for resp := range ch {
-		if resp.Error != nil {
-			t.Fatalf("构建失败: %v", resp.ErrorDetail.Message)
-		}
-		fmt.Println(resp.Stream)
-	}
+	fmt.Printf("镜像 ID: %s, 用时: %s\n", result.ImageID, result.Duration)
 }
 
 // TestBuildWithContext 测试带构建上下文的构建
@@ -39,21 +45,14 @@ func TestBuildWithContext(t *testing.T) {
 		Dockerfile: "/Users/hongfuz/development/code/Golang/vbox/template/Base-Dockerfile",
 		Remove:     true,
 		NoCache:    false,
+		Output:     os.Stdout,
 	}
 
-	ch, err := Build(context.Background(), opts)
-	if err != nil {
-		t.Fatalf("构建失败: %v", err)
-	}
-	for resp := range ch {
-		if resp.Error != nil {
-			t.Fatalf("构建失败: %v", resp.ErrorDetail.Message)
-		}
-		fmt.Println(resp.Stream)
-	}
+	result, err := Build(context.Background(), opts)
 	if err != nil {
 		t.Fatalf("构建失败: %v", err)
 	}
+	fmt.Printf("镜像 ID: %s, 用时: %s\n", result.ImageID, result.Duration)
 }
 
 // TestList 测试列出 vbox 镜像
@@ -74,3 +73,457 @@ func TestList(t *testing.T) {
 		)
 	}
 }
+
+// TestParseSpec 测试组合镜像描述的解析和标签生成
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec("golang:1.25.0+node:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec) != 2 || spec[0] != (EnvRef{"golang", "1.25.0"}) || spec[1] != (EnvRef{"node", "22"}) {
+		t.Fatalf("解析结果不符合预期: %v", spec)
+	}
+	if spec.String() != "golang:1.25.0+node:22" {
+		t.Fatalf("String() = %s", spec.String())
+	}
+
+	// 同一组合总是得到同一标签，顺序不同则标签不同
+	again, _ := ParseSpec("golang:1.25.0+node:22")
+	reversed, _ := ParseSpec("node:22+golang:1.25.0")
+	if spec.Tag() != again.Tag() {
+		t.Fatalf("标签不确定: %s != %s", spec.Tag(), again.Tag())
+	}
+	if spec.Tag() == reversed.Tag() {
+		t.Fatalf("不同顺序的组合不应得到相同标签: %s", spec.Tag())
+	}
+	if !strings.HasPrefix(spec.Tag(), "vbox-golang-node:") || len(spec.ImageVersion()) != 12 {
+		t.Fatalf("组合镜像标签格式错误: %s", spec.Tag())
+	}
+
+	single, err := ParseSpec("golang:1.25.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.Tag() != "vbox-golang:1.25.0" {
+		t.Fatalf("单个环境的标签应保持不变: %s", single.Tag())
+	}
+	if single.BaseTag("") != single.Tag() || single.BaseTag("alpine") != "vbox-golang:1.25.0-alpine" {
+		t.Fatalf("基础镜像标签不符合预期: %s", single.BaseTag("alpine"))
+	}
+
+	// 版本可以是需要解析的 latest、通配符或范围
+	for _, s := range []string{"golang:latest", "golang:1.25.x", "golang:>=1.24,<1.26", "golang:^1.24+node:~22"} {
+		if _, err := ParseSpec(s); err != nil {
+			t.Errorf("ParseSpec(%q) 返回错误: %v", s, err)
+		}
+	}
+
+	for _, s := range []string{"", "golang", "golang:", ":1.0", "golang:1+", "golang:1+golang:2", "Go:1.0", "golang:1;rm"} {
+		if _, err := ParseSpec(s); err == nil {
+			t.Errorf("ParseSpec(%q) 应返回错误", s)
+		}
+	}
+}
+
+// TestPlatformArch 测试从 --platform 中取出架构
+func TestPlatformArch(t *testing.T) {
+	for platform, want := range map[string]string{
+		"linux/amd64":    "amd64",
+		"linux/arm64":    "arm64",
+		"linux/arm64/v8": "arm64",
+		"linux/aarch64":  "arm64",
+	} {
+		if arch, err := PlatformArch(platform); err != nil || arch != want {
+			t.Errorf("PlatformArch(%q) = %s, %v, 期望 %s", platform, arch, err, want)
+		}
+	}
+	for _, platform := range []string{"", "arm64", "linux/", "windows/amd64", "linux/arm/v7/x"} {
+		if _, err := PlatformArch(platform); err == nil {
+			t.Errorf("PlatformArch(%q) 应返回错误", platform)
+		}
+	}
+}
+
+// TestDecodeBuildStream 测试构建输出流的解析
+func TestDecodeBuildStream(t *testing.T) {
+	stream := `{"stream":"Step 1/3 : FROM debian:bullseye-slim\n"}
+{"stream":" ---\u003e 1a2b3c4d5e6f\n"}
+{"status":"Pulling fs layer","id":"abc"}
+{"stream":"Step 2/3 : RUN ssh-keygen -A\n"}
+{"stream":" ---\u003e Using cache\n"}
+{"stream":"Step 3/3 : COPY setup.sh /usr/local/bin/setup.sh\n"}
+{"stream":"[Warning] One or more build-args [FOO] were not consumed\n"}
+{"aux":{"ID":"sha256:0123456789ab"}}
+{"stream":"Successfully built 0123456789ab\n"}
+`
+	var out strings.Builder
+	result, err := decodeBuildStream(strings.NewReader(stream), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ImageID != "sha256:0123456789ab" {
+		t.Fatalf("镜像 ID 为 %q", result.ImageID)
+	}
+	if len(result.Steps) != 3 || result.Steps[1].Instruction != "RUN ssh-keygen -A" || !result.Steps[1].Cached || result.CachedSteps() != 1 {
+		t.Fatalf("步骤不符合预期: %+v", result.Steps)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "FOO") {
+		t.Fatalf("警告不符合预期: %v", result.Warnings)
+	}
+	if out.String() != result.Log || !strings.Contains(result.Log, "abc: Pulling fs layer\n") {
+		t.Fatalf("日志不符合预期:\n%s", result.Log)
+	}
+
+	// 没有 aux 消息时从 Successfully built 中读取镜像 ID
+	result, err = decodeBuildStream(strings.NewReader(`{"stream":"Successfully built 0123456789ab\n"}`), nil)
+	if err != nil || result.ImageID != "0123456789ab" {
+		t.Fatalf("镜像 ID 为 %q, %v", result.ImageID, err)
+	}
+
+	var buildErr *BuildError
+	_, err = decodeBuildStream(strings.NewReader(`{"stream":"Step 1/1 : RUN false\n"}
+{"errorDetail":{"message":"exit code 1"},"error":"exit code 1"}`), nil)
+	if !errors.As(err, &buildErr) || buildErr.Message != "exit code 1" || len(buildErr.Result.Steps) != 1 {
+		t.Fatalf("应返回构建错误: %v", err)
+	}
+
+	for _, stream := range []string{
+		`{"stream":"Step 1/1 : FROM scratch\n"}`, // 没有镜像 ID
+		`{"stream":"Step 1/1`,                    // 不完整的消息
+		`not json`,
+	} {
+		if _, err := decodeBuildStream(strings.NewReader(stream), nil); err == nil {
+			t.Errorf("decodeBuildStream(%q) 应返回错误", stream)
+		}
+	}
+}
+
+// TestBuildLogs 测试构建日志的命名、查找和清理
+func TestBuildLogs(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 4; i++ {
+		for _, tag := range []string{"vbox-golang:1.25.0", "vbox-golang:1.25.0-alpine"} {
+			file, err := CreateBuildLog(dir, tag, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(file, "%s %d\n", tag, i)
+			file.Close()
+		}
+	}
+
+	logs, err := BuildLogs(dir, "vbox-golang:1.25.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个镜像只保留最近 3 次，带基础镜像后缀的标签不应混在一起；同一毫秒内的日志按创建顺序排列
+	if len(logs) != 3 || logs[0].Tag != "vbox-golang:1.25.0" || logs[0].Time.Before(logs[2].Time) {
+		t.Fatalf("构建日志不符合预期: %+v", logs)
+	}
+	for i, log := range logs {
+		if data, _ := os.ReadFile(log.Path); string(data) != fmt.Sprintf("vbox-golang:1.25.0 %d\n", 3-i) {
+			t.Fatalf("第 %d 新的日志内容为 %q", i+1, data)
+		}
+	}
+
+	// 文件名中的序号
+	for name, want := range map[string]int{
+		"vbox-golang_1.25.0-20250101-120000.000.log":   0,
+		"vbox-golang_1.25.0-20250101-120000.000-2.log": 2,
+	} {
+		if log, ok := parseBuildLog(dir, name); !ok || log.seq != want || log.Tag != "vbox-golang:1.25.0" {
+			t.Errorf("parseBuildLog(%q) = %+v, %v", name, log, ok)
+		}
+	}
+	for _, name := range []string{"vbox-golang_1.25.0-20250101-120000.000-0.log", "vbox-golang_1.25.0-20250101-120000.000-x.log", "notes.log"} {
+		if _, ok := parseBuildLog(dir, name); ok {
+			t.Errorf("parseBuildLog(%q) 应失败", name)
+		}
+	}
+	if all, _ := BuildLogs(dir, ""); len(all) != 6 {
+		t.Fatalf("应有 6 个构建日志: %+v", all)
+	}
+	if logs, err := BuildLogs(filepath.Join(dir, "missing"), ""); err != nil || len(logs) != 0 {
+		t.Fatalf("目录不存在时应返回空列表: %v, %v", logs, err)
+	}
+
+	if index, total, instruction, ok := ParseStep("Step 2/9 : RUN ssh-keygen -A"); !ok || index != 2 || total != 9 || instruction != "RUN ssh-keygen -A" {
+		t.Fatalf("ParseStep 结果不符合预期: %d %d %q", index, total, instruction)
+	}
+}
+
+// TestLockBuild 测试同一个镜像的构建锁
+func TestLockBuild(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	const tag = "vbox-golang:1.25.0"
+
+	unlock, waited, err := LockBuild(ctx, dir, tag, nil)
+	if err != nil || waited {
+		t.Fatalf("获取空闲的锁: %v, waited=%v", err, waited)
+	}
+	// 其他镜像不受影响
+	unlockOther, _, err := LockBuild(ctx, dir, tag+"-alpine", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+
+	// 锁被占用时等待，超时后返回错误
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	var holder int
+	if _, _, err := LockBuild(timeout, dir, tag, func(pid int) { holder = pid }); err == nil {
+		t.Fatal("锁被占用时应等待到超时")
+	}
+	if holder != os.Getpid() {
+		t.Fatalf("等待时应报告持有锁的进程 %d, 实际 %d", os.Getpid(), holder)
+	}
+
+	// 释放后等待的构建获得锁
+	acquired := make(chan bool)
+	go func() {
+		unlock, waited, err := LockBuild(ctx, dir, tag, nil)
+		if err == nil {
+			unlock()
+		}
+		acquired <- err == nil && waited
+	}()
+	time.Sleep(50 * time.Millisecond)
+	unlock()
+	if !<-acquired {
+		t.Fatal("锁释放后等待的构建应获得锁")
+	}
+
+	// 持有者已退出时遗留的锁文件不会阻塞构建
+	if err := os.WriteFile(filepath.Join(dir, "vbox-golang_1.25.0.lock"), []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlock, waited, err = LockBuild(ctx, dir, tag, nil)
+	if err != nil || waited {
+		t.Fatalf("遗留的锁文件不应阻塞构建: %v, waited=%v", err, waited)
+	}
+	unlock()
+
+	// 多个构建同时等待遗留的锁时，同一时刻只有一个持有锁
+	if err := os.WriteFile(filepath.Join(dir, "vbox-golang_1.25.0.lock"), []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var holders, maxHolders atomic.Int32
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, _, err := LockBuild(ctx, dir, tag, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := holders.Add(1)
+			for {
+				m := maxHolders.Load()
+				if n <= m || maxHolders.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			holders.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if maxHolders.Load() != 1 {
+		t.Fatalf("同时持有锁的构建数为 %d", maxHolders.Load())
+	}
+}
+
+// TestParseSecret 测试 --secret 参数的解析
+func TestParseSecret(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "npmrc")
+	if err := os.WriteFile(src, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("VBOX_TEST_TOKEN", "secret")
+
+	for s, want := range map[string]Secret{
+		"id=npm,src=" + src:              {ID: "npm", Src: src},
+		"type=file,id=npm,source=" + src: {ID: "npm", Src: src},
+		"id=gh,env=VBOX_TEST_TOKEN":      {ID: "gh", Env: "VBOX_TEST_TOKEN"},
+		"id=VBOX_TEST_TOKEN":             {ID: "VBOX_TEST_TOKEN", Env: "VBOX_TEST_TOKEN"},
+	} {
+		if secret, err := ParseSecret(s); err != nil || secret != want {
+			t.Errorf("ParseSecret(%q) = %+v, %v, 期望 %+v", s, secret, err, want)
+		}
+	}
+	for _, s := range []string{"", "npm", "id=", "id=a b,src=" + src, "id=npm,src=/nonexistent", "id=npm,src=" + src + ",env=X", "id=npm,mode=0400", "id=VBOX_TEST_UNSET"} {
+		if _, err := ParseSecret(s); err == nil {
+			t.Errorf("ParseSecret(%q) 应返回错误", s)
+		}
+	}
+}
+
+// TestDecodeBuildKitProgress 测试 BuildKit plain 输出的解析
+func TestDecodeBuildKitProgress(t *testing.T) {
+	progress := `#1 [internal] load build definition from Dockerfile
+#1 DONE 0.0s
+#5 [1/3] FROM docker.io/library/debian:bullseye-slim
+#5 DONE 0.1s
+#6 [2/3] RUN ssh-keygen -A
+#6 CACHED
+#7 [3/3] RUN for script in /tmp/vbox-envs/*.sh; do
+#7 0.512 ==> 执行环境脚本 01-golang.sh
+#7 [3/3] RUN for script in /tmp/vbox-envs/*.sh; do
+#7 DONE 12.5s
+WARNING: current commit information was not captured by the build
+ 1 warning found (use docker --debug to expand):
+ - JSONArgsRecommended: JSON arguments recommended for CMD (line 9)
+#8 exporting to image
+#8 DONE 0.2s
+`
+	var out strings.Builder
+	result, err := decodeBuildKitProgress(strings.NewReader(progress), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Steps) != 3 || !result.Steps[1].Cached || result.CachedSteps() != 1 || result.Steps[2].Duration != 12500*time.Millisecond {
+		t.Fatalf("步骤不符合预期: %+v", result.Steps)
+	}
+	if len(result.Warnings) != 2 || !strings.HasPrefix(result.Warnings[1], "JSONArgsRecommended") {
+		t.Fatalf("警告不符合预期: %q", result.Warnings)
+	}
+	if out.String() != progress || result.Log != progress {
+		t.Fatalf("日志不符合预期:\n%s", out.String())
+	}
+
+	_, err = decodeBuildKitProgress(strings.NewReader("#6 [2/2] RUN false\n#6 ERROR: process \"/bin/sh -c false\" did not complete successfully: exit code: 1\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), "exit code: 1") {
+		t.Fatalf("应返回构建错误: %v", err)
+	}
+
+	if index, total, instruction, ok := ParseStep("#7 [builder 3/9] RUN make"); !ok || index != 3 || total != 9 || instruction != "RUN make" {
+		t.Fatalf("ParseStep 结果不符合预期: %d %d %q", index, total, instruction)
+	}
+}
+
+// TestRunBuildKitLongLine 测试输出中有超长的行时读完剩余输出，不会因为 docker 写满管道而卡住
+func TestRunBuildKitLongLine(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("未找到 sh")
+	}
+	script := `printf '#1 [1/1] RUN make\n'; head -c 4000000 /dev/zero | tr '\0' a; printf '\n#1 DONE 0.1s\n'; exit $0`
+	for _, code := range []string{"0", "1"} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := runBuildKit(exec.Command("sh", "-c", script, code), nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			var buildErr *BuildError
+			if code == "1" && !errors.As(err, &buildErr) {
+				t.Errorf("docker 失败时应返回 BuildError: %v", err)
+			}
+			if code == "0" && (err == nil || !strings.Contains(err.Error(), "无法读取构建输出")) {
+				t.Errorf("应返回读取输出的错误: %v", err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("超长的输出行导致构建卡住")
+		}
+	}
+}
+
+// TestArchiveCompression 测试镜像归档的压缩和自动识别
+func TestArchiveCompression(t *testing.T) {
+	data := []byte(strings.Repeat("vbox image archive\n", 1000))
+	compressions := []string{CompressionNone, CompressionGzip, CompressionZstd}
+	for _, compression := range compressions {
+		if compression == CompressionZstd {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				t.Log("没有 zstd 命令，跳过 zstd")
+				continue
+			}
+		}
+		var buf bytes.Buffer
+		w, err := compressWriter(&buf, compression)
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("%s: 写入失败: %v", compression, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: 压缩失败: %v", compression, err)
+		}
+		if compression != CompressionNone && buf.Len() >= len(data) {
+			t.Fatalf("%s: 压缩后大小 %d 不小于原始大小 %d", compression, buf.Len(), len(data))
+		}
+
+		r, err := decompressReader(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: 读取失败: %v", compression, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: 解压失败: %v", compression, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: 解压后的内容不一致", compression)
+		}
+	}
+
+	// 短于魔数的内容原样返回
+	r, err := decompressReader(strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "x" {
+		t.Fatalf("短内容应原样返回，实际 %q", got)
+	}
+
+	for path, want := range map[string]string{
+		"envs.tar":     CompressionNone,
+		"envs.tar.gz":  CompressionGzip,
+		"envs.tgz":     CompressionGzip,
+		"envs.tar.zst": CompressionZstd,
+		"envs.tzst":    CompressionZstd,
+		"-":            CompressionNone,
+	} {
+		if got := CompressionFromPath(path); got != want {
+			t.Errorf("CompressionFromPath(%q) = %s，期望 %s", path, got, want)
+		}
+	}
+	if _, err := ParseCompression("xz"); err == nil {
+		t.Fatal("不支持的压缩方式应返回错误")
+	}
+}
+
+// TestDecodeLoadStream 测试解析导入镜像的输出
+func TestDecodeLoadStream(t *testing.T) {
+	stream := `{"stream":"Loaded image: vbox-golang:1.25.0\n"}
+{"stream":"Loaded image: vbox-node:22-alpine\n"}
+{"stream":"Loaded image ID: sha256:abc\n"}
+`
+	loaded, err := decodeLoadStream(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"vbox-golang:1.25.0", "vbox-node:22-alpine", "sha256:abc"}
+	if strings.Join(loaded, ",") != strings.Join(want, ",") {
+		t.Fatalf("导入的镜像为 %v，期望 %v", loaded, want)
+	}
+
+	stream = `{"stream":"Loaded image: vbox-golang:1.25.0\n"}
+{"errorDetail":{"message":"unexpected EOF"},"error":"unexpected EOF"}
+`
+	loaded, err = decodeLoadStream(strings.NewReader(stream))
+	if err == nil || err.Error() != "unexpected EOF" {
+		t.Fatalf("应返回导入错误，实际 %v", err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("出错前导入的镜像应保留，实际 %v", loaded)
+	}
+}
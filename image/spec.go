@@ -0,0 +1,110 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/123cdxcc/vbox/constant"
+)
+
+// EnvRef 表示镜像中的一个环境，如 golang:1.25.0
+type EnvRef struct {
+	Name    string
+	Version string
+}
+
+func (r EnvRef) String() string {
+	return r.Name + ":" + r.Version
+}
+
+// Spec 是按安装顺序组合的多个环境，如 golang:1.25.0+node:22
+type Spec []EnvRef
+
+var (
+	validEnvName    = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+	validEnvVersion = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	// 版本也可以是 latest、通配符或范围，如 1.25.x、>=1.24,<1.26、^1.24，由环境模板解析为具体版本
+	validEnvQuery = regexp.MustCompile(`^[A-Za-z0-9_.*^~<>=, -]{1,128}$`)
+)
+
+// ParseSpec 解析 "name:version" 或 "name:version+name:version" 格式的镜像描述
+func ParseSpec(s string) (Spec, error) {
+	if s == "" {
+		return nil, fmt.Errorf("镜像不能为空")
+	}
+
+	var spec Spec
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, "+") {
+		name, version, ok := strings.Cut(part, ":")
+		if !ok || name == "" || version == "" {
+			return nil, fmt.Errorf("镜像格式错误: %s，正确格式应为 'name:version' 或 'name:version+name:version'", s)
+		}
+		if !validEnvName.MatchString(name) {
+			return nil, fmt.Errorf("无效的环境名称: %s", name)
+		}
+		if !validEnvVersion.MatchString(version) && !validEnvQuery.MatchString(version) {
+			return nil, fmt.Errorf("无效的环境版本: %s", version)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("环境 %s 重复出现在 %s 中", name, s)
+		}
+		seen[name] = true
+		spec = append(spec, EnvRef{Name: name, Version: version})
+	}
+	return spec, nil
+}
+
+// String 返回规范的镜像描述，与 ParseSpec 互逆
+func (s Spec) String() string {
+	parts := make([]string, len(s))
+	for i, ref := range s {
+		parts[i] = ref.String()
+	}
+	return strings.Join(parts, "+")
+}
+
+// Composite 是否由多个环境组合而成
+func (s Spec) Composite() bool {
+	return len(s) > 1
+}
+
+// ImageName 返回不带前缀的镜像名，组合镜像为各环境名用 "-" 连接
+func (s Spec) ImageName() string {
+	names := make([]string, len(s))
+	for i, ref := range s {
+		names[i] = ref.Name
+	}
+	return strings.Join(names, "-")
+}
+
+// ImageVersion 返回镜像标签，组合镜像使用镜像描述的哈希，保证同一组合总是得到同一标签
+func (s Spec) ImageVersion() string {
+	if !s.Composite() {
+		return s[0].Version
+	}
+	sum := sha256.Sum256([]byte(s.String()))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Tag 返回完整的镜像标签，如 vbox-golang:1.25.0、vbox-golang-node:3f2a9c1b7d4e
+func (s Spec) Tag() string {
+	return s.BaseTag("")
+}
+
+// BaseVersion 返回基于非默认基础镜像构建时的镜像版本，在 ImageVersion 后追加 -<base>，如 1.25.0-alpine
+// base 为空表示默认基础镜像，与 ImageVersion 相同
+func (s Spec) BaseVersion(base string) string {
+	if base == "" {
+		return s.ImageVersion()
+	}
+	return s.ImageVersion() + "-" + base
+}
+
+// BaseTag 返回基于 base 构建时的完整镜像标签，如 vbox-golang:1.25.0-alpine
+func (s Spec) BaseTag(base string) string {
+	return fmt.Sprintf("%s%s:%s", constant.VboxImagePrefix, s.ImageName(), s.BaseVersion(base))
+}
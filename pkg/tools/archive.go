@@ -0,0 +1,255 @@
+package tools
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TarProgress 记录打包/解包过程中已处理的文件数和字节数
+type TarProgress func(files int, bytes int64)
+
+// TarPath 将 srcPath（文件或目录）写入 tar 流，根条目命名为 rootName
+// 保留文件权限、修改时间和符号链接；ignore 按相对 srcPath 的路径过滤，ignore 和 onProgress 可为空
+func TarPath(w io.Writer, srcPath, rootName string, ignore *IgnoreMatcher, onProgress TarProgress) error {
+	tw := tar.NewWriter(w)
+
+	files := 0
+	var written int64
+	err := filepath.Walk(srcPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(srcPath, filePath)
+		if err != nil {
+			return err
+		}
+		if ignore.Match(filepath.ToSlash(relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		tarPath := path.Join(rootName, filepath.ToSlash(relPath))
+
+		n, err := addPathToTar(tw, filePath, tarPath, info)
+		if err != nil {
+			return fmt.Errorf("添加 %s 到 tar 失败: %w", filePath, err)
+		}
+		files++
+		written += n
+		if onProgress != nil {
+			onProgress(files, written)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// TarFiles 将 root 下的若干相对路径写入 tar 流，目录只写入目录本身
+// 不存在的路径会被跳过，用于增量同步
+func TarFiles(w io.Writer, root string, relPaths []string, onProgress TarProgress) error {
+	tw := tar.NewWriter(w)
+
+	files := 0
+	var written int64
+	for _, relPath := range relPaths {
+		filePath := filepath.Join(root, filepath.FromSlash(relPath))
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		n, err := addPathToTar(tw, filePath, filepath.ToSlash(relPath), info)
+		if err != nil {
+			return fmt.Errorf("添加 %s 到 tar 失败: %w", filePath, err)
+		}
+		files++
+		written += n
+		if onProgress != nil {
+			onProgress(files, written)
+		}
+	}
+
+	return tw.Close()
+}
+
+// addPathToTar 添加文件、目录或符号链接到 tar，返回写入的文件内容字节数
+func addPathToTar(tw *tar.Writer, filePath, tarPath string, info os.FileInfo) (int64, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return 0, err
+		}
+		link = target
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return 0, err
+	}
+	header.Name = tarPath
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return 0, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return 0, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(tw, file)
+}
+
+// ExtractTar 将 tar 流解包到 dstDir
+// 根条目名为 rootName 时重命名为 newRootName（为空则保持不变），用于实现复制时的重命名
+func ExtractTar(r io.Reader, dstDir, rootName, newRootName string, onProgress TarProgress) error {
+	tr := tar.NewReader(r)
+
+	files := 0
+	var written int64
+	// 目录权限最后设置，避免只读目录导致后续文件无法写入
+	type dirMeta struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirs []dirMeta
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("读取 tar 失败: %w", err)
+		}
+
+		name := path.Clean(header.Name)
+		if newRootName != "" && (name == rootName || strings.HasPrefix(name, rootName+"/")) {
+			name = newRootName + strings.TrimPrefix(name, rootName)
+		}
+		target := filepath.Join(dstDir, filepath.FromSlash(name))
+		// 防止条目逃逸出目标目录
+		if !withinDir(dstDir, target) {
+			return fmt.Errorf("tar 条目路径非法: %s", header.Name)
+		}
+		// 前面的条目可能把路径中的目录替换为符号链接，如 x -> /etc 之后的 x/passwd
+		if err := checkNoSymlinkParents(dstDir, target); err != nil {
+			return fmt.Errorf("tar 条目路径非法: %s: %w", header.Name, err)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("tar 条目路径非法: %s: 目标是符号链接", header.Name)
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMeta{path: target, mode: mode, modTime: header.ModTime})
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// 已有的符号链接被替换为文件，不写入链接指向的文件
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			written += n
+		case tar.TypeSymlink:
+			// 链接可以指向任意位置（如 /usr/bin/python3），后续条目不会经由链接写入，见 checkNoSymlinkParents
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			// 忽略设备文件等其他类型
+			continue
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			os.Chmod(target, mode)
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		}
+
+		files++
+		if onProgress != nil {
+			onProgress(files, written)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].path, dirs[i].mode)
+		os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+	}
+
+	return nil
+}
+
+// withinDir 判断 target 在词法上是否位于 dir 之内（或就是 dir）
+func withinDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkNoSymlinkParents 检查 dstDir 和 target 之间已经存在的目录都不是符号链接，
+// 否则写入 target 时会跟随链接写到 dstDir 之外；dstDir 本身可以是符号链接
+func checkNoSymlinkParents(dstDir, target string) error {
+	rel, err := filepath.Rel(dstDir, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	current := dstDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s 是符号链接", current)
+		}
+	}
+	return nil
+}
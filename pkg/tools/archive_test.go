@@ -0,0 +1,259 @@
+package tools
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestTarPathExtractTar 测试目录打包后按新名称解包，并保留权限和符号链接
+func TestTarPathExtractTar(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/run.sh", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarPath(&buf, srcDir, "src", nil, nil); err != nil {
+		t.Fatalf("打包失败: %v", err)
+	}
+
+	dstDir := t.TempDir()
+	var files int
+	if err := ExtractTar(&buf, dstDir, "src", "renamed", func(n int, _ int64) { files = n }); err != nil {
+		t.Fatalf("解包失败: %v", err)
+	}
+	if files != 4 {
+		t.Errorf("期望处理 4 个条目，实际 %d", files)
+	}
+
+	info, err := os.Stat(filepath.Join(dstDir, "renamed", "sub", "run.sh"))
+	if err != nil {
+		t.Fatalf("解包后的文件不存在: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("期望权限 0755，实际 %v", info.Mode().Perm())
+	}
+	if target, err := os.Readlink(filepath.Join(dstDir, "renamed", "link")); err != nil || target != "sub/run.sh" {
+		t.Errorf("符号链接未保留: %q, %v", target, err)
+	}
+}
+
+// TestExtractTarSymlinkEscape 测试 tar 中的符号链接不能让条目写到目标目录之外
+func TestExtractTarSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("original\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name, link, body string
+		typeflag         byte
+	}
+	archive := func(entries ...entry) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, e := range entries {
+			header := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body))}
+			if e.typeflag == tar.TypeSymlink {
+				header.Mode = 0777
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		return &buf
+	}
+
+	for name, buf := range map[string]*bytes.Buffer{
+		"绝对路径链接后写入文件": archive(
+			entry{name: "x", link: outside, typeflag: tar.TypeSymlink},
+			entry{name: "x/passwd", body: "pwned\n", typeflag: tar.TypeReg},
+		),
+		"相对路径链接后写入文件": archive(
+			entry{name: "x", link: "../../../../../../../../" + outside, typeflag: tar.TypeSymlink},
+			entry{name: "x/passwd", body: "pwned\n", typeflag: tar.TypeReg},
+		),
+		"子目录中的链接后创建目录": archive(
+			entry{name: "dir/", typeflag: tar.TypeDir},
+			entry{name: "dir/link", link: outside, typeflag: tar.TypeSymlink},
+			entry{name: "dir/link/sub/", typeflag: tar.TypeDir},
+		),
+	} {
+		dstDir := t.TempDir()
+		if err := ExtractTar(buf, dstDir, "", "", nil); err == nil {
+			t.Errorf("%s: 应返回错误", name)
+		}
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(outside, "passwd")); string(data) != "original\n" {
+		t.Fatalf("目标目录之外的文件被修改: %q", data)
+	}
+
+	// box 中常见的指向目标目录之外的链接原样复制，不影响后面的条目
+	dstDir := t.TempDir()
+	tree := archive(
+		entry{name: "venv/", typeflag: tar.TypeDir},
+		entry{name: "venv/bin/", typeflag: tar.TypeDir},
+		entry{name: "venv/bin/python3", link: "/usr/bin/python3", typeflag: tar.TypeSymlink},
+		entry{name: "venv/lib", link: "../../lib", typeflag: tar.TypeSymlink},
+		entry{name: "venv/pyvenv.cfg", body: "home = /usr/bin\n", typeflag: tar.TypeReg},
+	)
+	if err := ExtractTar(tree, dstDir, "", "", nil); err != nil {
+		t.Fatalf("包含外部链接的目录应能复制: %v", err)
+	}
+	for link, want := range map[string]string{"venv/bin/python3": "/usr/bin/python3", "venv/lib": "../../lib"} {
+		if got, err := os.Readlink(filepath.Join(dstDir, filepath.FromSlash(link))); err != nil || got != want {
+			t.Errorf("%s 链接到 %q, 期望 %q (%v)", link, got, want, err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dstDir, "venv", "pyvenv.cfg")); string(data) != "home = /usr/bin\n" {
+		t.Fatalf("链接之后的文件内容为 %q", data)
+	}
+
+	// 目标目录中已有的指向外部的链接：写入同名文件时替换链接，不写入外部文件
+	dstDir = t.TempDir()
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(dstDir, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractTar(archive(entry{name: "passwd", body: "new\n", typeflag: tar.TypeReg}), dstDir, "", "", nil); err != nil {
+		t.Fatalf("解包失败: %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(dstDir, "passwd")); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("符号链接应被替换为普通文件: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "passwd")); string(data) != "original\n" {
+		t.Fatalf("目标目录之外的文件被修改: %q", data)
+	}
+
+	// 已有的链接目录：不能在其中创建目录或文件
+	dstDir = t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dstDir, "x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range []*bytes.Buffer{
+		archive(entry{name: "x/", typeflag: tar.TypeDir}),
+		archive(entry{name: "x/sub/", typeflag: tar.TypeDir}),
+		archive(entry{name: "x/passwd", body: "pwned\n", typeflag: tar.TypeReg}),
+	} {
+		if err := ExtractTar(buf, dstDir, "", "", nil); err == nil {
+			t.Error("在链接目录中解包应返回错误")
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "passwd")); string(data) != "original\n" {
+		t.Fatalf("目标目录之外的文件被修改: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "sub")); err == nil {
+		t.Fatal("不应在目标目录之外创建目录")
+	}
+}
+
+// TestCreateBuildContext 测试模板目录放入构建上下文时的过滤、顺序和固定的文件头
+func TestCreateBuildContext(t *testing.T) {
+	root := t.TempDir()
+	envDir := filepath.Join(root, "golang")
+	for name, data := range map[string]string{
+		"install.sh":        "#!/bin/bash\n",
+		"files/gitconfig":   "[user]\n",
+		"files/b/helper.sh": "echo\n",
+		"files/a.txt":       "a\n",
+		"notes.md":          "ignored\n",
+		"cache/big.bin":     "ignored\n",
+		".vboxignore":       "*.md\ncache/\n",
+	} {
+		path := filepath.Join(envDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("files/gitconfig", filepath.Join(envDir, "gitconfig")); err != nil {
+		t.Fatal(err)
+	}
+	setup := filepath.Join(root, "setup.sh")
+	if err := os.WriteFile(setup, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pack := func() []byte {
+		ignore, err := LoadIgnoreFiles(envDir, ".vboxignore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := CreateBuildContext("", setup, []ContextFile{
+			{Name: "Dockerfile", Data: []byte("FROM scratch\n")},
+			{Name: "envs/01-golang.d", Path: envDir, Ignore: ignore},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("创建构建上下文失败: %v", err)
+		}
+		return data
+	}
+
+	first := pack()
+	// 修改时间变化不影响构建上下文
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(envDir, "install.sh"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, pack()) {
+		t.Fatal("同样的内容应得到同样的构建上下文")
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		if !header.ModTime.Equal(time.Unix(0, 0)) || header.Uid != 0 || header.Uname != "" {
+			t.Errorf("%s 的文件头没有固定: %v %d %q", header.Name, header.ModTime, header.Uid, header.Uname)
+		}
+		if header.Name == "envs/01-golang.d/gitconfig" && (header.Typeflag != tar.TypeSymlink || header.Linkname != "files/gitconfig") {
+			t.Errorf("符号链接未保留: %+v", header)
+		}
+	}
+	want := []string{
+		"setup.sh",
+		"Dockerfile",
+		"envs/01-golang.d/",
+		"envs/01-golang.d/.vboxignore",
+		"envs/01-golang.d/files/",
+		"envs/01-golang.d/files/a.txt",
+		"envs/01-golang.d/files/b/",
+		"envs/01-golang.d/files/b/helper.sh",
+		"envs/01-golang.d/files/gitconfig",
+		"envs/01-golang.d/gitconfig",
+		"envs/01-golang.d/install.sh",
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("构建上下文的条目不符合预期:\n%v\n期望:\n%v", names, want)
+	}
+}
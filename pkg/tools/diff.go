@@ -0,0 +1,116 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext 是 unified diff 中每个改动前后保留的上下文行数
+const diffContext = 3
+
+// diffOp 是行级差异中的一行，kind 为 ' '、'-' 或 '+'
+type diffOp struct {
+	kind    byte
+	text    string
+	oldLine int // 该行之前旧内容已经过的行数
+	newLine int // 该行之前新内容已经过的行数
+}
+
+// splitLines 按行拆分，忽略末尾换行产生的空行
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// diffLines 基于最长公共子序列计算行级差异，模板文件很小，O(n*m) 足够
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', text: a[i], oldLine: i, newLine: j})
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			// 删除优先于插入，使输出中 "-" 行在 "+" 行之前
+			ops = append(ops, diffOp{kind: '-', text: a[i], oldLine: i, newLine: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', text: b[j], oldLine: i, newLine: j})
+			j++
+		}
+	}
+	return ops
+}
+
+// UnifiedDiff 生成 unified 格式的行级差异，内容相同时返回空字符串
+func UnifiedDiff(oldName, newName string, oldData, newData []byte) string {
+	ops := diffLines(splitLines(oldData), splitLines(newData))
+
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+
+	for k := 0; k < len(changes); {
+		// 相距不超过两倍上下文的改动合并到同一个 hunk
+		last := k
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+		start := max(0, changes[k]-diffContext)
+		end := min(len(ops), changes[last]+diffContext+1)
+
+		oldCount, newCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		oldStart, newStart := ops[start].oldLine, ops[start].newLine
+		if oldCount > 0 {
+			oldStart++
+		}
+		if newCount > 0 {
+			newStart++
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.text)
+			sb.WriteByte('\n')
+		}
+
+		k = last + 1
+	}
+	return sb.String()
+}
@@ -0,0 +1,43 @@
+package tools
+
+import "testing"
+
+// TestUnifiedDiff 测试行级差异的生成
+func TestUnifiedDiff(t *testing.T) {
+	if diff := UnifiedDiff("a", "b", []byte("x\ny\n"), []byte("x\ny\n")); diff != "" {
+		t.Fatalf("内容相同时应返回空字符串, 实际为:\n%s", diff)
+	}
+
+	oldData := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n")
+	newData := []byte("1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n")
+	want := `--- old
++++ new
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -13,3 +13,4 @@
+ 13
+ 14
+ 15
++16
+`
+	if diff := UnifiedDiff("old", "new", oldData, newData); diff != want {
+		t.Fatalf("差异不符合预期:\n%s\n期望:\n%s", diff, want)
+	}
+
+	// 新建文件
+	want = `--- old
++++ new
+@@ -0,0 +1,2 @@
++a
++b
+`
+	if diff := UnifiedDiff("old", "new", nil, []byte("a\nb\n")); diff != want {
+		t.Fatalf("差异不符合预期:\n%s\n期望:\n%s", diff, want)
+	}
+}
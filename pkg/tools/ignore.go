@@ -0,0 +1,146 @@
+package tools
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule 一条 .gitignore 风格的规则
+type ignoreRule struct {
+	pattern  string
+	negate   bool // 以 ! 开头，重新包含
+	dirOnly  bool // 以 / 结尾，只匹配目录
+	anchored bool // 包含 /，相对根目录匹配
+}
+
+// IgnoreMatcher 按 .gitignore 语义匹配相对路径，后出现的规则优先
+type IgnoreMatcher struct {
+	rules []ignoreRule
+}
+
+// ParseIgnore 从 r 中读取 .gitignore 风格的规则
+func ParseIgnore(r io.Reader) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m.Add(scanner.Text())
+	}
+	return m, scanner.Err()
+}
+
+// LoadIgnoreFiles 读取 root 下的忽略文件（如 .gitignore、.vboxignore），不存在的文件会被跳过
+func LoadIgnoreFiles(root string, names ...string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(root, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		parsed, err := ParseIgnore(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		m.rules = append(m.rules, parsed.rules...)
+	}
+	return m, nil
+}
+
+// Add 添加一条规则，空行和注释会被忽略
+func (m *IgnoreMatcher) Add(line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	rule := ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	rule.pattern = line
+	m.rules = append(m.rules, rule)
+}
+
+// Match 判断相对路径（使用 / 分隔）是否被忽略，父目录被忽略时子路径同样被忽略
+func (m *IgnoreMatcher) Match(rel string, isDir bool) bool {
+	if m == nil || len(m.rules) == 0 {
+		return false
+	}
+	rel = path.Clean(strings.TrimPrefix(filepath.ToSlash(rel), "/"))
+	if rel == "." {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if m.matchOne(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.matchOne(rel, isDir)
+}
+
+// matchOne 只根据规则判断单个路径，不考虑父目录
+func (m *IgnoreMatcher) matchOne(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		var matched bool
+		if rule.anchored {
+			matched = matchGlob(rule.pattern, rel)
+		} else {
+			matched = matchGlob(rule.pattern, path.Base(rel))
+		}
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchGlob 按路径段匹配，** 匹配零个或多个路径段
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
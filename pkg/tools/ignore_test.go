@@ -0,0 +1,45 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestIgnoreMatcher 测试 .gitignore 风格规则的匹配
+func TestIgnoreMatcher(t *testing.T) {
+	m, err := ParseIgnore(strings.NewReader(`
+# 注释
+*.log
+!keep.log
+build/
+/vendor
+docs/**/*.tmp
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"app.log", false, true},
+		{"sub/app.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build/out.o", false, true},
+		{"vendor/x.go", false, true},
+		{"src/vendor/x.go", false, false},
+		{"docs/a/b/c.tmp", false, true},
+		{"docs/c.tmp", false, true},
+		{"main.go", false, false},
+	}
+
+	for _, tc := range testCases {
+		if got := m.Match(tc.path, tc.isDir); got != tc.want {
+			t.Errorf("Match(%q, %v) = %v, 期望 %v", tc.path, tc.isDir, got, tc.want)
+		}
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/moby/moby/client"
 )
@@ -24,8 +26,62 @@ func ImageExists(ctx context.Context, cli *client.Client, imageName string) (boo
 	return true, nil
 }
 
+// ImageLabels 获取镜像的标签
+func ImageLabels(ctx context.Context, cli *client.Client, imageName string) (map[string]string, error) {
+	inspect, err := cli.ImageInspect(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	if inspect.Config == nil {
+		return nil, nil
+	}
+	return inspect.Config.Labels, nil
+}
+
+// ImageArch 获取镜像的架构，使用 Go 风格的名称，镜像不存在时返回空字符串
+func ImageArch(ctx context.Context, cli *client.Client, imageName string) (string, error) {
+	inspect, err := cli.ImageInspect(ctx, imageName)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such image") {
+			return "", nil
+		}
+		return "", err
+	}
+	return NormalizeArch(inspect.Architecture), nil
+}
+
+// NormalizeArch 将 uname 风格的架构名转换为 Go 风格，如 x86_64 -> amd64
+func NormalizeArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "x86_64", "x86-64", "amd64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "armv7l", "armv7", "armhf", "arm":
+		return "arm"
+	case "i386", "i686", "386":
+		return "386"
+	default:
+		return strings.ToLower(arch)
+	}
+}
+
+// contextModTime 是构建上下文中所有条目的修改时间
+// 经典构建器按文件头（包括修改时间和属主）计算 COPY 的缓存键，固定这些字段后内容不变就能命中缓存
+var contextModTime = time.Unix(0, 0).UTC()
+
+// ContextFile 是构建上下文中的一个额外文件，内容来自 Path 指向的文件或 Data
+// Path 是目录时添加整个目录，Ignore 按相对该目录的路径过滤，可为空
+type ContextFile struct {
+	Name   string // 在构建上下文中的路径
+	Path   string
+	Data   []byte
+	Ignore *IgnoreMatcher
+}
+
 // CreateBuildContext 创建构建上下文的 tar 流
-func CreateBuildContext(dockerfilePath string, setupScriptPath string, setupEnvScriptPath string) (io.ReadCloser, error) {
+// 条目按固定顺序写入并去掉修改时间和属主，同样的输入总是得到同样的 tar；文件边读边写，不会整体读入内存
+func CreateBuildContext(dockerfilePath string, setupScriptPath string, files []ContextFile) (io.ReadCloser, error) {
 	// 创建管道
 	pr, pw := io.Pipe()
 
@@ -35,49 +91,121 @@ func CreateBuildContext(dockerfilePath string, setupScriptPath string, setupEnvS
 		tw := tar.NewWriter(pw)
 		defer tw.Close()
 
-		// 添加 Dockerfile 到 tar (在根目录下命名为 Dockerfile)
-		if err := addFileToTar(tw, dockerfilePath, filepath.Base(dockerfilePath)); err != nil {
-			pw.CloseWithError(fmt.Errorf("添加 Dockerfile 到 tar 失败: %w", err))
-			return
+		// 添加 Dockerfile 到 tar (在根目录下命名为 Dockerfile)，为空时由 files 提供
+		if dockerfilePath != "" {
+			if err := addContextPath(tw, dockerfilePath, filepath.Base(dockerfilePath), nil); err != nil {
+				pw.CloseWithError(fmt.Errorf("添加 Dockerfile 到 tar 失败: %w", err))
+				return
+			}
 		}
 
-		if err := addFileToTar(tw, setupScriptPath, filepath.Base(setupScriptPath)); err != nil {
+		if err := addContextPath(tw, setupScriptPath, filepath.Base(setupScriptPath), nil); err != nil {
 			pw.CloseWithError(fmt.Errorf("添加 setup.sh 到 tar 失败: %w", err))
 			return
 		}
 
-		if err := addFileToTar(tw, setupEnvScriptPath, "env.sh"); err != nil {
-			pw.CloseWithError(fmt.Errorf("添加环境脚本到 tar 失败: %w", err))
-			return
+		for _, file := range files {
+			var err error
+			if file.Path != "" {
+				err = addContextPath(tw, file.Path, file.Name, file.Ignore)
+			} else {
+				err = addDataToTar(tw, file.Data, file.Name)
+			}
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("添加 %s 到 tar 失败: %w", file.Name, err))
+				return
+			}
 		}
 	}()
 
 	return pr, nil
 }
 
-// addFileToTar 添加单个文件到 tar
-func addFileToTar(tw *tar.Writer, filePath, tarPath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
+// addDataToTar 将内存中的数据作为普通文件添加到 tar
+func addDataToTar(tw *tar.Writer, data []byte, tarPath string) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     tarPath,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  contextModTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
 		return err
 	}
-	defer file.Close()
+	_, err := tw.Write(data)
+	return err
+}
 
-	info, err := file.Stat()
+// addContextPath 添加文件或目录到构建上下文，目录中的条目按名称排序，符号链接保持为链接
+// filePath 本身是符号链接时添加它指向的文件或目录
+func addContextPath(tw *tar.Writer, filePath, tarPath string, ignore *IgnoreMatcher) error {
+	info, err := os.Stat(filePath)
 	if err != nil {
 		return err
 	}
-
-	header := &tar.Header{
-		Name: tarPath,
-		Size: info.Size(),
-		Mode: int64(info.Mode()),
+	if !info.IsDir() {
+		return addContextEntry(tw, filePath, tarPath, info)
 	}
 
+	// filepath.Walk 按文件名顺序遍历，不跟随符号链接
+	return filepath.Walk(filePath, func(entryPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(filePath, entryPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if ignore.Match(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			// 跳过套接字、设备文件等
+			return nil
+		}
+		return addContextEntry(tw, entryPath, path.Join(tarPath, relPath), info)
+	})
+}
+
+// addContextEntry 添加单个条目，固定修改时间和属主，只保留权限位
+func addContextEntry(tw *tar.Writer, filePath, tarPath string, info os.FileInfo) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = tarPath
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.Mode &= 0777
+	header.ModTime, header.AccessTime, header.ChangeTime = contextModTime, time.Time{}, time.Time{}
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
 	if err := tw.WriteHeader(header); err != nil {
 		return err
 	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
 
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// 文件在打包过程中被修改时 tar.Writer 会返回错误，不会写入损坏的条目
 	_, err = io.Copy(tw, file)
 	return err
 }
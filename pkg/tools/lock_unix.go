@@ -0,0 +1,24 @@
+//go:build !windows
+
+package tools
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// TryLockFile 尝试获取文件的排他锁，不等待；锁被其他进程或同一进程的其他打开持有时返回 false
+// 持有锁的进程退出时锁自动释放
+func TryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UnlockFile 释放 TryLockFile 获取的锁
+func UnlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
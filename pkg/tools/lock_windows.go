@@ -0,0 +1,30 @@
+//go:build windows
+
+package tools
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffsetHigh 锁定文件末尾之外的一个字节，不妨碍其他进程读取文件内容
+const lockOffsetHigh = 0x7fffffff
+
+// TryLockFile 尝试获取文件的排他锁，不等待；锁被其他进程或同一进程的其他打开持有时返回 false
+// 持有锁的进程退出时锁自动释放
+func TryLockFile(f *os.File) (bool, error) {
+	ol := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UnlockFile 释放 TryLockFile 获取的锁
+func UnlockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package tools
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// ProcessAlive 检查进程是否仍在运行
+func ProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// TerminateProcess 请求进程退出
+func TerminateProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(syscall.SIGTERM)
+}
+
+// Detach 让子进程脱离当前终端会话，父进程退出后继续运行
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
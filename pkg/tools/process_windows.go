@@ -0,0 +1,34 @@
+//go:build windows
+
+package tools
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// ProcessAlive 检查进程是否仍在运行
+// Windows 下 FindProcess 会打开进程句柄，进程不存在时返回错误
+func ProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// TerminateProcess 请求进程退出，Windows 下只能直接结束进程
+func TerminateProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
+
+// Detach 让子进程使用新的进程组，不随当前控制台退出
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -6,6 +6,9 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -15,7 +18,6 @@ import (
 	"github.com/123cdxcc/vbox/box"
 	"github.com/123cdxcc/vbox/config"
 	"github.com/123cdxcc/vbox/constant"
-	"github.com/123cdxcc/vbox/pkg/tools"
 )
 
 // BoxListParams 包含列出 box 的参数
@@ -31,12 +33,20 @@ type BoxGetParams struct {
 // BoxRunParams 包含运行 box 的参数
 type BoxRunParams struct {
 	Name      string
-	Image     string // 格式: "imageName:version"
+	Image     string // 格式: "name:version"，多个环境用 "+" 连接，如 "golang:1.25.0+node:22"
+	Base      string // 基础镜像，如 alpine、ubuntu:22.04，为空时使用 debian
+	Rebuild   string // 重新构建镜像的策略: auto、always、never，为空时使用 auto
 	Ports     []box.Port
 	SSHPort   int               // SSH 端口映射，0表示随机分配
 	PublicKey string            // SSH 公钥内容或文件路径
 	Volumes   map[string]string // 卷挂载配置，key为主机路径，value为容器路径
 	Detached  bool              // 是否后台运行，默认 true
+	SSHProxy  bool              // 通过 vbox ssh-proxy 连接，不发布 SSH 端口
+	Idle      box.IdlePolicy    // 空闲自动停止策略
+
+	UserMapping string // 主机用户映射模式: auto、host、none
+	UID         int    // 显式指定 box 用户的 UID，小于 0 表示不指定
+	GID         int    // 显式指定 box 用户组的 GID，小于 0 表示不指定
 }
 
 // BoxStopParams 包含停止 box 的参数
@@ -49,21 +59,34 @@ type BoxRemoveParams struct {
 	BoxID string
 }
 
+// BoxProxyParams 包含 SSH 代理的参数
+type BoxProxyParams struct {
+	Name string // box 名称，即 SSH 配置中的 Host
+}
+
+// BoxStopIdleParams 包含停止空闲 box 的参数
+type BoxStopIdleParams struct {
+	DryRun bool // 只打印将被停止的 box
+}
+
 // BoxService 提供 box 相关的业务逻辑
 type BoxService struct {
 	imageService *ImageService
+	backend      runBackend // vbox run 中会修改系统状态的操作
 }
 
 // NewBoxService 创建新的 BoxService 实例
 func NewBoxService() *BoxService {
+	imageService := NewImageService()
 	return &BoxService{
-		imageService: NewImageService(),
+		imageService: imageService,
+		backend:      &dockerRunBackend{imageService: imageService},
 	}
 }
 
 // ListBoxes 列出所有 vbox
 func (s *BoxService) ListBoxes(ctx context.Context, params BoxListParams) error {
-	containers, err := box.List()
+	containers, err := box.List(ctx)
 	if err != nil {
 		return fmt.Errorf("获取容器列表失败: %v", err)
 	}
@@ -104,6 +127,13 @@ func (s *BoxService) GetBox(ctx context.Context, params BoxGetParams) error {
 	fmt.Printf("Box ID: %s\n", container.ID)
 	fmt.Printf("名称: %s\n", container.Name)
 	fmt.Printf("镜像: %s\n", container.Image)
+	if spec := container.Labels[constant.LabelSpec]; spec != "" {
+		if request := container.Labels[constant.LabelRequest]; request != "" && request != spec {
+			fmt.Printf("环境: %s (请求: %s)\n", spec, request)
+		} else {
+			fmt.Printf("环境: %s\n", spec)
+		}
+	}
 	fmt.Printf("状态: %s\n", container.Status)
 	fmt.Printf("运行状态: %s\n", container.State)
 
@@ -142,93 +172,164 @@ func (s *BoxService) isPortAvailable(port int) bool {
 	return true
 }
 
-// Run 运行一个新的 box
-func (s *BoxService) Run(ctx context.Context, params BoxRunParams) (boxContainer *box.Container, gerr error) {
-	cli := config.GlobalConfig.GetDockerClient()
+// hintDeclaredPorts 提示环境模板声明了但未发布的端口
+func (s *BoxService) hintDeclaredPorts(ctx context.Context, imageLabels map[string]string, published []box.Port) {
+	declared := imageLabels[constant.LabelPorts]
+	if declared == "" {
+		return
+	}
+	var missing []string
+	for _, port := range strings.Split(declared, ",") {
+		if !slices.ContainsFunc(published, func(p box.Port) bool { return strconv.Itoa(p.PrivatePort) == port }) {
+			missing = append(missing, port)
+		}
+	}
+	if len(missing) > 0 {
+		slog.InfoContext(ctx, fmt.Sprintf("镜像声明了常用端口 %s，可以用 -p 发布", strings.Join(missing, ",")))
+	}
+}
 
-	// 解析镜像名和版本
-	var imageName string
-	var imageVersion string
+// resolveUserMapping 根据映射模式计算 box 用户的 UID/GID 环境变量
+// rootless Docker 中容器内的 root 才对应主机用户，auto 模式下不做映射
+func (s *BoxService) resolveUserMapping(ctx context.Context, params BoxRunParams) ([]string, error) {
+	uid, gid := params.UID, params.GID
 
-	if !strings.Contains(params.Image, ":") {
-		return nil, fmt.Errorf("镜像格式错误: %s，正确格式应为 'name:version'", params.Image)
+	switch params.UserMapping {
+	case "", constant.UserMappingAuto:
+		if runtime.GOOS != "linux" {
+			break
+		}
+		rootless, err := box.RootlessDocker(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if rootless {
+			slog.InfoContext(ctx, "检测到 rootless Docker，不映射主机 UID/GID")
+			break
+		}
+		fallthrough
+	case constant.UserMappingHost:
+		// Windows 上 Getuid 返回 -1，root 用户不做映射
+		if uid < 0 && os.Getuid() > 0 {
+			uid = os.Getuid()
+		}
+		if gid < 0 && os.Getgid() > 0 {
+			gid = os.Getgid()
+		}
+	case constant.UserMappingNone:
+	default:
+		return nil, fmt.Errorf("不支持的用户映射模式: %s", params.UserMapping)
 	}
 
-	parts := strings.SplitN(params.Image, ":", 2)
-	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
-		return nil, fmt.Errorf("镜像格式错误: %s，正确格式应为 'name:version'", params.Image)
+	var env []string
+	if uid >= 0 {
+		env = append(env, fmt.Sprintf("%s=%d", constant.EnvUID, uid))
 	}
-	imageName = parts[0]
-	imageVersion = parts[1]
-
-	imageFullName := fmt.Sprintf("%s%s:%s", constant.VboxImagePrefix, imageName, imageVersion)
+	if gid >= 0 {
+		env = append(env, fmt.Sprintf("%s=%d", constant.EnvGID, gid))
+	}
+	return env, nil
+}
 
-	// 检查镜像是否存在
-	exists, err := tools.ImageExists(ctx, cli, imageFullName)
+// sshProxyCommand 返回写入 SSH 配置的 ProxyCommand，使用当前可执行文件的绝对路径
+func sshProxyCommand() (string, error) {
+	executable, err := os.Executable()
 	if err != nil {
-		return nil, fmt.Errorf("检查镜像失败: %w", err)
+		return "", fmt.Errorf("获取 vbox 可执行文件路径失败: %w", err)
 	}
+	return proxyCommandFor(executable, runtime.GOOS), nil
+}
 
-	if !exists {
-		// 镜像不存在，尝试从模板构建
-		if err := s.imageService.BuildImage(ctx, ImageBuildParams{
-			EnvName: imageName,
-			Version: imageVersion,
-		}); err != nil {
-			return nil, fmt.Errorf("镜像 %s 不存在且无法从模板构建: %w", imageFullName, err)
+// proxyCommandFor 生成执行 executable ssh-proxy 的 ProxyCommand
+// ssh 先展开 % 开头的记号，再交给 shell 执行（Windows 上直接执行），路径中的空格等字符需要引用
+func proxyCommandFor(executable, goos string) string {
+	executable = strings.ReplaceAll(executable, "%", "%%")
+	switch {
+	case goos == "windows":
+		if strings.ContainsAny(executable, " \t&()^") {
+			executable = `"` + executable + `"`
 		}
+	case strings.ContainsAny(executable, " \t'\"\\$`!&;|<>()*?[]{}#~"):
+		executable = "'" + strings.ReplaceAll(executable, "'", `'\''`) + "'"
 	}
+	return executable + " ssh-proxy %n"
+}
 
-	// 处理SSH端口
-	sshPort := params.SSHPort
-	if sshPort == 0 {
-		// 随机生成端口
-		randomPort, err := s.generateRandomPort()
-		if err != nil {
-			return nil, fmt.Errorf("生成随机SSH端口失败: %w", err)
-		}
-		sshPort = randomPort
-		slog.InfoContext(ctx, fmt.Sprintf("为容器 %s 随机分配SSH端口: %d", params.Name, sshPort))
+// Proxy 将当前进程的 stdin/stdout 连接到 box 内的 sshd
+// 输出会被 ssh 当作协议数据，这里不能向 stdout 打印任何内容
+func (s *BoxService) Proxy(ctx context.Context, params BoxProxyParams) error {
+	// 记录会话，供空闲检测使用
+	endSession, err := box.BeginSession(params.Name)
+	if err != nil {
+		return fmt.Errorf("SSH 代理失败: %v", err)
+	}
+	defer endSession()
+
+	if err := box.Proxy(ctx, constant.VboxContainerPrefix+params.Name, os.Stdin, os.Stdout); err != nil {
+		return fmt.Errorf("SSH 代理失败: %v", err)
 	}
+	return nil
+}
+
+// StopIdleBoxes 停止配置了空闲策略且已空闲超时的 box
+// 空闲的判定：没有经由 ssh-proxy 的活跃会话，距最近活动（或启动）超过超时时间，且 CPU 使用率低于阈值
+func (s *BoxService) StopIdleBoxes(ctx context.Context, params BoxStopIdleParams) error {
+	containers, err := box.List(ctx)
+	if err != nil {
+		return fmt.Errorf("获取容器列表失败: %v", err)
+	}
+
+	for _, container := range containers {
+		if container.State != "running" {
+			continue
+		}
+		policy, ok := box.ParseIdlePolicy(container.Labels)
+		if !ok {
+			continue
+		}
 
-	// 处理SSH密钥
-	var publicKeyPath = params.PublicKey
-	if publicKeyPath == "" {
-		// 如果没有提供公钥，则生成新的SSH密钥对
-		generatedPublicKey, generatedPrivateKey, err := config.GenSSHKeys()
+		sessions, lastActivity, err := box.Sessions(container.Name)
 		if err != nil {
-			return nil, fmt.Errorf("生成SSH密钥失败: %w", err)
+			slog.WarnContext(ctx, fmt.Sprintf("读取 box %s 的会话失败: %v", container.Name, err))
+			continue
+		}
+		if sessions > 0 {
+			continue
 		}
-		slog.InfoContext(ctx, fmt.Sprintf("为容器 %s 生成了新的SSH密钥", params.Name))
 
-		// 保存SSH配置和密钥文件
-		publicKeyPath, err = config.UpdateSSH(params.Name, "localhost", constant.VboxUser, fmt.Sprintf("%d", sshPort), generatedPrivateKey, generatedPublicKey)
+		startedAt, err := box.StartedAt(ctx, container.ID)
 		if err != nil {
-			return nil, fmt.Errorf("保存SSH配置失败: %w", err)
+			slog.WarnContext(ctx, fmt.Sprintf("获取 box %s 的启动时间失败: %v", container.Name, err))
+			continue
+		}
+		if lastActivity.Before(startedAt) {
+			lastActivity = startedAt
+		}
+		idleFor := time.Since(lastActivity)
+		if idleFor < policy.Timeout {
+			continue
 		}
-		slog.InfoContext(ctx, fmt.Sprintf("为容器 %s 保存了SSH配置", params.Name))
-		slog.InfoContext(ctx, "公钥路径", slog.Any("path", publicKeyPath))
-	}
 
-	// 创建容器选项
-	createOpt := box.CreateOption{
-		Name:         params.Name,
-		ImageName:    imageName,
-		ImageVersion: imageVersion,
-		Ports:        params.Ports,
-		SSHPort:      sshPort,
-		PublicKey:    publicKeyPath,
-		Volumes:      params.Volumes,
-		Detached:     params.Detached,
-	}
+		cpu, err := box.CPUPercent(ctx, container.ID)
+		if err != nil {
+			slog.WarnContext(ctx, fmt.Sprintf("获取 box %s 的 CPU 使用率失败: %v", container.Name, err))
+			continue
+		}
+		if cpu >= policy.CPUPercent {
+			continue
+		}
 
-	// 调用 box.Create 创建容器
-	container, err := box.Create(ctx, createOpt)
-	if err != nil {
-		return nil, err
+		if params.DryRun {
+			fmt.Printf("将停止空闲 box: %s (空闲 %s, CPU %.1f%%)\n", container.Name, idleFor.Round(time.Second), cpu)
+			continue
+		}
+		if err := box.Stop(ctx, container.ID); err != nil {
+			slog.WarnContext(ctx, fmt.Sprintf("停止空闲 box %s 失败: %v", container.Name, err))
+			continue
+		}
+		fmt.Printf("已停止空闲 box: %s (空闲 %s, CPU %.1f%%)\n", container.Name, idleFor.Round(time.Second), cpu)
 	}
-
-	return container, nil
+	return nil
 }
 
 // StopBox 停止指定的 box
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+	"gopkg.in/yaml.v3"
+)
+
+// ImageBuildManyParams 包含并行构建多个镜像的参数
+type ImageBuildManyParams struct {
+	All     bool             // 构建所有环境模板的所有版本
+	Envs    []string         // 构建这些环境的所有版本
+	Matrix  string           // 矩阵文件路径
+	Bases   []string         // 基础镜像，每个环境分别基于这些基础镜像构建，为空时使用 debian
+	Jobs    int              // 同时进行的构建数，小于 1 时使用默认值
+	Options ImageBuildParams // 各镜像共用的构建选项，Spec、Base 和 Output 被忽略
+}
+
+// buildMatrix 是矩阵文件的内容
+//
+//	bases: [debian, alpine]
+//	builds:
+//	  - golang                  # 所有版本
+//	  - node:22
+//	  - golang:1.25.0+node:22
+type buildMatrix struct {
+	Bases  []string `yaml:"bases"`  // 为空时使用 --base
+	Builds []string `yaml:"builds"` // 环境描述，只写环境名称时构建所有版本
+}
+
+// parseBuildMatrix 解析矩阵文件
+func parseBuildMatrix(data []byte) (*buildMatrix, error) {
+	var m buildMatrix
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("解析矩阵文件失败: %w", err)
+	}
+	if len(m.Builds) == 0 {
+		return nil, fmt.Errorf("矩阵文件中没有 builds")
+	}
+	return &m, nil
+}
+
+// buildJob 是并行构建中的一个镜像
+type buildJob struct {
+	spec  image.Spec // 已经解析的版本
+	base  string     // --base 形式的基础镜像
+	tag   string
+	label string // 输出前缀，如 golang:1.25.0 或 golang:1.25.0/alpine
+
+	status   string
+	duration time.Duration
+	err      error
+}
+
+// 并行构建中镜像的状态
+const (
+	jobSucceeded = "成功"
+	jobFailed    = "失败"
+	jobCanceled  = "已取消"
+)
+
+// templateEnvNames 返回所有模板层中的环境名称，按名称排序
+func templateEnvNames() ([]string, error) {
+	entries, err := template.List(config.GlobalConfig.TemplatesDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("获取模板列表失败: %v", err)
+	}
+	layers, err := templateLayers()
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		if layer.Kind != template.LayerSource {
+			continue
+		}
+		sourceEntries, err := template.ListSource(layer)
+		if err != nil {
+			return nil, fmt.Errorf("读取模板来源 %s 失败: %v", layer.Name, err)
+		}
+		entries = append(entries, sourceEntries...)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !slices.Contains(names, entry.Name) {
+			names = append(names, entry.Name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// envVersions 返回环境可以构建的所有版本：template.yaml 声明的 versions，没有声明时使用版本脚本
+func envVersions(name string) ([]string, error) {
+	layers, err := templateLayers()
+	if err != nil {
+		return nil, err
+	}
+	envDir, _, err := template.FindEnv(layers, name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := template.LoadManifest(envDir)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	if m != nil && len(m.Versions) > 0 {
+		versions = slices.Clone(m.Versions)
+	} else {
+		versions = template.ScriptVersions(envDir)
+	}
+	slices.SortFunc(versions, template.CompareVersions)
+	return versions, nil
+}
+
+// planBuilds 展开要构建的环境和基础镜像，解析版本并去掉重复的镜像
+func (s *ImageService) planBuilds(ctx context.Context, params ImageBuildManyParams) ([]*buildJob, error) {
+	bases := params.Bases
+	var requests []string // 环境描述，或者只有环境名称
+	if params.All {
+		names, err := templateEnvNames()
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, names...)
+	}
+	requests = append(requests, params.Envs...)
+	if params.Matrix != "" {
+		data, err := os.ReadFile(params.Matrix)
+		if err != nil {
+			return nil, fmt.Errorf("读取矩阵文件失败: %v", err)
+		}
+		matrix, err := parseBuildMatrix(data)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, matrix.Builds...)
+		if len(matrix.Bases) > 0 {
+			bases = matrix.Bases
+		}
+	}
+	if len(bases) == 0 {
+		bases = []string{""}
+	}
+
+	var specs []image.Spec
+	for _, request := range requests {
+		if strings.ContainsAny(request, ":+") {
+			spec, err := image.ParseSpec(request)
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, spec)
+			continue
+		}
+		versions, err := envVersions(request)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			fmt.Printf("跳过环境 %s: 没有版本脚本，template.yaml 中也没有声明 versions\n", request)
+			continue
+		}
+		for _, version := range versions {
+			specs = append(specs, image.Spec{{Name: request, Version: version}})
+		}
+	}
+
+	var jobs []*buildJob
+	seen := make(map[string]bool)
+	for _, baseName := range bases {
+		base, err := template.ParseBase(baseName)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range specs {
+			resolved, _, err := s.resolveSpec(ctx, spec, base)
+			if err != nil {
+				return nil, err
+			}
+			// 同一个镜像只构建一次，如同时指定了 golang 和 golang:1.25.0
+			tag := resolved.BaseTag(base.ID())
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			label := resolved.String()
+			if base.ID() != "" {
+				label += "/" + base.ID()
+			}
+			jobs = append(jobs, &buildJob{spec: resolved, base: baseName, tag: tag, label: label})
+		}
+	}
+	return jobs, nil
+}
+
+// BuildMany 并行构建多个镜像，各镜像的输出逐行交错打印并带有镜像前缀，最后打印汇总表
+// 一个镜像构建失败不影响其他镜像，有镜像失败时返回错误
+func (s *ImageService) BuildMany(ctx context.Context, params ImageBuildManyParams) error {
+	jobs, err := s.planBuilds(ctx, params)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("没有要构建的镜像")
+	}
+	workers := params.Jobs
+	if workers < 1 {
+		workers = constant.DefaultBuildJobs
+	}
+	workers = min(workers, len(jobs))
+	fmt.Printf("构建 %d 个镜像，同时构建 %d 个\n", len(jobs), workers)
+
+	width := 0
+	for _, job := range jobs {
+		width = max(width, len(job.label))
+	}
+	var mu sync.Mutex // 保证各镜像的输出行不会交错在同一行中
+	queue := make(chan *buildJob)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				out := &prefixWriter{mu: &mu, out: os.Stdout, prefix: fmt.Sprintf("%-*s | ", width, job.label)}
+				opts := params.Options
+				opts.Spec, opts.Base, opts.Output = job.spec, job.base, out
+				start := time.Now()
+				_, job.err = s.BuildImage(ctx, opts)
+				job.duration = time.Since(start)
+				out.Flush()
+				switch {
+				case job.err == nil:
+					job.status = jobSucceeded
+				case ctx.Err() != nil:
+					job.status = jobCanceled
+				default:
+					job.status = jobFailed
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			job.status = jobCanceled
+			continue
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	printBuildSummary(os.Stdout, jobs)
+	failed := 0
+	for _, job := range jobs {
+		if job.status == jobFailed {
+			failed++
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("构建已取消: %w", ctx.Err())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d 个镜像构建失败", failed)
+	}
+	return nil
+}
+
+// printBuildSummary 打印各镜像的构建结果和用时，失败的镜像在表格后列出原因
+func printBuildSummary(out io.Writer, jobs []*buildJob) {
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTAG\tSTATUS\tDURATION")
+	for _, job := range jobs {
+		duration := "-"
+		if job.duration > 0 {
+			duration = job.duration.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", job.label, job.tag, job.status, duration)
+	}
+	w.Flush()
+	for _, job := range jobs {
+		if job.status == jobFailed {
+			fmt.Fprintf(out, "\n%s: %v\n", job.label, job.err)
+		}
+	}
+}
+
+// prefixWriter 在每行前加上前缀后写入 out，多个 prefixWriter 共用 mu 时各自的行不会交错
+type prefixWriter struct {
+	mu      *sync.Mutex
+	out     io.Writer
+	prefix  string
+	partial []byte // 还没有换行的输出
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	lines := w.partial[:i+1]
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			buf.WriteString(w.prefix)
+			buf.Write(line)
+		}
+	}
+	w.partial = append([]byte(nil), w.partial[i+1:]...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush 输出最后一行没有换行的内容
+func (w *prefixWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/123cdxcc/vbox/config"
+	template "github.com/123cdxcc/vbox/env"
+)
+
+// TestPlanBuilds 测试批量构建时要构建的镜像的展开和去重
+func TestPlanBuilds(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+	dir := t.TempDir()
+	config.GlobalConfig.TemplatesDirPath = filepath.Join(dir, "env")
+	config.GlobalConfig.SourcesDirPath = filepath.Join(dir, "sources")
+	if err := template.Init(config.GlobalConfig.TemplatesDirPath); err != nil {
+		t.Fatal(err)
+	}
+
+	matrix := filepath.Join(dir, "matrix.yaml")
+	if err := os.WriteFile(matrix, []byte("bases: [debian, alpine]\nbuilds:\n  - golang:stable\n  - golang\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewImageService()
+	jobs, err := s.planBuilds(context.Background(), ImageBuildManyParams{Matrix: matrix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, job := range jobs {
+		labels = append(labels, job.label)
+	}
+	// golang:stable 解析为 1.25.0，与 golang 的所有版本重复的只构建一次
+	want := []string{
+		"golang:1.25.0", "golang:1.23.12", "golang:1.24.6",
+		"golang:1.25.0/alpine", "golang:1.23.12/alpine", "golang:1.24.6/alpine",
+	}
+	if !slices.Equal(labels, want) {
+		t.Fatalf("展开结果不符合预期:\n%v\n期望:\n%v", labels, want)
+	}
+	if jobs[3].tag != "vbox-golang:1.25.0-alpine" || jobs[3].base != "alpine" {
+		t.Fatalf("基础镜像不符合预期: %+v", jobs[3])
+	}
+
+	// --env 和 --base
+	jobs, err = s.planBuilds(context.Background(), ImageBuildManyParams{Envs: []string{"golang"}, Bases: []string{"ubuntu"}})
+	if err != nil || len(jobs) != 3 || jobs[0].label != "golang:1.23.12/ubuntu" {
+		t.Fatalf("--env golang 的展开结果不符合预期: %v", err)
+	}
+	if _, err := s.planBuilds(context.Background(), ImageBuildManyParams{Envs: []string{"missing"}}); err == nil {
+		t.Fatal("不存在的环境应返回错误")
+	}
+
+	for _, data := range []string{"builds: []", "bases: [debian]", "builds: [golang]\nunknown: 1"} {
+		if _, err := parseBuildMatrix([]byte(data)); err == nil {
+			t.Errorf("parseBuildMatrix(%q) 应返回错误", data)
+		}
+	}
+}
+
+// TestPrefixWriter 测试并行输出时每行带有前缀且不会交错
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	writers := make([]*prefixWriter, 4)
+	for i := range writers {
+		writers[i] = &prefixWriter{mu: &mu, out: &out, prefix: fmt.Sprintf("[%d] ", i)}
+		wg.Add(1)
+		go func(w *prefixWriter, i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// 一行分几次写入
+				fmt.Fprintf(w, "line %d", j)
+				fmt.Fprintf(w, " from %d\n", i)
+			}
+			fmt.Fprintf(w, "last")
+			w.Flush()
+		}(writers[i], i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4*101 {
+		t.Fatalf("期望 %d 行，实际 %d 行", 4*101, len(lines))
+	}
+	for _, line := range lines {
+		var i int
+		if _, err := fmt.Sscanf(line, "[%d] ", &i); err != nil {
+			t.Fatalf("行没有前缀: %q", line)
+		}
+		if rest := strings.TrimPrefix(line, fmt.Sprintf("[%d] ", i)); rest != "last" && !strings.HasSuffix(rest, fmt.Sprintf(" from %d", i)) {
+			t.Fatalf("行内容交错: %q", line)
+		}
+	}
+}
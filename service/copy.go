@@ -0,0 +1,230 @@
+package service
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/123cdxcc/vbox/box"
+	"github.com/123cdxcc/vbox/constant"
+	"github.com/123cdxcc/vbox/pkg/tools"
+)
+
+// BoxCopyParams 包含在主机和 box 之间复制文件的参数
+type BoxCopyParams struct {
+	Src   string // 源路径，"<box>:<path>"、本地路径或 "-"（从 stdin 读取 tar 流）
+	Dst   string // 目标路径，"<box>:<path>"、本地路径或 "-"（向 stdout 写出 tar 流）
+	Quiet bool   // 不显示进度
+}
+
+// copyEndpoint 表示复制的一端
+type copyEndpoint struct {
+	Box  string // box 名称，为空表示主机
+	Path string
+}
+
+// parseCopyEndpoint 解析 "<box>:<path>" 或本地路径
+// 以 "/" 或 "." 开头的参数总是视为本地路径，便于复制名称中带冒号的文件
+func parseCopyEndpoint(arg string) copyEndpoint {
+	if arg == "-" || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") || filepath.IsAbs(arg) {
+		return copyEndpoint{Path: arg}
+	}
+	name, p, ok := strings.Cut(arg, ":")
+	if !ok || name == "" {
+		return copyEndpoint{Path: arg}
+	}
+	if p == "" {
+		p = "."
+	}
+	return copyEndpoint{Box: name, Path: p}
+}
+
+// Copy 在主机和 box 之间复制文件或目录
+func (s *BoxService) Copy(ctx context.Context, params BoxCopyParams) error {
+	src := parseCopyEndpoint(params.Src)
+	dst := parseCopyEndpoint(params.Dst)
+
+	progress := s.newCopyProgress(params.Quiet)
+	defer progress.Done()
+
+	switch {
+	case src.Box == "" && dst.Box != "":
+		return s.copyToBox(ctx, src.Path, dst, progress.Update)
+	case src.Box != "" && dst.Box == "":
+		return s.copyFromBox(ctx, src, dst.Path, progress.Update)
+	case src.Box != "" && dst.Box != "":
+		return fmt.Errorf("不支持在两个 box 之间直接复制")
+	default:
+		return fmt.Errorf("源路径和目标路径至少有一个必须是 '<box>:<path>' 格式")
+	}
+}
+
+// copyToBox 将主机上的文件或 stdin 中的 tar 流复制到 box，文件所有者设置为 box 用户
+func (s *BoxService) copyToBox(ctx context.Context, srcPath string, dst copyEndpoint, onProgress tools.TarProgress) error {
+	containerID := constant.VboxContainerPrefix + dst.Box
+	boxContainer, err := box.Get(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("获取 box 信息失败: %w", err)
+	}
+	boxUser := boxContainer.User().Name
+
+	// stdin 中的 tar 流直接解包到目标目录
+	if srcPath == "-" {
+		stat, exists, err := box.StatPath(ctx, containerID, dst.Path)
+		if err != nil {
+			return err
+		}
+		if !exists || !stat.Mode.IsDir() {
+			return fmt.Errorf("目标 %s 必须是 box 中已存在的目录", dst.Path)
+		}
+
+		// 边上传边解析 tar 头，记录顶层条目以便修正所有者
+		pr, pw := io.Pipe()
+		roots := make(map[string]struct{})
+		var parseErr error
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr := tar.NewReader(pr)
+			for {
+				header, err := tr.Next()
+				if err != nil {
+					if err != io.EOF {
+						parseErr = err
+					}
+					io.Copy(io.Discard, pr)
+					return
+				}
+				root, _, _ := strings.Cut(strings.TrimPrefix(path.Clean(header.Name), "/"), "/")
+				roots[root] = struct{}{}
+			}
+		}()
+
+		copyErr := box.CopyTo(ctx, containerID, dst.Path, io.TeeReader(os.Stdin, pw))
+		pw.Close()
+		wg.Wait()
+		if copyErr != nil {
+			return copyErr
+		}
+		if parseErr != nil {
+			return fmt.Errorf("解析 tar 流失败: %w", parseErr)
+		}
+		for root := range roots {
+			if err := box.Chown(ctx, containerID, boxUser, true, path.Join(dst.Path, root)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := os.Lstat(srcPath); err != nil {
+		return fmt.Errorf("源路径不可访问: %w", err)
+	}
+
+	// 目标是已存在的目录时复制到目录内，否则按目标路径重命名
+	dstDir := dst.Path
+	rootName := filepath.Base(srcPath)
+	stat, exists, err := box.StatPath(ctx, containerID, dst.Path)
+	if err != nil {
+		return err
+	}
+	if !exists || !stat.Mode.IsDir() {
+		if strings.HasSuffix(dst.Path, "/") {
+			return fmt.Errorf("box 中的目标目录 %s 不存在", dst.Path)
+		}
+		dstDir = path.Dir(dst.Path)
+		rootName = path.Base(dst.Path)
+		if _, parentExists, err := box.StatPath(ctx, containerID, dstDir); err != nil {
+			return err
+		} else if !parentExists {
+			return fmt.Errorf("box 中的目标目录 %s 不存在", dstDir)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tools.TarPath(pw, srcPath, rootName, nil, onProgress))
+	}()
+
+	if err := box.CopyTo(ctx, containerID, dstDir, pr); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	return box.Chown(ctx, containerID, boxUser, true, path.Join(dstDir, rootName))
+}
+
+// copyFromBox 将 box 中的文件复制到主机，或以 tar 流写到 stdout
+func (s *BoxService) copyFromBox(ctx context.Context, src copyEndpoint, dstPath string, onProgress tools.TarProgress) error {
+	containerID := constant.VboxContainerPrefix + src.Box
+
+	content, stat, err := box.CopyFrom(ctx, containerID, src.Path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if dstPath == "-" {
+		if _, err := io.Copy(os.Stdout, content); err != nil {
+			return fmt.Errorf("写出 tar 流失败: %w", err)
+		}
+		return nil
+	}
+
+	// 目标是已存在的目录时复制到目录内，否则按目标路径重命名
+	if info, err := os.Stat(dstPath); err == nil && info.IsDir() {
+		return tools.ExtractTar(content, dstPath, stat.Name, "", onProgress)
+	}
+	if strings.HasSuffix(dstPath, string(filepath.Separator)) {
+		return fmt.Errorf("目标目录 %s 不存在", dstPath)
+	}
+	dstDir := filepath.Dir(dstPath)
+	if info, err := os.Stat(dstDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("目标目录 %s 不存在", dstDir)
+	}
+	return tools.ExtractTar(content, dstDir, stat.Name, filepath.Base(dstPath), onProgress)
+}
+
+// copyProgress 在 stderr 上显示复制进度，避免干扰 stdout 中的 tar 流
+type copyProgress struct {
+	formatSize func(int64) string
+	quiet      bool
+	last       time.Time
+	files      int
+	bytes      int64
+	shown      bool
+}
+
+func (s *BoxService) newCopyProgress(quiet bool) *copyProgress {
+	return &copyProgress{
+		formatSize: s.imageService.formatSize,
+		quiet:      quiet,
+	}
+}
+
+// Update 记录进度，最多每 200ms 刷新一次
+func (p *copyProgress) Update(files int, bytes int64) {
+	p.files, p.bytes = files, bytes
+	if p.quiet || time.Since(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	p.shown = true
+	fmt.Fprintf(os.Stderr, "\r已复制 %d 个文件，%s", p.files, p.formatSize(p.bytes))
+}
+
+// Done 输出最终进度
+func (p *copyProgress) Done() {
+	if p.quiet || !p.shown {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r已复制 %d 个文件，%s\n", p.files, p.formatSize(p.bytes))
+}
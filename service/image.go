@@ -2,21 +2,49 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/123cdxcc/vbox/box"
 	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
 	"github.com/123cdxcc/vbox/image"
+	"github.com/123cdxcc/vbox/pkg/tools"
 )
 
 // ImageBuildParams 包含构建镜像的参数
 type ImageBuildParams struct {
-	EnvName string
-	Version string
+	Spec  image.Spec // 要安装的环境，按顺序执行各自的脚本
+	User  string     // box 用户名，为空时使用主机用户名
+	Shell string     // 登录 shell (bash|zsh|fish)，为空时使用 bash
+	Home  string     // 用户目录，为空时使用 /home/<user>
+	Base  string     // 基础镜像，如 alpine、ubuntu:22.04，为空时使用 debian
+
+	BuildArgs map[string]string // 额外的构建参数
+	Labels    map[string]string // 额外的镜像标签，不能使用 vbox. 前缀
+	NoCache   bool              // 不使用构建缓存
+	Pull      bool              // 总是拉取基础镜像的最新版本
+	Platform  string            // 目标平台，如 linux/arm64，为空时使用 Docker 守护进程的平台
+	BuildKit  bool              // 使用 BuildKit 构建，不可用时退回经典构建器
+	Secrets   []string          // BuildKit 构建密钥，格式: id=...,src=... 或 id=...,env=...
+
+	Output io.Writer // 构建信息和构建输出，为空时使用标准输出并在终端中显示进度
 }
 
 // ImageListParams 包含列出镜像的参数
@@ -24,6 +52,18 @@ type ImageListParams struct {
 	// 目前不需要额外参数，预留结构体
 }
 
+// ImageBuildLogParams 包含查看构建日志的参数
+type ImageBuildLogParams struct {
+	Image string // 环境描述，如 golang:1.25.0，为空时列出所有构建日志
+	Base  string // 基础镜像，为空时使用 debian
+	List  bool   // 列出该镜像的所有构建日志而不是显示最近一次
+}
+
+// ImageOutdatedParams 包含检查过时镜像的参数
+type ImageOutdatedParams struct {
+	All bool // 同时列出最新的镜像和 box
+}
+
 // ImageRmiParams 包含删除镜像的参数
 type ImageRmiParams struct {
 	ImageID string
@@ -38,77 +78,621 @@ func NewImageService() *ImageService {
 	return &ImageService{}
 }
 
-// BuildImage 从 Dockerfile 构建镜像
-func (s *ImageService) BuildImage(ctx context.Context, params ImageBuildParams) error {
-	setupEnvScriptPath := filepath.Join(config.GlobalConfig.TemplatesDirPath, "template", params.EnvName, params.Version+".sh")
-	dockerfilePath := filepath.Join(config.GlobalConfig.TemplatesDirPath, "Dockerfile")
-	setupScriptPath := filepath.Join(config.GlobalConfig.TemplatesDirPath, "setup.sh")
+// validUserName 匹配可用于 useradd 的用户名
+var validUserName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// defaultBoxUser 返回默认的 box 用户名：主机用户名可用时使用主机用户名，否则使用 devbox
+func defaultBoxUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return constant.VboxUser
+	}
+	// Windows 上用户名形如 DOMAIN\name
+	name := strings.ToLower(current.Username)
+	if i := strings.LastIndexAny(name, `\/`); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "root" || !validUserName.MatchString(name) {
+		return constant.VboxUser
+	}
+	return name
+}
+
+// resolveBoxUser 补全并校验 box 用户参数
+func (s *ImageService) resolveBoxUser(params *ImageBuildParams) error {
+	if params.User == "" {
+		params.User = defaultBoxUser()
+	}
+	if params.User == "root" || !validUserName.MatchString(params.User) {
+		return fmt.Errorf("无效的用户名: %s", params.User)
+	}
 
-	if _, err := os.Stat(setupEnvScriptPath); os.IsNotExist(err) {
-		return fmt.Errorf("环境脚本不存在: %s", setupEnvScriptPath)
+	if params.Shell == "" {
+		params.Shell = constant.DefaultUserShell
+	}
+	switch params.Shell {
+	case "bash", "zsh", "fish":
+	default:
+		return fmt.Errorf("不支持的 shell: %s，可选 bash、zsh、fish", params.Shell)
+	}
+
+	if params.Home == "" {
+		params.Home = path.Join("/home", params.User)
+	}
+	if !path.IsAbs(params.Home) {
+		return fmt.Errorf("用户目录必须是绝对路径: %s", params.Home)
+	}
+	return nil
+}
+
+// BuildImage 从 Dockerfile 构建镜像，构建输出实时打印，返回镜像 ID、各步骤用时和警告
+// 同一个镜像正在由另一个构建构建时等待其完成，模板没有变化时不再构建，返回的结果中没有镜像 ID
+func (s *ImageService) BuildImage(ctx context.Context, params ImageBuildParams) (*image.BuildResult, error) {
+	out := params.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	if err := s.resolveBoxUser(&params); err != nil {
+		return nil, err
+	}
+
+	if len(params.Spec) == 0 {
+		return nil, fmt.Errorf("未指定要构建的环境")
+	}
+
+	base, err := template.ParseBase(params.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, manifests, err := s.resolveSpec(ctx, params.Spec, base)
+	if err != nil {
+		return nil, err
+	}
+	if spec.String() != params.Spec.String() {
+		fmt.Fprintf(out, "%s 解析为 %s\n", params.Spec, spec)
+	}
+	params.Spec = spec
+
+	dockerfilePath, setupScriptPath := templateFiles()
+	scripts, err := resolveScripts(spec)
+	if err != nil {
+		return nil, err
 	}
 
 	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
-		return fmt.Errorf("Dockerfile 不存在: %s", dockerfilePath)
+		return nil, fmt.Errorf("Dockerfile 不存在: %s", dockerfilePath)
 	}
 
 	if _, err := os.Stat(setupScriptPath); os.IsNotExist(err) {
-		return fmt.Errorf("启动脚本不存在: %s", setupScriptPath)
+		return nil, fmt.Errorf("启动脚本不存在: %s", setupScriptPath)
+	}
+	hash, err := templateHashOf(dockerfilePath, setupScriptPath, spec, base, scripts)
+	if err != nil {
+		return nil, err
 	}
 
-	absSetupEnvScriptPath, err := filepath.Abs(setupEnvScriptPath)
+	// 目标架构来自 --platform，否则使用 Docker 守护进程的架构
+	var arch string
+	if params.Platform != "" {
+		arch, err = image.PlatformArch(params.Platform)
+	} else {
+		arch, err = image.ServerArch(ctx)
+	}
 	if err != nil {
-		return fmt.Errorf("无法获取绝对路径: %v", err)
+		return nil, err
+	}
+
+	for key := range params.Labels {
+		if strings.HasPrefix(key, constant.VboxCommonPrefix+".") {
+			return nil, fmt.Errorf("标签 %s 由 vbox 使用，不能通过 --label 指定", key)
+		}
+	}
+	if err := checkBuildArgs(params.BuildArgs); err != nil {
+		return nil, err
+	}
+	buildArgs := make(map[string]*string, len(params.BuildArgs))
+	for key, value := range params.BuildArgs {
+		buildArgs[key] = &value
 	}
 
 	absSetupScriptPath, err := filepath.Abs(setupScriptPath)
 	if err != nil {
-		return fmt.Errorf("无法获取绝对路径: %v", err)
+		return nil, fmt.Errorf("无法获取绝对路径: %v", err)
 	}
 
+	absDockerfilePath, err := filepath.Abs(dockerfilePath)
 	if err != nil {
-		return fmt.Errorf("无法获取绝对路径: %v", err)
+		return nil, fmt.Errorf("无法获取绝对路径: %v", err)
 	}
 
-	absDockerfilePath, err := filepath.Abs(dockerfilePath)
+	// 构建密钥只能通过 BuildKit 传入，BuildKit 不可用时其余情况退回经典构建器
+	secrets := make([]image.Secret, 0, len(params.Secrets))
+	secretIDs := make([]string, 0, len(params.Secrets))
+	for _, value := range params.Secrets {
+		secret, err := image.ParseSecret(value)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+		secretIDs = append(secretIDs, secret.ID)
+	}
+	buildkit := params.BuildKit || len(secrets) > 0 || os.Getenv(constant.EnvBuildKit) == "1"
+	if buildkit {
+		if err := image.BuildKitAvailable(ctx); err != nil {
+			if len(secrets) > 0 {
+				return nil, fmt.Errorf("构建密钥需要 BuildKit: %v", err)
+			}
+			fmt.Fprintf(out, "BuildKit 不可用，使用经典构建器: %v\n", err)
+			buildkit = false
+		}
+	}
+
+	// Dockerfile 是模板，按基础镜像选择软件包的安装方式，BuildKit 构建时挂载软件包缓存
+	dockerfile, err := template.RenderDockerfile(absDockerfilePath, template.DockerfileData{
+		Base:     base,
+		BuildKit: buildkit,
+		Secrets:  secretIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tag := params.Spec.BaseTag(base.ID())
+	// 同一个镜像同时只有一个构建，包括其他 vbox 进程中的构建
+	unlock, waited, err := image.LockBuild(ctx, config.GlobalConfig.LocksDirPath, tag, func(pid int) {
+		fmt.Fprintf(out, "镜像 %s 正在由另一个构建 (进程 %d) 构建，等待其完成...\n", tag, pid)
+	})
 	if err != nil {
-		return fmt.Errorf("无法获取绝对路径: %v", err)
+		return nil, err
+	}
+	defer unlock()
+	if waited && !params.NoCache {
+		// 另一个构建已经用当前模板构建了该镜像
+		labels, err := tools.ImageLabels(ctx, config.GlobalConfig.GetDockerClient(), tag)
+		if err == nil && labels[constant.LabelTemplateHash] == hash {
+			fmt.Fprintf(out, "镜像 %s 已由另一个构建完成\n", tag)
+			return &image.BuildResult{Tag: tag}, nil
+		}
+	}
+
+	// 不同架构的镜像使用同一个标签，覆盖后 vbox run 会启动另一个架构的镜像
+	existingArch, err := tools.ImageArch(ctx, config.GlobalConfig.GetDockerClient(), tag)
+	if err != nil {
+		return nil, fmt.Errorf("检查镜像失败: %v", err)
+	}
+	if err := checkImageArch(tag, existingArch, arch); err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("开始构建镜像: %s:%s\n", params.EnvName, params.Version)
-	fmt.Printf("使用 Dockerfile: %s\n", absDockerfilePath)
-	fmt.Printf("使用启动脚本: %s\n", absSetupScriptPath)
-	fmt.Printf("使用环境脚本: %s\n", absSetupEnvScriptPath)
+	fmt.Fprintf(out, "开始构建镜像: %s (%s)\n", params.Spec, tag)
+	fmt.Fprintf(out, "使用 Dockerfile: %s (基础镜像: %s)\n", absDockerfilePath, base)
+	fmt.Fprintf(out, "使用启动脚本: %s\n", absSetupScriptPath)
+
+	envScripts := make([]image.EnvScript, 0, len(scripts))
+	var ports []string
+	for i, script := range scripts {
+		envScript := image.EnvScript{Name: script.Name, Version: script.Version}
+		if m := manifests[i]; m != nil {
+			envScript.Packages = m.Packages.For(base.Family)
+			envScript.Env = m.Env
+			for _, port := range m.Ports {
+				ports = append(ports, strconv.Itoa(port))
+			}
+			// 声明的文件在主机上下载并校验，缓存后重新构建不需要联网
+			for _, artifact := range m.Artifacts {
+				resolved, err := artifact.Resolve(script.Version, arch)
+				if artifact.Optional && errors.Is(err, template.ErrNoChecksum) {
+					fmt.Fprintf(out, "%s:%s (%s) 没有声明 %s 的校验和，由环境脚本下载\n", script.Name, script.Version, arch, artifact.Name)
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				artifactPath, err := template.FetchArtifact(ctx, config.GlobalConfig.CacheDirPath, resolved, out)
+				if err != nil {
+					return nil, err
+				}
+				if envScript.Artifacts == nil {
+					envScript.Artifacts = make(map[string]string, len(m.Artifacts))
+				}
+				envScript.Artifacts[artifact.Name] = artifactPath
+			}
+		}
+
+		// 脚本模板先在主机上渲染
+		if script.Template {
+			envScript.Data, err = template.Render(script.Path, template.ScriptData{
+				Name:    script.Name,
+				Version: script.Version,
+				Arch:    arch,
+				User:    params.User,
+				Shell:   params.Shell,
+				Home:    params.Home,
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else if envScript.Path, err = filepath.Abs(script.Path); err != nil {
+			return nil, fmt.Errorf("无法获取绝对路径: %v", err)
+		}
+		// 模板目录中的配置文件、辅助脚本等整个放入构建上下文
+		if envScript.Dir, err = filepath.Abs(filepath.Dir(script.Path)); err != nil {
+			return nil, fmt.Errorf("无法获取绝对路径: %v", err)
+		}
+		if envScript.Ignore, err = templateDirIgnore(envScript.Dir); err != nil {
+			return nil, err
+		}
 
-	respCh, err := image.Build(ctx, image.BuildOptions{
-		Name:           params.EnvName,
-		Version:        params.Version,
+		if script.Generic {
+			fmt.Fprintf(out, "使用通用环境脚本: %s [%s] (VERSION=%s, ARCH=%s)\n", script.Path, script.Layer, script.Version, arch)
+		} else {
+			fmt.Fprintf(out, "使用环境脚本: %s [%s]\n", envScript.Path, script.Layer)
+		}
+		envScripts = append(envScripts, envScript)
+	}
+	fmt.Fprintf(out, "box 用户: %s (shell: %s, 用户目录: %s)\n", params.User, params.Shell, params.Home)
+	if params.Platform != "" {
+		fmt.Fprintf(out, "目标平台: %s\n", params.Platform)
+	}
+	if buildkit {
+		fmt.Fprintf(out, "使用 BuildKit 构建\n")
+	}
+
+	labels := portsLabel(ports)
+	maps.Copy(labels, params.Labels)
+	labels[constant.LabelTemplateHash] = hash
+	if err := recordBuildOptions(labels, params); err != nil {
+		return nil, err
+	}
+
+	// 构建输出同时保存到日志文件，可以用 vbox image build-log 查看
+	logFile, err := image.CreateBuildLog(config.GlobalConfig.BuildLogsDirPath, tag, constant.DefaultBuildLogKeep)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	fmt.Fprintf(logFile, "# %s (%s)，基础镜像: %s，开始于 %s\n", params.Spec, tag, base, time.Now().Format(time.DateTime))
+	// 指定了输出时（如并行构建）逐行输出，不显示终端进度
+	progress := &buildProgress{out: out}
+	if params.Output == nil {
+		progress = newBuildProgress(os.Stdout)
+	}
+
+	result, err := image.Build(ctx, image.BuildOptions{
+		Name:           params.Spec.ImageName(),
+		Version:        params.Spec.BaseVersion(base.ID()),
 		Dockerfile:     absDockerfilePath,
+		DockerfileData: dockerfile,
+		Base:           base.Image,
 		SetupScript:    absSetupScriptPath,
-		SetupEnvScript: absSetupEnvScriptPath,
+		EnvScripts:     envScripts,
+		Spec:           params.Spec.String(),
+		Labels:         labels,
+		Remove:         true,
+		NoCache:        params.NoCache,
+		Pull:           params.Pull,
+		Platform:       params.Platform,
+		BuildArgs:      buildArgs,
+		User:           params.User,
+		Shell:          params.Shell,
+		Home:           params.Home,
+		Arch:           arch,
+		Output:         io.MultiWriter(progress, logFile),
+		BuildKit:       buildkit,
+		Secrets:        secrets,
 	})
+	progress.Close(err)
 	if err != nil {
-		return fmt.Errorf("构建失败: %v", err)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("构建已取消: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("构建失败: %w，完整日志: %s", err, logFile.Name())
 	}
 
-	// 处理构建响应
-	for resp := range respCh {
-		if resp.Error != nil {
-			return fmt.Errorf("构建错误: %s", *resp.Error)
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(out, "⚠ %s\n", warning)
+	}
+	fmt.Fprintf(out, "\n镜像构建完成: %s (%s)\n", params.Spec, tag)
+	fmt.Fprintf(out, "镜像 ID: %s，用时 %s，共 %d 步 (%d 步使用缓存)\n",
+		result.ImageID, result.Duration.Round(time.Millisecond), len(result.Steps), result.CachedSteps())
+	fmt.Fprintf(out, "构建日志: %s\n", logFile.Name())
+	return result, nil
+}
+
+// templateLayers 返回按优先级排序的模板层：本地修改 > 外部来源 > 内置模板
+func templateLayers() ([]template.Layer, error) {
+	layers, err := template.Layers(config.GlobalConfig.TemplatesDirPath, config.GlobalConfig.SourcesDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取模板来源失败: %v", err)
+	}
+	return layers, nil
+}
+
+// templateFiles 返回模板目录中的 Dockerfile 和启动脚本
+func templateFiles() (dockerfilePath, setupScriptPath string) {
+	return filepath.Join(config.GlobalConfig.TemplatesDirPath, "Dockerfile"),
+		filepath.Join(config.GlobalConfig.TemplatesDirPath, "setup.sh")
+}
+
+// resolveScripts 按模板层的优先级为每个环境查找脚本，优先使用 <version>.sh，否则使用环境的通用脚本
+func resolveScripts(spec image.Spec) ([]template.Script, error) {
+	layers, err := templateLayers()
+	if err != nil {
+		return nil, err
+	}
+	scripts := make([]template.Script, 0, len(spec))
+	for _, ref := range spec {
+		script, err := template.ResolveScript(layers, ref.Name, ref.Version)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+// templateHash 返回用当前模板构建 spec 时的模板哈希，spec 中的版本需要已经解析
+func templateHash(spec image.Spec, base template.Base) (string, error) {
+	scripts, err := resolveScripts(spec)
+	if err != nil {
+		return "", err
+	}
+	dockerfilePath, setupScriptPath := templateFiles()
+	return templateHashOf(dockerfilePath, setupScriptPath, spec, base, scripts)
+}
+
+// templateHashOf 计算 Dockerfile、启动脚本、使用的环境脚本及模板目录（按 templateDirIgnore 过滤）的哈希
+// 只包含构建 spec 实际使用的内容，修改同一模板中其他版本的脚本不会使镜像过时
+// 下载文件由 template.yaml 中的地址和校验和确定，已经包含在模板目录中
+// 内容与构建上下文一样按固定顺序打包，修改时间不影响哈希
+func templateHashOf(dockerfilePath, setupScriptPath string, spec image.Spec, base template.Base, scripts []template.Script) (string, error) {
+	files := []tools.ContextFile{{Name: "spec", Data: []byte(spec.String() + "\n" + base.Image + "\n")}}
+	for i, script := range scripts {
+		name := fmt.Sprintf("envs/%02d-%s", i+1, script.Name)
+		dir := filepath.Dir(script.Path)
+		ignore, err := templateDirIgnore(dir)
+		if err != nil {
+			return "", err
 		}
-		if resp.ErrorDetail.Message != "" {
-			return fmt.Errorf("构建错误: %s", resp.ErrorDetail.Message)
+		files = append(files,
+			tools.ContextFile{Name: name + ".sh", Path: script.Path},
+			tools.ContextFile{Name: name + ".d", Path: dir, Ignore: ignore},
+		)
+	}
+
+	r, err := tools.CreateBuildContext(dockerfilePath, setupScriptPath, files)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("计算模板哈希失败: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// templateDirIgnore 返回模板目录放入构建上下文时的过滤规则：.vboxignore 和目录中的环境脚本
+// 使用的脚本单独放在 NN-<name>.sh，其他版本的脚本不放入构建上下文，也不计入模板哈希
+func templateDirIgnore(dir string) (*tools.IgnoreMatcher, error) {
+	ignore, err := tools.LoadIgnoreFiles(dir, template.IgnoreFileName)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %w", filepath.Join(dir, template.IgnoreFileName), err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && template.IsScriptFile(file.Name()) {
+			ignore.Add("/" + file.Name())
 		}
-		if resp.Stream != "" {
-			// 去掉末尾的换行符
-			output := strings.TrimSuffix(resp.Stream, "\n")
-			if output != "" {
-				fmt.Print(output)
+	}
+	return ignore, nil
+}
+
+// resolveSpec 把各环境的版本别名、latest、部分版本和范围解析为具体版本，返回与 spec 一一对应的描述文件（可能为 nil）
+// 可选的版本来自 template.yaml 声明的 versions，没有声明时来自版本脚本和已经构建的镜像
+// 找不到环境模板时在已经构建的镜像中选择，普通版本原样保留；只考虑基于 base 构建的镜像
+func (s *ImageService) resolveSpec(ctx context.Context, spec image.Spec, base template.Base) (image.Spec, []*template.Manifest, error) {
+	layers, err := templateLayers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 已经构建的镜像版本只在需要时读取一次
+	var built map[string][]string
+	builtVersions := func(name string) ([]string, error) {
+		if built == nil {
+			images, err := image.List(ctx)
+			if err != nil {
+				return nil, err
+			}
+			built = make(map[string][]string)
+			for _, img := range images {
+				// 旧镜像没有基础镜像标签，ParseBase 返回默认基础镜像
+				if imgBase, err := template.ParseBase(img.Base); err != nil || imgBase.Image != base.Image {
+					continue
+				}
+				if imgSpec, err := image.ParseSpec(img.Spec); err == nil && !imgSpec.Composite() {
+					built[imgSpec[0].Name] = append(built[imgSpec[0].Name], imgSpec[0].Version)
+				}
 			}
 		}
+		return built[name], nil
 	}
 
-	fmt.Printf("\n镜像构建完成: %s:%s\n", params.EnvName, params.Version)
+	resolved := make(image.Spec, len(spec))
+	manifests := make([]*template.Manifest, len(spec))
+	for i, ref := range spec {
+		var m *template.Manifest
+		var available []string
+		if envDir, _, err := template.FindEnv(layers, ref.Name); err == nil {
+			if m, err = template.LoadManifest(envDir); err != nil {
+				return nil, nil, err
+			}
+			available = template.ScriptVersions(envDir)
+		}
+		if (m == nil || len(m.Versions) == 0) && !slices.Contains(available, ref.Version) {
+			versions, err := builtVersions(ref.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, version := range versions {
+				if !slices.Contains(available, version) {
+					available = append(available, version)
+				}
+			}
+		}
+		version, err := m.ResolveVersionIn(ref.Version, available)
+		if err != nil {
+			return nil, nil, fmt.Errorf("环境 %s: %w", ref.Name, err)
+		}
+		resolved[i] = image.EnvRef{Name: ref.Name, Version: version}
+		manifests[i] = m
+	}
+	return resolved, manifests, nil
+}
+
+// reservedBuildArgs 是 vbox 传给 Dockerfile 的构建参数和对应的选项，不能通过 --build-arg 覆盖
+var reservedBuildArgs = map[string]string{
+	constant.BuildArgUser:       "--user",
+	constant.BuildArgShell:      "--shell",
+	constant.BuildArgHome:       "--home",
+	constant.BuildArgTargetArch: "--platform",
+	constant.BuildArgArch:       "--platform",
+}
+
+// checkBuildArgs 检查 --build-arg 没有使用 vbox 设置的构建参数
+func checkBuildArgs(buildArgs map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(buildArgs)) {
+		if flag, ok := reservedBuildArgs[key]; ok {
+			return fmt.Errorf("构建参数 %s 由 vbox 设置，不能通过 --build-arg 指定，请使用 %s", key, flag)
+		}
+	}
+	return nil
+}
+
+// checkImageArch 检查构建不会用另一个架构的镜像覆盖已有的镜像，existing 为空表示镜像不存在
+func checkImageArch(tag, existing, target string) error {
+	if existing == "" || existing == target {
+		return nil
+	}
+	return fmt.Errorf("镜像 %s 已存在且架构为 %s，与目标架构 %s 不同，先用 vbox rmi 删除该镜像再构建", tag, existing, target)
+}
+
+// recordBuildOptions 把构建参数、额外标签和平台记录在镜像标签中，box 用户由 Dockerfile 记录
+func recordBuildOptions(labels map[string]string, params ImageBuildParams) error {
+	if len(params.BuildArgs) > 0 {
+		data, err := json.Marshal(params.BuildArgs)
+		if err != nil {
+			return err
+		}
+		labels[constant.LabelBuildArgs] = string(data)
+	}
+	if len(params.Labels) > 0 {
+		data, err := json.Marshal(slices.Sorted(maps.Keys(params.Labels)))
+		if err != nil {
+			return err
+		}
+		labels[constant.LabelLabels] = string(data)
+	}
+	if params.Platform != "" {
+		labels[constant.LabelPlatform] = params.Platform
+	}
+	return nil
+}
+
+// rebuildParams 根据已有镜像的标签还原构建时的 box 用户、构建参数、额外标签和平台，
+// 重新构建后替换同一个标签的镜像，使用该镜像的 box 不会因此换成另一个用户
+// 构建密钥无法还原，需要密钥的镜像要用 vbox image build 重新构建
+func rebuildParams(spec image.Spec, base string, labels map[string]string) (ImageBuildParams, error) {
+	user := box.UserFromLabels(labels)
+	params := ImageBuildParams{
+		Spec:     spec,
+		Base:     base,
+		User:     user.Name,
+		Shell:    user.Shell,
+		Home:     user.Home,
+		Platform: labels[constant.LabelPlatform],
+	}
+	if data := labels[constant.LabelBuildArgs]; data != "" {
+		if err := json.Unmarshal([]byte(data), &params.BuildArgs); err != nil {
+			return ImageBuildParams{}, fmt.Errorf("无法解析镜像标签 %s: %w", constant.LabelBuildArgs, err)
+		}
+	}
+	if data := labels[constant.LabelLabels]; data != "" {
+		var keys []string
+		if err := json.Unmarshal([]byte(data), &keys); err != nil {
+			return ImageBuildParams{}, fmt.Errorf("无法解析镜像标签 %s: %w", constant.LabelLabels, err)
+		}
+		params.Labels = make(map[string]string, len(keys))
+		for _, key := range keys {
+			params.Labels[key] = labels[key]
+		}
+	}
+	return params, nil
+}
+
+// portsLabel 生成记录环境常用端口的镜像标签
+func portsLabel(ports []string) map[string]string {
+	if len(ports) == 0 {
+		return make(map[string]string)
+	}
+	return map[string]string{constant.LabelPorts: strings.Join(ports, ",")}
+}
+
+// BuildLog 显示镜像最近一次的构建日志，没有指定镜像时列出所有构建日志
+func (s *ImageService) BuildLog(ctx context.Context, params ImageBuildLogParams) error {
+	var tag string
+	if params.Image != "" {
+		spec, err := image.ParseSpec(params.Image)
+		if err != nil {
+			return err
+		}
+		base, err := template.ParseBase(params.Base)
+		if err != nil {
+			return err
+		}
+		// 和构建时一样解析 latest、部分版本和范围
+		spec, _, err = s.resolveSpec(ctx, spec, base)
+		if err != nil {
+			return err
+		}
+		tag = spec.BaseTag(base.ID())
+	}
+
+	logs, err := image.BuildLogs(config.GlobalConfig.BuildLogsDirPath, tag)
+	if err != nil {
+		return err
+	}
+	if len(logs) == 0 {
+		if tag != "" {
+			return fmt.Errorf("没有 %s 的构建日志", tag)
+		}
+		fmt.Println("没有构建日志")
+		return nil
+	}
+
+	if tag == "" || params.List {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "IMAGE\tTIME\tPATH")
+		for _, log := range logs {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", log.Tag, log.Time.Format(time.DateTime), log.Path)
+		}
+		w.Flush()
+		return nil
+	}
+
+	file, err := os.Open(logs[0].Path)
+	if err != nil {
+		return fmt.Errorf("打开构建日志失败: %v", err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(os.Stdout, file); err != nil {
+		return fmt.Errorf("读取构建日志失败: %v", err)
+	}
 	return nil
 }
 
@@ -126,7 +710,7 @@ func (s *ImageService) ListImages(ctx context.Context, params ImageListParams) e
 
 	// 使用 tabwriter 格式化输出
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "NAME\tVERSION\tIMAGE ID\tSIZE\tCREATED")
+	fmt.Fprintln(w, "IMAGE\tBASE\tIMAGE ID\tSIZE\tCREATED")
 
 	for _, img := range images {
 		// 格式化大小
@@ -141,8 +725,14 @@ func (s *ImageService) ListImages(ctx context.Context, params ImageListParams) e
 			shortID = shortID[:12]
 		}
 
+		// 旧镜像没有基础镜像标签，都基于默认基础镜像
+		base, err := template.ParseBase(img.Base)
+		if err != nil {
+			base.Image = img.Base
+		}
+
 		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
-			img.Name, img.Version, shortID, sizeStr, createdStr)
+			img.Spec, base, shortID, sizeStr, createdStr)
 	}
 	w.Flush()
 	return nil
@@ -162,6 +752,124 @@ func (s *ImageService) formatSize(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
+// 镜像和 box 相对当前模板的状态
+const (
+	statusLatest   = "最新"
+	statusOutdated = "已过时"
+	statusUnknown  = "未知" // 旧版本 vbox 构建的镜像没有记录模板哈希，或者模板已不存在
+)
+
+// templateStatus 比较构建时记录的模板哈希和当前模板的哈希
+func templateStatus(hash string, current func() (string, error)) string {
+	if hash == "" {
+		return statusUnknown
+	}
+	currentHash, err := current()
+	if err != nil {
+		return statusUnknown
+	}
+	if hash != currentHash {
+		return statusOutdated
+	}
+	return statusLatest
+}
+
+// Outdated 列出模板修改后没有重新构建的镜像和使用旧模板创建的 box
+func (s *ImageService) Outdated(ctx context.Context, params ImageOutdatedParams) error {
+	images, err := image.List(ctx)
+	if err != nil {
+		return fmt.Errorf("获取镜像列表失败: %v", err)
+	}
+	boxes, err := box.List(ctx)
+	if err != nil {
+		return fmt.Errorf("获取 box 列表失败: %v", err)
+	}
+
+	// 同一个环境组合和基础镜像的模板哈希只计算一次
+	hashes := make(map[string]string)
+	current := func(specStr, baseStr string) func() (string, error) {
+		return func() (string, error) {
+			key := specStr + "@" + baseStr
+			if hash, ok := hashes[key]; ok {
+				return hash, nil
+			}
+			spec, err := image.ParseSpec(specStr)
+			if err != nil {
+				return "", err
+			}
+			// 旧镜像没有基础镜像标签，ParseBase 返回默认基础镜像
+			base, err := template.ParseBase(baseStr)
+			if err != nil {
+				return "", err
+			}
+			hash, err := templateHash(spec, base)
+			if err != nil {
+				return "", err
+			}
+			hashes[key] = hash
+			return hash, nil
+		}
+	}
+
+	var imageRows, boxRows []string
+	outdated := false
+	for _, img := range images {
+		status := templateStatus(img.Hash, current(img.Spec, img.Base))
+		outdated = outdated || status == statusOutdated
+		if status == statusLatest && !params.All {
+			continue
+		}
+		shortID := img.ID
+		if len(shortID) > 12 {
+			shortID = shortID[:12]
+		}
+		base, err := template.ParseBase(img.Base)
+		if err != nil {
+			base.Image = img.Base
+		}
+		imageRows = append(imageRows, fmt.Sprintf("%s\t%s\t%s\t%s", img.Spec, base, shortID, status))
+	}
+	for _, c := range boxes {
+		// box 标签继承自镜像，没有环境标签的不是 vbox 模板构建的
+		spec := c.Labels[constant.LabelSpec]
+		if spec == "" {
+			continue
+		}
+		status := templateStatus(c.Labels[constant.LabelTemplateHash], current(spec, c.Labels[constant.LabelBase]))
+		outdated = outdated || status == statusOutdated
+		if status == statusLatest && !params.All {
+			continue
+		}
+		boxRows = append(boxRows, fmt.Sprintf("%s\t%s\t%s\t%s", c.Name, spec, c.State, status))
+	}
+
+	if len(imageRows) == 0 && len(boxRows) == 0 {
+		fmt.Println("所有镜像和 box 都使用当前的模板")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	if len(imageRows) > 0 {
+		fmt.Fprintln(w, "IMAGE\tBASE\tIMAGE ID\tSTATUS")
+		for _, row := range imageRows {
+			fmt.Fprintln(w, row)
+		}
+	}
+	if len(boxRows) > 0 {
+		if len(imageRows) > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, "BOX\tIMAGE\tSTATE\tSTATUS")
+		for _, row := range boxRows {
+			fmt.Fprintln(w, row)
+		}
+	}
+	w.Flush()
+	if outdated {
+		fmt.Println("\n用 vbox image build 重新构建过时的镜像，box 需要用新镜像重新创建")
+	}
+	return nil
+}
+
 // RmiImage 删除指定的镜像
 func (s *ImageService) RmiImage(ctx context.Context, params ImageRmiParams) error {
 	fmt.Printf("正在删除镜像: %s\n", params.ImageID)
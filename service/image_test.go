@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+)
+
+// TestTemplateHash 测试模板哈希只随模板内容变化
+func TestTemplateHash(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+	dir := t.TempDir()
+	config.GlobalConfig.TemplatesDirPath = filepath.Join(dir, "env")
+	config.GlobalConfig.SourcesDirPath = filepath.Join(dir, "sources")
+	if err := template.Init(config.GlobalConfig.TemplatesDirPath); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := image.ParseSpec("golang:1.25.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := template.ParseBase("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := func() string {
+		t.Helper()
+		h, err := templateHash(spec, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	original := hash()
+	envDir := filepath.Join(config.GlobalConfig.TemplatesDirPath, "template", "golang")
+	script := filepath.Join(envDir, "1.25.0.sh")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(script, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if hash() != original {
+		t.Fatal("修改时间变化不应改变模板哈希")
+	}
+
+	// 被 .vboxignore 忽略的文件不影响哈希
+	if err := os.WriteFile(filepath.Join(envDir, template.IgnoreFileName), []byte("*.md\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ignored := hash()
+	if err := os.WriteFile(filepath.Join(envDir, "notes.md"), []byte("notes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash() != ignored {
+		t.Fatal("被忽略的文件不应改变模板哈希")
+	}
+
+	// 同一模板中其他版本的脚本和没有使用的通用脚本不影响哈希
+	if err := os.WriteFile(filepath.Join(envDir, "1.24.0.sh"), []byte("#!/bin/bash\necho 1.24.0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(envDir, template.GenericScriptName), []byte("#!/bin/bash\necho changed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if hash() != ignored {
+		t.Fatal("其他版本的脚本不应改变模板哈希")
+	}
+
+	// 模板目录中的其他文件和 template.yaml 会放入构建上下文
+	previous := ignored
+	for _, name := range []string{"files/gitconfig", template.ManifestFileName} {
+		p := filepath.Join(envDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("# changed\n")
+		f.Close()
+		if h := hash(); h == previous {
+			t.Fatalf("修改 %s 后模板哈希应改变", name)
+		} else {
+			previous = h
+		}
+	}
+
+	if err := os.WriteFile(script, []byte("#!/bin/bash\necho changed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if hash() == previous {
+		t.Fatal("修改环境脚本后模板哈希应改变")
+	}
+
+	alpine, err := template.ParseBase("alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := templateHash(spec, alpine); err != nil || h == hash() {
+		t.Fatalf("不同基础镜像的模板哈希应不同: %v", err)
+	}
+
+	// 状态比较
+	current := func() (string, error) { return "new", nil }
+	for hash, want := range map[string]string{"": statusUnknown, "old": statusOutdated, "new": statusLatest} {
+		if got := templateStatus(hash, current); got != want {
+			t.Errorf("templateStatus(%q) = %s，期望 %s", hash, got, want)
+		}
+	}
+}
+
+// TestResolveSpecUnlistedVersion 测试内置 golang 模板可以使用 versions 之外的发行版
+func TestResolveSpecUnlistedVersion(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+	dir := t.TempDir()
+	config.GlobalConfig.TemplatesDirPath = filepath.Join(dir, "env")
+	config.GlobalConfig.SourcesDirPath = filepath.Join(dir, "sources")
+	if err := template.Init(config.GlobalConfig.TemplatesDirPath); err != nil {
+		t.Fatal(err)
+	}
+	base, err := template.ParseBase("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewImageService()
+	spec, err := image.ParseSpec("golang:1.23.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, _, err := s.resolveSpec(context.Background(), spec, base)
+	if err != nil {
+		t.Fatalf("golang:1.23.4 应可以构建: %v", err)
+	}
+	if tag := resolved.BaseTag(base.ID()); tag != "vbox-golang:1.23.4" {
+		t.Fatalf("镜像标签为 %s，期望 vbox-golang:1.23.4", tag)
+	}
+	if _, err := templateHash(resolved, base); err != nil {
+		t.Fatalf("golang:1.23.4 应可以使用通用脚本: %v", err)
+	}
+
+	// 别名和范围仍然在 versions 中解析
+	spec, _ = image.ParseSpec("golang:~1.24.0")
+	if resolved, _, err = s.resolveSpec(context.Background(), spec, base); err != nil || resolved.String() != "golang:1.24.6" {
+		t.Fatalf("golang:~1.24.0 解析为 %v, %v", resolved, err)
+	}
+	spec, _ = image.ParseSpec("golang:nightly")
+	if _, _, err := s.resolveSpec(context.Background(), spec, base); err == nil {
+		t.Fatal("不匹配 version_pattern 的版本应返回错误")
+	}
+}
+
+// TestRebuildParams 测试构建选项记录在镜像标签后可以还原
+func TestRebuildParams(t *testing.T) {
+	spec, _ := image.ParseSpec("golang:1.25.0")
+	params := ImageBuildParams{
+		BuildArgs: map[string]string{"GOPROXY": "off", "EMPTY": ""},
+		Labels:    map[string]string{"team": "infra", "owner": "alice"},
+		Platform:  "linux/arm64",
+	}
+	labels := map[string]string{constant.LabelUser: "alice", "team": "infra", "owner": "alice"}
+	if err := recordBuildOptions(labels, params); err != nil {
+		t.Fatal(err)
+	}
+	got, err := rebuildParams(spec, "alpine", labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got.BuildArgs, params.BuildArgs) || !maps.Equal(got.Labels, params.Labels) || got.Platform != params.Platform {
+		t.Fatalf("还原的构建选项不符合预期: %+v", got)
+	}
+	if got.User != "alice" || got.Shell != constant.DefaultUserShell || got.Home != "/home/alice" || got.Base != "alpine" {
+		t.Fatalf("还原的用户不符合预期: %+v", got)
+	}
+
+	labels[constant.LabelBuildArgs] = "{"
+	if _, err := rebuildParams(spec, "", labels); err == nil {
+		t.Fatal("无效的标签应返回错误")
+	}
+}
+
+// TestCheckBuildOptions 测试 --build-arg 不能覆盖 vbox 的构建参数，不同架构的镜像不能互相覆盖
+func TestCheckBuildOptions(t *testing.T) {
+	if err := checkBuildArgs(map[string]string{"GOPROXY": "off"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"TARGETARCH", "ARCH", "VBOX_USER", "VBOX_SHELL", "VBOX_HOME"} {
+		if err := checkBuildArgs(map[string]string{key: "x"}); err == nil {
+			t.Errorf("--build-arg %s 应返回错误", key)
+		}
+	}
+
+	for _, tt := range []struct {
+		existing, target string
+		ok               bool
+	}{
+		{"", "arm64", true},
+		{"amd64", "amd64", true},
+		{"amd64", "arm64", false},
+	} {
+		if err := checkImageArch("vbox-golang:1.25.0", tt.existing, tt.target); (err == nil) != tt.ok {
+			t.Errorf("checkImageArch(%q, %q) = %v", tt.existing, tt.target, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/123cdxcc/vbox/image"
+	"golang.org/x/term"
+)
+
+// buildProgressTail 是终端中当前步骤下方显示的输出行数
+const buildProgressTail = 5
+
+var (
+	buildKitPrefix = regexp.MustCompile(`^#\d+ \d+\.\d+ `)
+	buildKitCached = regexp.MustCompile(`^#\d+ CACHED$`)
+)
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// buildProgress 作为 image.BuildOptions.Output 显示构建进度
+// 终端中只显示当前步骤、用时和最后几行输出，步骤结束后折叠为一行；否则逐行输出
+type buildProgress struct {
+	mu      sync.Mutex
+	out     io.Writer
+	tty     bool
+	width   int
+	partial string // 还没有换行的输出
+
+	step      string // 当前步骤，如 [2/9] RUN ssh-keygen -A
+	stepStart time.Time
+	cached    bool
+	tail      []string
+	drawn     int // 上次绘制占用的行数
+	frame     int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newBuildProgress(out *os.File) *buildProgress {
+	p := &buildProgress{out: out, tty: term.IsTerminal(int(out.Fd()))}
+	if !p.tty {
+		return p
+	}
+	p.width = 80
+	if width, _, err := term.GetSize(int(out.Fd())); err == nil && width > 0 {
+		p.width = width
+	}
+	// 没有新输出时也定时刷新用时，避免长时间的安装看起来像卡住了
+	p.stop, p.stopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				p.frame++
+				p.redraw()
+				p.mu.Unlock()
+			}
+		}
+	}()
+	return p
+}
+
+// Write 按行处理构建输出，不完整的行等到换行后再处理
+func (p *buildProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines := strings.Split(p.partial+string(b), "\n")
+	p.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		p.line(line)
+	}
+	if p.tty {
+		p.redraw()
+	}
+	return len(b), nil
+}
+
+func (p *buildProgress) line(line string) {
+	// 进度条用 \r 覆盖同一行，只保留最后的内容
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	if !p.tty {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+
+	if index, total, instruction, ok := image.ParseStep(line); ok {
+		// BuildKit 在同一步骤的输出被打断后会重复步骤行
+		if step := fmt.Sprintf("[%d/%d] %s", index, total, instruction); step != p.step {
+			p.finishStep("✓")
+			p.step = step
+			p.stepStart = time.Now()
+		}
+		return
+	}
+	// 去掉 BuildKit 输出行的步骤编号和时间前缀，如 #7 12.34
+	line = strings.TrimRight(buildKitPrefix.ReplaceAllString(line, ""), " \t")
+	if strings.TrimSpace(line) == "---> Using cache" || buildKitCached.MatchString(line) {
+		p.cached = true
+	}
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	p.tail = append(p.tail, line)
+	if len(p.tail) > buildProgressTail {
+		p.tail = p.tail[len(p.tail)-buildProgressTail:]
+	}
+}
+
+// finishStep 把当前步骤折叠为一行
+func (p *buildProgress) finishStep(mark string) {
+	p.clear()
+	if p.step != "" {
+		status := time.Since(p.stepStart).Round(100 * time.Millisecond).String()
+		if p.cached {
+			status = "缓存"
+		}
+		fmt.Fprintln(p.out, p.truncate(fmt.Sprintf("%s %s (%s)", mark, p.step, status)))
+	}
+	p.step, p.cached, p.tail = "", false, nil
+}
+
+// clear 清除上次绘制的内容
+func (p *buildProgress) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\r\x1b[%dA\x1b[J", p.drawn)
+		p.drawn = 0
+	}
+}
+
+// redraw 重新绘制当前步骤和最后几行输出
+func (p *buildProgress) redraw() {
+	p.clear()
+	if p.step == "" && len(p.tail) == 0 {
+		return
+	}
+	var b strings.Builder
+	if p.step != "" {
+		elapsed := time.Since(p.stepStart).Round(100 * time.Millisecond)
+		fmt.Fprintf(&b, "%s\n", p.truncate(fmt.Sprintf("%s %s (%s)", spinnerFrames[p.frame%len(spinnerFrames)], p.step, elapsed)))
+		p.drawn++
+	}
+	for _, line := range p.tail {
+		fmt.Fprintf(&b, "\x1b[2m%s\x1b[0m\n", p.truncate("    "+line))
+		p.drawn++
+	}
+	io.WriteString(p.out, b.String())
+}
+
+// truncate 截断超出终端宽度的行，避免自动换行后无法清除
+func (p *buildProgress) truncate(line string) string {
+	line = strings.ReplaceAll(line, "\t", "    ")
+	runes := []rune(line)
+	// 中文等宽字符占两列，按最坏情况计算
+	limit := p.width - 1
+	if strings.ContainsFunc(line, func(r rune) bool { return r > 0x2e80 }) {
+		limit = p.width/2 - 1
+	}
+	if limit > 0 && len(runes) > limit {
+		return string(runes[:limit-1]) + "…"
+	}
+	return line
+}
+
+// Close 结束进度显示，构建失败时保留当前步骤最后几行输出
+func (p *buildProgress) Close(err error) {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.stopped
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.partial != "" {
+		p.line(p.partial)
+		p.partial = ""
+	}
+	if !p.tty {
+		return
+	}
+	if err == nil {
+		p.finishStep("✓")
+		return
+	}
+	tail := p.tail
+	p.finishStep("✗")
+	for _, line := range tail {
+		fmt.Fprintf(p.out, "    %s\n", line)
+	}
+}
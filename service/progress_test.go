@@ -0,0 +1,34 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestBuildProgress 测试构建输出按行显示，终端中步骤完成后折叠为一行
+func TestBuildProgress(t *testing.T) {
+	var out strings.Builder
+	p := &buildProgress{out: &out}
+	for _, chunk := range []string{"Step 1/2 : FROM debian\n", "abc: Pulling", " fs layer\n", "Step 2/2 : RUN make\n", "done"} {
+		p.Write([]byte(chunk))
+	}
+	p.Close(nil)
+	if out.String() != "Step 1/2 : FROM debian\nabc: Pulling fs layer\nStep 2/2 : RUN make\ndone\n" {
+		t.Fatalf("非终端输出不符合预期:\n%q", out.String())
+	}
+
+	out.Reset()
+	p = &buildProgress{out: &out, tty: true, width: 80}
+	p.Write([]byte("Step 1/2 : FROM debian\n ---> Using cache\nStep 2/2 : RUN make\n"))
+	p.Write([]byte("cc -o app\r50%\r100%\nerror: failed\n"))
+	p.Close(errors.New("exit code 1"))
+	text := out.String()
+	if !strings.Contains(text, "✓ [1/2] FROM debian (缓存)\n") || !strings.Contains(text, "✗ [2/2] RUN make") {
+		t.Fatalf("步骤没有折叠:\n%q", text)
+	}
+	// 失败时保留当前步骤最后几行输出，\r 覆盖的内容只保留最后一次
+	if !strings.HasSuffix(text, "    100%\n    error: failed\n") {
+		t.Fatalf("失败时应保留最后几行输出:\n%q", text)
+	}
+}
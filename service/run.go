@@ -0,0 +1,399 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/123cdxcc/vbox/box"
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+	"github.com/123cdxcc/vbox/pkg/tools"
+)
+
+// runBackend 是 vbox run 中会修改系统状态的操作，测试中可以替换
+type runBackend interface {
+	ResolveSpec(ctx context.Context, spec image.Spec, base template.Base) (image.Spec, error)
+	ImageExists(ctx context.Context, tag string) (bool, error)
+	BuildImage(ctx context.Context, params ImageBuildParams) (string, error) // 返回镜像 ID
+	RemoveImage(ctx context.Context, imageID string) error
+	ImageLabels(ctx context.Context, tag string) (map[string]string, error)
+	TemplateHash(spec image.Spec, base template.Base) (string, error)
+	WriteSSHKeys(name, privateKey, publicKey string) (string, error) // 返回公钥文件路径
+	CreateBox(ctx context.Context, opt box.CreateOption) (*box.Container, error)
+	RemoveBox(ctx context.Context, containerID string) error
+	WaitReady(ctx context.Context, containerID string) error
+	UpdateSSHHost(name, host, user, port, proxyCommand string) error
+}
+
+// dockerRunBackend 通过 Docker 和本地 SSH 配置实现 runBackend
+type dockerRunBackend struct {
+	imageService *ImageService
+}
+
+func (b *dockerRunBackend) ResolveSpec(ctx context.Context, spec image.Spec, base template.Base) (image.Spec, error) {
+	spec, _, err := b.imageService.resolveSpec(ctx, spec, base)
+	return spec, err
+}
+
+func (b *dockerRunBackend) ImageExists(ctx context.Context, tag string) (bool, error) {
+	return tools.ImageExists(ctx, config.GlobalConfig.GetDockerClient(), tag)
+}
+
+func (b *dockerRunBackend) BuildImage(ctx context.Context, params ImageBuildParams) (string, error) {
+	result, err := b.imageService.BuildImage(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return result.ImageID, nil
+}
+
+func (b *dockerRunBackend) RemoveImage(ctx context.Context, imageID string) error {
+	return image.Delete(ctx, imageID, false)
+}
+
+func (b *dockerRunBackend) ImageLabels(ctx context.Context, tag string) (map[string]string, error) {
+	return tools.ImageLabels(ctx, config.GlobalConfig.GetDockerClient(), tag)
+}
+
+func (b *dockerRunBackend) TemplateHash(spec image.Spec, base template.Base) (string, error) {
+	return templateHash(spec, base)
+}
+
+func (b *dockerRunBackend) WriteSSHKeys(name, privateKey, publicKey string) (string, error) {
+	return config.WriteSSHKeys(name, privateKey, publicKey)
+}
+
+func (b *dockerRunBackend) CreateBox(ctx context.Context, opt box.CreateOption) (*box.Container, error) {
+	return box.Create(ctx, opt)
+}
+
+func (b *dockerRunBackend) RemoveBox(ctx context.Context, containerID string) error {
+	return box.Delete(ctx, containerID, true)
+}
+
+func (b *dockerRunBackend) WaitReady(ctx context.Context, containerID string) error {
+	return box.WaitSSHReady(ctx, containerID, constant.DefaultSSHWaitTimeout*time.Second)
+}
+
+func (b *dockerRunBackend) UpdateSSHHost(name, host, user, port, proxyCommand string) error {
+	return config.UpdateSSHHost(name, host, user, port, proxyCommand)
+}
+
+// needRebuild 按 --rebuild 策略判断已有镜像是否需要重新构建，镜像不存在时总是需要构建
+// 镜像记录的模板哈希与当前模板不同时镜像已过时，auto 重新构建，never 只给出警告
+func (s *BoxService) needRebuild(ctx context.Context, policy string, exists bool, tag string, spec image.Spec, base template.Base) (bool, error) {
+	switch policy {
+	case "", constant.RebuildAuto, constant.RebuildAlways, constant.RebuildNever:
+	default:
+		return false, fmt.Errorf("不支持的重新构建策略: %s，可选 auto、always、never", policy)
+	}
+	if !exists {
+		if policy == constant.RebuildNever {
+			return false, fmt.Errorf("镜像 %s 不存在，--rebuild=never 时不会自动构建", tag)
+		}
+		return false, nil
+	}
+	if policy == constant.RebuildAlways {
+		return true, nil
+	}
+
+	labels, err := s.backend.ImageLabels(ctx, tag)
+	if err != nil {
+		return false, fmt.Errorf("获取镜像信息失败: %w", err)
+	}
+	// 旧镜像没有模板哈希，找不到模板时也无法比较，都按最新处理
+	built := labels[constant.LabelTemplateHash]
+	if built == "" {
+		return false, nil
+	}
+	current, err := s.backend.TemplateHash(spec, base)
+	if err != nil || current == built {
+		return false, nil
+	}
+	if policy == constant.RebuildNever {
+		slog.WarnContext(ctx, fmt.Sprintf("镜像 %s 构建后模板已修改，使用 --rebuild=auto 重新构建", tag))
+		return false, nil
+	}
+	slog.WarnContext(ctx, fmt.Sprintf("镜像 %s 构建后模板已修改，正在重新构建", tag))
+	return true, nil
+}
+
+// runStep 是 vbox run 中的一个步骤
+// do 失败时同样会调用 undo，undo 需要能撤销部分完成的修改，没有修改时什么也不做
+type runStep struct {
+	name string
+	do   func(ctx context.Context) error
+	undo func(ctx context.Context) error
+}
+
+// runSteps 按顺序执行步骤，某一步失败或被取消时按相反顺序撤销该步骤及之前的所有步骤
+func runSteps(ctx context.Context, steps []runStep) error {
+	for i, step := range steps {
+		err := ctx.Err()
+		if err != nil {
+			err = fmt.Errorf("运行已取消: %w", err)
+		} else if err = step.do(ctx); err == nil {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			slog.WarnContext(ctx, "运行已取消，正在清理...")
+		}
+		// 即使 ctx 已取消也要完成清理
+		cleanupCtx, cancel := box.CleanupContext(ctx)
+		defer cancel()
+		for j := i; j >= 0; j-- {
+			if steps[j].undo == nil {
+				continue
+			}
+			if uerr := steps[j].undo(cleanupCtx); uerr != nil {
+				slog.WarnContext(ctx, fmt.Sprintf("撤销步骤「%s」失败: %v", steps[j].name, uerr))
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Run 运行一个新的 box
+// 依次解析/构建镜像、生成密钥、创建并启动容器、等待就绪、写入 SSH 配置，
+// 任何一步失败或被取消（如 Ctrl+C）时撤销已经完成的步骤，恢复到运行前的状态
+func (s *BoxService) Run(ctx context.Context, params BoxRunParams) (*box.Container, error) {
+	var (
+		spec          image.Spec
+		base          template.Base
+		builtImageID  string // 本次运行构建的镜像，失败时删除
+		boxUser       box.User
+		publicKeyPath = params.PublicKey
+		restoreKeys   func() error
+		sshPort       int
+		boxContainer  *box.Container
+		restoreHost   func() error
+	)
+	// 使用 --public-key 时不生成密钥，也不写入 SSH 配置
+	generateKeys := params.PublicKey == ""
+	if err := params.Idle.Validate(); err != nil {
+		return nil, err
+	}
+	if params.SSHProxy && params.SSHPort != 0 {
+		return nil, fmt.Errorf("--ssh-proxy 不发布 SSH 端口，不能同时指定 --ssh-port")
+	}
+
+	steps := []runStep{
+		{
+			name: "解析和构建镜像",
+			do: func(ctx context.Context) error {
+				// 解析镜像，支持 golang:1.25.0+node:22 这样的组合镜像
+				requested, err := image.ParseSpec(params.Image)
+				if err != nil {
+					return err
+				}
+				base, err = template.ParseBase(params.Base)
+				if err != nil {
+					return err
+				}
+				// 解析版本别名、latest、部分版本和范围，如 golang:stable、golang:1.25
+				spec, err = s.backend.ResolveSpec(ctx, requested, base)
+				if err != nil {
+					return err
+				}
+				if spec.String() != params.Image {
+					slog.InfoContext(ctx, fmt.Sprintf("%s 解析为 %s", params.Image, spec))
+				}
+				imageFullName := spec.BaseTag(base.ID())
+
+				// 检查镜像是否存在
+				exists, err := s.backend.ImageExists(ctx, imageFullName)
+				if err != nil {
+					return fmt.Errorf("检查镜像失败: %w", err)
+				}
+				rebuild, err := s.needRebuild(ctx, params.Rebuild, exists, imageFullName, spec, base)
+				if err != nil {
+					return err
+				}
+				if !exists || rebuild {
+					// 镜像不存在或已过时，从模板构建
+					buildParams := ImageBuildParams{Spec: spec, Base: params.Base}
+					if exists {
+						// 使用原来的用户、构建参数等重新构建
+						labels, err := s.backend.ImageLabels(ctx, imageFullName)
+						if err != nil {
+							return fmt.Errorf("获取镜像信息失败: %w", err)
+						}
+						if buildParams, err = rebuildParams(spec, params.Base, labels); err != nil {
+							return err
+						}
+					}
+					imageID, err := s.backend.BuildImage(ctx, buildParams)
+					if err != nil {
+						if exists {
+							return fmt.Errorf("重新构建镜像 %s 失败: %w", imageFullName, err)
+						}
+						return fmt.Errorf("镜像 %s 不存在且无法从模板构建: %w", params.Image, err)
+					}
+					// 重新构建的镜像替换了原来的标签，失败时不删除，否则原来的镜像也无法使用
+					if !exists {
+						builtImageID = imageID
+					}
+				}
+
+				// box 用户由镜像标签决定
+				imageLabels, err := s.backend.ImageLabels(ctx, imageFullName)
+				if err != nil {
+					return fmt.Errorf("获取镜像信息失败: %w", err)
+				}
+				boxUser = box.UserFromLabels(imageLabels)
+				s.hintDeclaredPorts(ctx, imageLabels, params.Ports)
+				return nil
+			},
+			undo: func(ctx context.Context) error {
+				if builtImageID == "" {
+					return nil
+				}
+				return s.backend.RemoveImage(ctx, builtImageID)
+			},
+		},
+		{
+			name: "生成SSH密钥",
+			do: func(ctx context.Context) error {
+				if !generateKeys {
+					return nil
+				}
+				generatedPublicKey, generatedPrivateKey, err := config.GenSSHKeys()
+				if err != nil {
+					return fmt.Errorf("生成SSH密钥失败: %w", err)
+				}
+				// 记录原来的密钥文件，撤销时还原
+				restoreKeys, err = config.SnapshotSSHKeys(params.Name)
+				if err != nil {
+					return fmt.Errorf("读取SSH密钥失败: %w", err)
+				}
+				publicKeyPath, err = s.backend.WriteSSHKeys(params.Name, generatedPrivateKey, generatedPublicKey)
+				if err != nil {
+					return fmt.Errorf("保存SSH密钥失败: %w", err)
+				}
+				slog.InfoContext(ctx, fmt.Sprintf("为容器 %s 生成了新的SSH密钥", params.Name))
+				slog.InfoContext(ctx, "公钥路径", slog.Any("path", publicKeyPath))
+				return nil
+			},
+			undo: func(ctx context.Context) error {
+				if restoreKeys == nil {
+					return nil
+				}
+				return restoreKeys()
+			},
+		},
+		{
+			name: "创建容器",
+			do: func(ctx context.Context) error {
+				if params.Idle.Timeout > 0 && !params.SSHProxy {
+					slog.WarnContext(ctx, "空闲检测只统计经由 ssh-proxy 的会话，建议同时使用 --ssh-proxy")
+				}
+
+				// 处理SSH端口
+				sshPort = params.SSHPort
+				if params.SSHProxy {
+					// 通过 ProxyCommand 连接，不需要发布 SSH 端口
+					sshPort = 0
+				} else if sshPort == 0 {
+					// 随机生成端口
+					randomPort, err := s.generateRandomPort()
+					if err != nil {
+						return fmt.Errorf("生成随机SSH端口失败: %w", err)
+					}
+					sshPort = randomPort
+					slog.InfoContext(ctx, fmt.Sprintf("为容器 %s 随机分配SSH端口: %d", params.Name, sshPort))
+				}
+
+				// 映射主机用户，修复挂载目录的权限
+				env, err := s.resolveUserMapping(ctx, params)
+				if err != nil {
+					return err
+				}
+
+				// 记录解析后的环境和原始请求，以后可以按同样的版本重新构建
+				labels := params.Idle.Labels()
+				if labels == nil {
+					labels = make(map[string]string)
+				}
+				labels[constant.LabelSpec] = spec.String()
+				labels[constant.LabelRequest] = params.Image
+
+				// 创建并启动容器，创建后启动失败时 box.Create 会删除容器
+				boxContainer, err = s.backend.CreateBox(ctx, box.CreateOption{
+					Name:         params.Name,
+					ImageName:    spec.ImageName(),
+					ImageVersion: spec.BaseVersion(base.ID()),
+					Ports:        params.Ports,
+					SSHPort:      sshPort,
+					PublicKey:    publicKeyPath,
+					Volumes:      params.Volumes,
+					Detached:     params.Detached,
+					Labels:       labels,
+					Env:          env,
+					User:         boxUser,
+				})
+				return err
+			},
+			undo: func(ctx context.Context) error {
+				if boxContainer == nil {
+					return nil
+				}
+				return s.backend.RemoveBox(ctx, boxContainer.ID)
+			},
+		},
+		{
+			name: "等待就绪",
+			do: func(ctx context.Context) error {
+				if err := s.backend.WaitReady(ctx, boxContainer.ID); err != nil {
+					return fmt.Errorf("容器 %s 未能就绪: %w", params.Name, err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "写入SSH配置",
+			do: func(ctx context.Context) error {
+				if !generateKeys {
+					return nil
+				}
+				// 记录原来的 Host 配置，撤销时还原
+				var err error
+				restoreHost, err = config.SnapshotSSHHost(params.Name)
+				if err != nil {
+					return fmt.Errorf("读取SSH配置失败: %w", err)
+				}
+				if params.SSHProxy {
+					var proxyCommand string
+					proxyCommand, err = sshProxyCommand()
+					if err != nil {
+						return err
+					}
+					err = s.backend.UpdateSSHHost(params.Name, "", boxUser.Name, "", proxyCommand)
+				} else {
+					err = s.backend.UpdateSSHHost(params.Name, "localhost", boxUser.Name, fmt.Sprintf("%d", sshPort), "")
+				}
+				if err != nil {
+					return fmt.Errorf("保存SSH配置失败: %w", err)
+				}
+				slog.InfoContext(ctx, fmt.Sprintf("为容器 %s 保存了SSH配置", params.Name))
+				return nil
+			},
+			undo: func(ctx context.Context) error {
+				if restoreHost == nil {
+					return nil
+				}
+				return restoreHost()
+			},
+		},
+	}
+
+	if err := runSteps(ctx, steps); err != nil {
+		return nil, err
+	}
+	return boxContainer, nil
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/123cdxcc/vbox/box"
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+)
+
+// fakeRunBackend 在内存中记录镜像和容器，SSH 密钥和配置写入真实文件
+// failAt 为方法名，调用到该方法时返回错误，写文件的方法先写入再返回错误以模拟部分完成
+type fakeRunBackend struct {
+	failAt string
+	cancel context.CancelFunc // 非空时在 failAt 处取消 ctx 而不是直接返回错误
+	images map[string]bool
+	boxes  map[string]bool
+
+	hashes    map[string]string            // 镜像记录的模板哈希
+	labels    map[string]map[string]string // 镜像的其他标签
+	template  string                       // 当前模板的哈希
+	builds    int
+	lastBuild ImageBuildParams
+}
+
+func (b *fakeRunBackend) fail(method string) error {
+	if b.failAt != method {
+		return nil
+	}
+	if b.cancel != nil {
+		b.cancel()
+		return context.Canceled
+	}
+	return errors.New("注入的错误: " + method)
+}
+
+func (b *fakeRunBackend) ResolveSpec(ctx context.Context, spec image.Spec, base template.Base) (image.Spec, error) {
+	return spec, b.fail("ResolveSpec")
+}
+
+func (b *fakeRunBackend) ImageExists(ctx context.Context, tag string) (bool, error) {
+	return b.images[tag], b.fail("ImageExists")
+}
+
+func (b *fakeRunBackend) BuildImage(ctx context.Context, params ImageBuildParams) (string, error) {
+	if err := b.fail("BuildImage"); err != nil {
+		return "", err
+	}
+	tag := params.Spec.Tag()
+	b.images[tag] = true
+	if b.hashes != nil {
+		b.hashes[tag] = b.template
+	}
+	b.builds++
+	b.lastBuild = params
+	return tag, nil
+}
+
+func (b *fakeRunBackend) RemoveImage(ctx context.Context, imageID string) error {
+	delete(b.images, imageID)
+	return nil
+}
+
+func (b *fakeRunBackend) ImageLabels(ctx context.Context, tag string) (map[string]string, error) {
+	labels := map[string]string{constant.LabelUser: "vbox", constant.LabelTemplateHash: b.hashes[tag]}
+	maps.Copy(labels, b.labels[tag])
+	return labels, b.fail("ImageLabels")
+}
+
+func (b *fakeRunBackend) TemplateHash(spec image.Spec, base template.Base) (string, error) {
+	if b.template == "" {
+		return "", errors.New("模板不存在")
+	}
+	return b.template, nil
+}
+
+func (b *fakeRunBackend) WriteSSHKeys(name, privateKey, publicKey string) (string, error) {
+	path, err := config.WriteSSHKeys(name, privateKey, publicKey)
+	if err != nil {
+		return "", err
+	}
+	return path, b.fail("WriteSSHKeys")
+}
+
+func (b *fakeRunBackend) CreateBox(ctx context.Context, opt box.CreateOption) (*box.Container, error) {
+	if err := b.fail("CreateBox"); err != nil {
+		return nil, err
+	}
+	b.boxes[opt.Name] = true
+	return &box.Container{ID: opt.Name, Name: opt.Name}, nil
+}
+
+func (b *fakeRunBackend) RemoveBox(ctx context.Context, containerID string) error {
+	delete(b.boxes, containerID)
+	return nil
+}
+
+func (b *fakeRunBackend) WaitReady(ctx context.Context, containerID string) error {
+	return b.fail("WaitReady")
+}
+
+func (b *fakeRunBackend) UpdateSSHHost(name, host, user, port, proxyCommand string) error {
+	if err := config.UpdateSSHHost(name, host, user, port, proxyCommand); err != nil {
+		return err
+	}
+	return b.fail("UpdateSSHHost")
+}
+
+// readDir 读取目录中所有文件的内容
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+// TestRunRollback 测试 vbox run 任何一步失败或被取消时都恢复到运行前的状态
+func TestRunRollback(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+
+	// 已有同名的旧配置和另一个 box 的配置，失败后都应保持原样
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		config.GlobalConfig.AppSSHDirPath = dir
+		config.GlobalConfig.AppSSHConfigPath = filepath.Join(dir, "config")
+		for _, name := range []string{"demo", "other"} {
+			if _, err := config.WriteSSHKeys(name, "old-private-"+name, "old-public-"+name); err != nil {
+				t.Fatal(err)
+			}
+			if err := config.UpdateSSHHost(name, "localhost", "vbox", "2222", ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+	params := BoxRunParams{
+		Name:        "demo",
+		Image:       "golang:1.25.0",
+		UserMapping: constant.UserMappingNone,
+		SSHPort:     2222,
+	}
+
+	for _, failAt := range []string{"ResolveSpec", "ImageExists", "BuildImage", "ImageLabels", "WriteSSHKeys", "CreateBox", "WaitReady", "UpdateSSHHost"} {
+		for _, cancel := range []bool{false, true} {
+			dir := setup(t)
+			before := readDir(t, dir)
+
+			ctx, stop := context.WithCancel(context.Background())
+			backend := &fakeRunBackend{failAt: failAt, images: map[string]bool{}, boxes: map[string]bool{}}
+			if cancel {
+				backend.cancel = stop
+			}
+			s := &BoxService{backend: backend}
+			if _, err := s.Run(ctx, params); err == nil {
+				t.Fatalf("%s 失败时 Run 应返回错误", failAt)
+			}
+			stop()
+
+			if after := readDir(t, dir); len(after) != len(before) {
+				t.Fatalf("%s 失败后 SSH 目录中的文件不一致: %v", failAt, after)
+			} else {
+				for name, content := range before {
+					if after[name] != content {
+						t.Fatalf("%s 失败后 %s 未恢复:\n%s\n期望:\n%s", failAt, name, after[name], content)
+					}
+				}
+			}
+			if len(backend.images) != 0 || len(backend.boxes) != 0 {
+				t.Fatalf("%s 失败后仍有镜像 %v 或容器 %v", failAt, backend.images, backend.boxes)
+			}
+		}
+	}
+
+	// 镜像已存在时失败不应删除镜像
+	dir := setup(t)
+	backend := &fakeRunBackend{failAt: "WaitReady", images: map[string]bool{"vbox-golang:1.25.0": true}, boxes: map[string]bool{}}
+	if _, err := (&BoxService{backend: backend}).Run(context.Background(), params); err == nil || !backend.images["vbox-golang:1.25.0"] {
+		t.Fatalf("不应删除运行前已存在的镜像: %v", err)
+	}
+
+	// 全部成功时写入新的密钥和配置
+	backend = &fakeRunBackend{images: map[string]bool{}, boxes: map[string]bool{}}
+	container, err := (&BoxService{backend: backend}).Run(context.Background(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.ID != "demo" || !backend.boxes["demo"] || !backend.images["vbox-golang:1.25.0"] {
+		t.Fatalf("运行结果不符合预期: %+v", container)
+	}
+	if files := readDir(t, dir); files["demo"] == "old-private-demo" || files["other"] != "old-private-other" {
+		t.Fatalf("密钥文件不符合预期: %v", files)
+	}
+}
+
+// TestRunRebuild 测试 --rebuild 各策略下何时构建镜像
+func TestRunRebuild(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+	dir := t.TempDir()
+	config.GlobalConfig.AppSSHDirPath = dir
+	config.GlobalConfig.AppSSHConfigPath = filepath.Join(dir, "config")
+
+	const tag = "vbox-golang:1.25.0"
+	for _, tc := range []struct {
+		policy   string
+		exists   bool
+		hash     string // 镜像记录的模板哈希
+		template string // 当前模板的哈希，为空表示找不到模板
+		builds   int
+		fail     bool
+	}{
+		{policy: "", exists: false, builds: 1},
+		{policy: constant.RebuildAuto, exists: true, hash: "old", template: "new", builds: 1},
+		{policy: constant.RebuildAuto, exists: true, hash: "new", template: "new", builds: 0},
+		{policy: constant.RebuildAuto, exists: true, hash: "", template: "new", builds: 0},
+		{policy: constant.RebuildAuto, exists: true, hash: "old", template: "", builds: 0},
+		{policy: constant.RebuildAlways, exists: true, hash: "new", template: "new", builds: 1},
+		{policy: constant.RebuildNever, exists: true, hash: "old", template: "new", builds: 0},
+		{policy: constant.RebuildNever, exists: false, fail: true},
+		{policy: "sometimes", exists: true, fail: true},
+	} {
+		backend := &fakeRunBackend{
+			images:   map[string]bool{tag: tc.exists},
+			boxes:    map[string]bool{},
+			hashes:   map[string]string{tag: tc.hash},
+			template: tc.template,
+		}
+		params := BoxRunParams{
+			Name:        "demo",
+			Image:       "golang:1.25.0",
+			Rebuild:     tc.policy,
+			UserMapping: constant.UserMappingNone,
+			SSHPort:     2222,
+		}
+		_, err := (&BoxService{backend: backend}).Run(context.Background(), params)
+		if (err != nil) != tc.fail {
+			t.Fatalf("%+v: Run 返回 %v", tc, err)
+		}
+		if backend.builds != tc.builds {
+			t.Fatalf("%+v: 期望构建 %d 次，实际 %d 次", tc, tc.builds, backend.builds)
+		}
+		if tc.builds > 0 && backend.hashes[tag] != tc.template {
+			t.Fatalf("%+v: 重新构建后的模板哈希为 %q", tc, backend.hashes[tag])
+		}
+	}
+
+	// 重新构建过时的镜像时使用原来的用户、构建参数、额外标签和平台
+	backend := &fakeRunBackend{
+		images: map[string]bool{tag: true},
+		boxes:  map[string]bool{},
+		hashes: map[string]string{tag: "old"},
+		labels: map[string]map[string]string{tag: {
+			constant.LabelUser:      "alice",
+			constant.LabelShell:     "zsh",
+			constant.LabelHome:      "/work/alice",
+			constant.LabelBuildArgs: `{"GOPROXY":"https://proxy.example.com"}`,
+			constant.LabelLabels:    `["team"]`,
+			constant.LabelPlatform:  "linux/arm64",
+			"team":                  "infra",
+		}},
+		template: "new",
+	}
+	params := BoxRunParams{Name: "demo", Image: "golang:1.25.0", UserMapping: constant.UserMappingNone, SSHPort: 2222}
+	if _, err := (&BoxService{backend: backend}).Run(context.Background(), params); err != nil {
+		t.Fatal(err)
+	}
+	build := backend.lastBuild
+	if backend.builds != 1 || build.User != "alice" || build.Shell != "zsh" || build.Home != "/work/alice" {
+		t.Fatalf("重新构建应保留原来的用户: %+v", build)
+	}
+	if build.BuildArgs["GOPROXY"] != "https://proxy.example.com" || build.Labels["team"] != "infra" || build.Platform != "linux/arm64" {
+		t.Fatalf("重新构建应保留原来的构建选项: %+v", build)
+	}
+
+	// 旧镜像没有记录用户时使用原来固定的用户，而不是主机用户名
+	backend.labels[tag] = map[string]string{constant.LabelUser: ""}
+	backend.hashes[tag] = "old"
+	if _, err := (&BoxService{backend: backend}).Run(context.Background(), params); err != nil {
+		t.Fatal(err)
+	}
+	if backend.lastBuild.User != constant.VboxUser {
+		t.Fatalf("旧镜像重新构建的用户为 %s，期望 %s", backend.lastBuild.User, constant.VboxUser)
+	}
+}
+
+// TestRunSSHProxy 测试 --ssh-proxy 写入 SSH 配置的 ProxyCommand
+func TestRunSSHProxy(t *testing.T) {
+	saved := *config.GlobalConfig
+	t.Cleanup(func() { *config.GlobalConfig = saved })
+	dir := t.TempDir()
+	config.GlobalConfig.AppSSHDirPath = dir
+	config.GlobalConfig.AppSSHConfigPath = filepath.Join(dir, "config")
+
+	backend := &fakeRunBackend{images: map[string]bool{}, boxes: map[string]bool{}}
+	params := BoxRunParams{Name: "demo", Image: "golang:1.25.0", UserMapping: constant.UserMappingNone, SSHProxy: true}
+	if _, err := (&BoxService{backend: backend}).Run(context.Background(), params); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(config.GlobalConfig.AppSSHConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := sshProxyCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\n    ProxyCommand "+want+"\n") || strings.Contains(string(data), "Port ") {
+		t.Fatalf("SSH 配置不符合预期:\n%s", data)
+	}
+
+	// --ssh-port 和 --ssh-proxy 不能同时使用
+	params.SSHPort = 2222
+	backend = &fakeRunBackend{images: map[string]bool{}, boxes: map[string]bool{}}
+	if _, err := (&BoxService{backend: backend}).Run(context.Background(), params); err == nil || backend.builds != 0 {
+		t.Fatalf("同时指定 --ssh-port 和 --ssh-proxy 应在运行前返回错误: %v", err)
+	}
+}
+
+// TestProxyCommandFor 测试 ProxyCommand 中可执行文件路径的引用
+func TestProxyCommandFor(t *testing.T) {
+	for _, tt := range []struct{ executable, goos, want string }{
+		{"/usr/local/bin/vbox", "linux", "/usr/local/bin/vbox ssh-proxy %n"},
+		{"/Users/a/Library/Application Support/vbox", "darwin", "'/Users/a/Library/Application Support/vbox' ssh-proxy %n"},
+		{"/opt/it's/vbox", "linux", `'/opt/it'\''s/vbox' ssh-proxy %n`},
+		{"/opt/100%/vbox", "linux", "/opt/100%%/vbox ssh-proxy %n"},
+		{`C:\Program Files\vbox.exe`, "windows", `"C:\Program Files\vbox.exe" ssh-proxy %n`},
+	} {
+		if got := proxyCommandFor(tt.executable, tt.goos); got != tt.want {
+			t.Errorf("proxyCommandFor(%q) = %s，期望 %s", tt.executable, got, tt.want)
+		}
+	}
+
+	// ssh 通过 sh -c 执行 ProxyCommand，引用后的路径应还原为原来的路径
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("没有 sh")
+	}
+	for _, executable := range []string{"/a b/vbox", "/it's/$HOME/`x`/vbox", "/a\\b;c/vbox"} {
+		command := strings.TrimSuffix(proxyCommandFor(executable, "linux"), " ssh-proxy %n")
+		out, err := exec.Command(sh, "-c", "printf %s "+command).Output()
+		if err != nil || string(out) != executable {
+			t.Errorf("%q 引用后经 shell 得到 %q, %v", executable, out, err)
+		}
+	}
+}
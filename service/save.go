@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+	"github.com/123cdxcc/vbox/pkg/tools"
+	"golang.org/x/term"
+)
+
+// ImageSaveParams 包含导出镜像的参数
+type ImageSaveParams struct {
+	Images      []string // 环境描述 (golang:1.25.0) 或镜像标签 (vbox-golang:1.25.0)
+	Base        string   // 环境描述使用的基础镜像，为空时使用 debian
+	All         bool     // 导出所有 vbox 镜像
+	Output      string   // 归档文件路径，- 表示标准输出
+	Compression string   // none、gzip、zstd，为空时根据扩展名选择
+	Quiet       bool     // 不显示进度
+}
+
+// ImageLoadParams 包含导入镜像的参数
+type ImageLoadParams struct {
+	Input string // 归档文件路径，- 表示标准输入
+	Quiet bool   // 不显示进度
+}
+
+// saveTags 把要导出的镜像解析为镜像标签，只有按标签导出时归档中才会记录标签
+func (s *ImageService) saveTags(ctx context.Context, params ImageSaveParams) ([]string, error) {
+	var tags []string
+	if params.All {
+		images, err := image.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			tags = append(tags, constant.VboxImagePrefix+img.Name+":"+img.Version)
+		}
+	}
+
+	base, err := template.ParseBase(params.Base)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range params.Images {
+		if strings.HasPrefix(ref, constant.VboxImagePrefix) {
+			tags = append(tags, ref)
+			continue
+		}
+		spec, err := image.ParseSpec(ref)
+		if err != nil {
+			return nil, err
+		}
+		spec, _, err = s.resolveSpec(ctx, spec, base)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, spec.BaseTag(base.ID()))
+	}
+
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("没有要导出的镜像")
+	}
+	cli := config.GlobalConfig.GetDockerClient()
+	for _, tag := range tags {
+		exists, err := tools.ImageExists(ctx, cli, tag)
+		if err != nil {
+			return nil, fmt.Errorf("检查镜像失败: %v", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("镜像 %s 不存在", tag)
+		}
+	}
+	return tags, nil
+}
+
+// Save 把 vbox 镜像导出到一个归档文件，可以用 vbox image load 在其他机器上导入
+// 先写入同一目录中的临时文件，成功后再重命名，失败或取消时不会留下不完整的归档
+func (s *ImageService) Save(ctx context.Context, params ImageSaveParams) error {
+	if params.Output == "-" && term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("不能把归档写入终端，请重定向标准输出或使用 -o 指定文件")
+	}
+	tags, err := s.saveTags(ctx, params)
+	if err != nil {
+		return err
+	}
+	compression := params.Compression
+	if compression == "" {
+		compression = image.CompressionFromPath(params.Output)
+	}
+	if compression, err = image.ParseCompression(compression); err != nil {
+		return err
+	}
+
+	// 进度输出到 stderr，避免干扰 stdout 中的归档
+	progress := &transferProgress{verb: "已写入", quiet: params.Quiet, formatSize: s.formatSize}
+	fmt.Fprintf(os.Stderr, "正在导出 %d 个镜像 (压缩: %s): %s\n", len(tags), compression, strings.Join(tags, ", "))
+	start := time.Now()
+
+	if params.Output == "-" {
+		err = image.Save(ctx, &countingWriter{w: os.Stdout, progress: progress}, tags, compression)
+		progress.Done()
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(params.Output), ".vbox-save-*")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = image.Save(ctx, &countingWriter{w: tmp, progress: progress}, tags, compression)
+	progress.Done()
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("写入归档失败: %v", cerr)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("导出已取消: %w", ctx.Err())
+		}
+		return err
+	}
+	if err := os.Rename(tmp.Name(), params.Output); err != nil {
+		return fmt.Errorf("保存归档失败: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "已导出到 %s (%s，用时 %s)\n", params.Output, s.formatSize(progress.bytes), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Load 从归档文件导入镜像，列出导入的 vbox 镜像
+func (s *ImageService) Load(ctx context.Context, params ImageLoadParams) error {
+	var input io.Reader = os.Stdin
+	var total int64
+	if params.Input != "-" {
+		file, err := os.Open(params.Input)
+		if err != nil {
+			return fmt.Errorf("打开归档失败: %v", err)
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			total = info.Size()
+		}
+		input = file
+	}
+
+	progress := &transferProgress{verb: "已读取", quiet: params.Quiet, total: total, formatSize: s.formatSize}
+	start := time.Now()
+	loaded, err := image.Load(ctx, &countingReader{r: input, progress: progress})
+	progress.Done()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("导入已取消: %w", ctx.Err())
+		}
+		return err
+	}
+	if len(loaded) == 0 {
+		return fmt.Errorf("归档中没有镜像")
+	}
+	fmt.Printf("导入了 %d 个镜像，用时 %s\n", len(loaded), time.Since(start).Round(time.Millisecond))
+
+	// 镜像标签随镜像配置一起导入，List 根据标签和 vbox 标签识别导入的镜像
+	images, err := image.List(ctx)
+	if err != nil {
+		return fmt.Errorf("获取镜像列表失败: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tBASE\tTAG\tIMAGE ID")
+	for _, ref := range loaded {
+		i := slices.IndexFunc(images, func(img image.Image) bool {
+			return constant.VboxImagePrefix+img.Name+":"+img.Version == ref
+		})
+		if i < 0 {
+			fmt.Fprintf(w, "-\t-\t%s\t不是 vbox 镜像\n", ref)
+			continue
+		}
+		img := images[i]
+		base, err := template.ParseBase(img.Base)
+		if err != nil {
+			base.Image = img.Base
+		}
+		shortID := img.ID
+		if len(shortID) > 12 {
+			shortID = shortID[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Spec, base, ref, shortID)
+	}
+	w.Flush()
+	return nil
+}
+
+// transferProgress 在 stderr 上显示导出、导入的字节数，知道总大小时显示百分比
+type transferProgress struct {
+	verb       string
+	quiet      bool
+	total      int64
+	formatSize func(int64) string
+	bytes      int64
+	last       time.Time
+	shown      bool
+}
+
+// Add 记录进度，最多每 200ms 刷新一次
+func (p *transferProgress) Add(n int) {
+	p.bytes += int64(n)
+	if p.quiet || time.Since(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	p.shown = true
+	fmt.Fprintf(os.Stderr, "\r%s", p.status())
+}
+
+func (p *transferProgress) status() string {
+	if p.total > 0 {
+		return fmt.Sprintf("%s %s / %s (%d%%)", p.verb, p.formatSize(p.bytes), p.formatSize(p.total), p.bytes*100/p.total)
+	}
+	return fmt.Sprintf("%s %s", p.verb, p.formatSize(p.bytes))
+}
+
+// Done 输出最终进度
+func (p *transferProgress) Done() {
+	if p.quiet || !p.shown {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r%s\n", p.status())
+}
+
+// countingWriter 统计写入的字节数
+type countingWriter struct {
+	w        io.Writer
+	progress *transferProgress
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.progress.Add(n)
+	return n, err
+}
+
+// countingReader 统计读取的字节数
+type countingReader struct {
+	r        io.Reader
+	progress *transferProgress
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.progress.Add(n)
+	return n, err
+}
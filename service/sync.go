@@ -0,0 +1,548 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/123cdxcc/vbox/box"
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	"github.com/123cdxcc/vbox/pkg/tools"
+	"github.com/fsnotify/fsnotify"
+	"github.com/moby/moby/api/types/container"
+)
+
+// syncIDEnv 后台同步子进程通过该环境变量获知自己的记录 ID
+const syncIDEnv = "VBOX_SYNC_ID"
+
+// syncDebounce 合并文件变更的等待时间
+const syncDebounce = 300 * time.Millisecond
+
+// BoxSyncParams 包含同步目录的参数
+type BoxSyncParams struct {
+	HostDir string // 主机目录
+	Target  string // 格式: "<box>:<dir>"
+	Force   bool   // box 中的文件被修改时仍然覆盖
+	Detach  bool   // 在后台运行
+}
+
+// BoxSyncListParams 包含列出后台同步的参数
+type BoxSyncListParams struct {
+	// 目前不需要额外参数，预留结构体
+}
+
+// BoxSyncStopParams 包含停止后台同步的参数
+type BoxSyncStopParams struct {
+	ID string
+}
+
+// syncRecord 记录一个后台同步进程
+type syncRecord struct {
+	ID      string    `json:"id"`
+	PID     int       `json:"pid"`
+	HostDir string    `json:"host_dir"`
+	Target  string    `json:"target"`
+	LogPath string    `json:"log_path"`
+	Started time.Time `json:"started"`
+}
+
+// Sync 将主机目录单向同步到 box：先完整复制一次，然后持续推送增量变更
+func (s *BoxService) Sync(ctx context.Context, params BoxSyncParams) error {
+	hostDir, err := filepath.Abs(params.HostDir)
+	if err != nil {
+		return fmt.Errorf("无法获取绝对路径: %v", err)
+	}
+	if info, err := os.Stat(hostDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("主机目录 %s 不存在", hostDir)
+	}
+
+	target := parseCopyEndpoint(params.Target)
+	if target.Box == "" {
+		return fmt.Errorf("目标格式错误: %s，正确格式应为 '<box>:<dir>'", params.Target)
+	}
+
+	if params.Detach {
+		return s.startBackgroundSync(hostDir, params)
+	}
+
+	// 后台子进程退出时删除自己的记录
+	if id := os.Getenv(syncIDEnv); id != "" {
+		defer os.Remove(filepath.Join(config.GlobalConfig.SyncDirPath, id+".json"))
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ignore, err := tools.LoadIgnoreFiles(hostDir, ".gitignore", ".vboxignore")
+	if err != nil {
+		return fmt.Errorf("读取忽略规则失败: %v", err)
+	}
+	ignore.Add(".git/")
+
+	containerID := constant.VboxContainerPrefix + target.Box
+	boxContainer, err := box.Get(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("获取 box 信息失败: %w", err)
+	}
+
+	syncer := &boxSyncer{
+		box:    dockerSyncBox{containerID: containerID},
+		user:   boxContainer.User().Name,
+		root:   hostDir,
+		dst:    target.Path,
+		ignore: ignore,
+		force:  params.Force,
+		pushed: make(map[string]time.Time),
+		out:    os.Stdout,
+	}
+
+	if err := syncer.initial(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("初始同步完成: %s -> %s，开始监听变更...\n", hostDir, params.Target)
+
+	return syncer.watch(ctx)
+}
+
+// startBackgroundSync 以后台进程运行同步，并记录到 SyncDirPath
+func (s *BoxService) startBackgroundSync(hostDir string, params BoxSyncParams) error {
+	if err := os.MkdirAll(config.GlobalConfig.SyncDirPath, 0700); err != nil {
+		return fmt.Errorf("创建同步目录失败: %v", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("获取 vbox 可执行文件路径失败: %v", err)
+	}
+
+	id := fmt.Sprintf("%x", time.Now().UnixNano())[:12]
+	logPath := filepath.Join(config.GlobalConfig.SyncDirPath, id+".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("创建同步日志失败: %v", err)
+	}
+	defer logFile.Close()
+
+	args := []string{"sync", hostDir, params.Target}
+	if params.Force {
+		args = append(args, "--force")
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Env = append(os.Environ(), syncIDEnv+"="+id)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	tools.Detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("启动后台同步失败: %v", err)
+	}
+
+	record := syncRecord{
+		ID:      id,
+		PID:     cmd.Process.Pid,
+		HostDir: hostDir,
+		Target:  params.Target,
+		LogPath: logPath,
+		Started: time.Now(),
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(config.GlobalConfig.SyncDirPath, id+".json"), data, 0600); err != nil {
+		return fmt.Errorf("保存同步记录失败: %v", err)
+	}
+	cmd.Process.Release()
+
+	fmt.Printf("后台同步已启动: %s (日志: %s)\n", id, logPath)
+	return nil
+}
+
+// readSyncRecords 读取后台同步记录，已退出的进程记录会被清理
+func readSyncRecords() ([]syncRecord, error) {
+	entries, err := os.ReadDir(config.GlobalConfig.SyncDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []syncRecord
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		recordPath := filepath.Join(config.GlobalConfig.SyncDirPath, entry.Name())
+		data, err := os.ReadFile(recordPath)
+		if err != nil {
+			return nil, err
+		}
+		var record syncRecord
+		if err := json.Unmarshal(data, &record); err != nil || !tools.ProcessAlive(record.PID) {
+			os.Remove(recordPath)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ListSyncs 列出后台运行的同步
+func (s *BoxService) ListSyncs(ctx context.Context, params BoxSyncListParams) error {
+	records, err := readSyncRecords()
+	if err != nil {
+		return fmt.Errorf("读取同步记录失败: %v", err)
+	}
+
+	if len(records) == 0 {
+		fmt.Println("没有正在运行的同步")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SYNC ID\tPID\tHOST DIR\tTARGET\tSTARTED")
+	for _, record := range records {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+			record.ID, record.PID, record.HostDir, record.Target, record.Started.Format(time.DateTime))
+	}
+	w.Flush()
+	return nil
+}
+
+// StopSync 停止后台同步
+func (s *BoxService) StopSync(ctx context.Context, params BoxSyncStopParams) error {
+	records, err := readSyncRecords()
+	if err != nil {
+		return fmt.Errorf("读取同步记录失败: %v", err)
+	}
+
+	for _, record := range records {
+		if record.ID != params.ID {
+			continue
+		}
+		if err := tools.TerminateProcess(record.PID); err != nil {
+			return fmt.Errorf("停止同步失败: %v", err)
+		}
+		os.Remove(filepath.Join(config.GlobalConfig.SyncDirPath, record.ID+".json"))
+		return nil
+	}
+	return fmt.Errorf("未找到 ID 为 %s 的同步", params.ID)
+}
+
+// syncBox 是同步时对 box 的操作，测试中可以替换
+type syncBox interface {
+	MkdirAll(ctx context.Context, dir string) error
+	CopyTo(ctx context.Context, dstDir string, content io.Reader) error
+	Chown(ctx context.Context, user string, paths ...string) error
+	RemovePaths(ctx context.Context, paths ...string) error
+	StatPath(ctx context.Context, path string) (container.PathStat, bool, error)
+}
+
+// dockerSyncBox 通过 Docker 操作 box 中的文件
+type dockerSyncBox struct {
+	containerID string
+}
+
+func (b dockerSyncBox) MkdirAll(ctx context.Context, dir string) error {
+	return box.MkdirAll(ctx, b.containerID, dir)
+}
+
+func (b dockerSyncBox) CopyTo(ctx context.Context, dstDir string, content io.Reader) error {
+	return box.CopyTo(ctx, b.containerID, dstDir, content)
+}
+
+func (b dockerSyncBox) Chown(ctx context.Context, user string, paths ...string) error {
+	return box.Chown(ctx, b.containerID, user, false, paths...)
+}
+
+func (b dockerSyncBox) RemovePaths(ctx context.Context, paths ...string) error {
+	return box.RemovePaths(ctx, b.containerID, paths...)
+}
+
+func (b dockerSyncBox) StatPath(ctx context.Context, path string) (container.PathStat, bool, error) {
+	return box.StatPath(ctx, b.containerID, path)
+}
+
+// boxSyncer 负责把主机目录的变更推送到 box
+type boxSyncer struct {
+	box    syncBox
+	user   string // box 用户，推送的文件归该用户所有
+	root   string // 主机目录
+	dst    string // box 中的目录
+	ignore *tools.IgnoreMatcher
+	force  bool
+	pushed map[string]time.Time // 已推送文件在主机上的修改时间，用于检测 box 中的修改
+	out    io.Writer            // 同步和冲突信息
+}
+
+// initial 完整复制一次主机目录
+func (s *boxSyncer) initial(ctx context.Context) error {
+	if err := s.box.MkdirAll(ctx, s.dst); err != nil {
+		return err
+	}
+
+	var relPaths []string
+	err := filepath.Walk(s.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(s.root, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if s.ignore.Match(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPaths = append(relPaths, relPath)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("遍历主机目录失败: %v", err)
+	}
+
+	return s.push(ctx, relPaths)
+}
+
+// push 将若干相对路径打包推送到 box，并修正所有者
+func (s *boxSyncer) push(ctx context.Context, relPaths []string) error {
+	if len(relPaths) == 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tools.TarFiles(pw, s.root, relPaths, nil))
+	}()
+	if err := s.box.CopyTo(ctx, s.dst, pr); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	boxPaths := make([]string, 0, len(relPaths))
+	for _, relPath := range relPaths {
+		boxPaths = append(boxPaths, path.Join(s.dst, relPath))
+		if info, err := os.Lstat(filepath.Join(s.root, filepath.FromSlash(relPath))); err == nil && !info.IsDir() {
+			s.pushed[relPath] = info.ModTime()
+		}
+	}
+	// 分批修改所有者，避免命令行参数过长
+	for len(boxPaths) > 0 {
+		n := min(len(boxPaths), 500)
+		if err := s.box.Chown(ctx, s.user, boxPaths[:n]...); err != nil {
+			return err
+		}
+		boxPaths = boxPaths[n:]
+	}
+	return nil
+}
+
+// watch 监听主机目录的变更并推送增量
+func (s *boxSyncer) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("创建文件监听失败: %v", err)
+	}
+	defer watcher.Close()
+
+	if err := s.watchTree(watcher, s.root); err != nil {
+		return err
+	}
+
+	pending := make(map[string]struct{})
+	timer := time.NewTimer(syncDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "文件监听错误: %v\n", err)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			relPath, err := filepath.Rel(s.root, event.Name)
+			if err != nil || relPath == "." {
+				continue
+			}
+			relPath = filepath.ToSlash(relPath)
+
+			info, statErr := os.Lstat(event.Name)
+			isDir := statErr == nil && info.IsDir()
+			if s.ignore.Match(relPath, isDir) {
+				continue
+			}
+			pending[relPath] = struct{}{}
+
+			// 新建的目录需要加入监听，目录中已有的文件一并推送
+			if isDir && event.Has(fsnotify.Create) {
+				if err := s.watchTree(watcher, event.Name); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+				filepath.Walk(event.Name, func(filePath string, info os.FileInfo, err error) error {
+					if err != nil {
+						return nil
+					}
+					rel, err := filepath.Rel(s.root, filePath)
+					if err != nil {
+						return nil
+					}
+					rel = filepath.ToSlash(rel)
+					if s.ignore.Match(rel, info.IsDir()) {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					pending[rel] = struct{}{}
+					return nil
+				})
+			}
+			timer.Reset(syncDebounce)
+		case <-timer.C:
+			if err := s.flush(ctx, pending); err != nil {
+				fmt.Fprintf(os.Stderr, "同步失败: %v\n", err)
+			}
+			pending = make(map[string]struct{})
+		}
+	}
+}
+
+// watchTree 递归监听目录，忽略的目录不会被监听
+func (s *boxSyncer) watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if relPath, err := filepath.Rel(s.root, filePath); err == nil && relPath != "." && s.ignore.Match(filepath.ToSlash(relPath), true) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(filePath); err != nil {
+			return fmt.Errorf("监听目录 %s 失败: %v", filePath, err)
+		}
+		return nil
+	})
+}
+
+// flush 推送一批变更：存在的路径打包复制，已删除的路径在 box 中删除
+// 没有 --force 时，box 中在上次推送后被修改过的文件既不覆盖也不删除
+func (s *boxSyncer) flush(ctx context.Context, pending map[string]struct{}) error {
+	var changed, removed []string
+	for relPath := range pending {
+		info, err := os.Lstat(filepath.Join(s.root, filepath.FromSlash(relPath)))
+		if err != nil {
+			if !s.force {
+				conflict, err := s.removeConflicted(ctx, relPath)
+				if err != nil {
+					return err
+				}
+				if conflict {
+					fmt.Fprintf(s.out, "冲突: %s 在 box 中已被修改，不删除（使用 --force 删除）\n", relPath)
+					continue
+				}
+			}
+			removed = append(removed, relPath)
+			continue
+		}
+		if !info.IsDir() && !s.force {
+			conflict, err := s.conflicted(ctx, relPath)
+			if err != nil {
+				return err
+			}
+			if conflict {
+				fmt.Fprintf(s.out, "冲突: %s 在 box 中已被修改，跳过（使用 --force 覆盖）\n", relPath)
+				continue
+			}
+		}
+		changed = append(changed, relPath)
+	}
+	// 父目录先于子路径写入 tar
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	if err := s.push(ctx, changed); err != nil {
+		return err
+	}
+
+	if len(removed) > 0 {
+		boxPaths := make([]string, 0, len(removed))
+		for _, relPath := range removed {
+			boxPaths = append(boxPaths, path.Join(s.dst, relPath))
+			for pushedPath := range s.pushed {
+				if pushedPath == relPath || strings.HasPrefix(pushedPath, relPath+"/") {
+					delete(s.pushed, pushedPath)
+				}
+			}
+		}
+		for len(boxPaths) > 0 {
+			n := min(len(boxPaths), 500)
+			if err := s.box.RemovePaths(ctx, boxPaths[:n]...); err != nil {
+				return err
+			}
+			boxPaths = boxPaths[n:]
+		}
+	}
+
+	if len(changed) > 0 || len(removed) > 0 {
+		fmt.Fprintf(s.out, "[%s] 已同步 %d 个变更，删除 %d 个路径\n", time.Now().Format(time.TimeOnly), len(changed), len(removed))
+	}
+	return nil
+}
+
+// removeConflicted 判断删除主机上已删除的路径是否会丢失 box 中的修改
+// 目录检查其中推送过的文件，box 中新建的文件不在检查范围内
+func (s *boxSyncer) removeConflicted(ctx context.Context, relPath string) (bool, error) {
+	stat, exists, err := s.box.StatPath(ctx, path.Join(s.dst, relPath))
+	if err != nil || !exists {
+		return false, err
+	}
+	if !stat.Mode.IsDir() {
+		return s.conflicted(ctx, relPath)
+	}
+	for pushedPath := range s.pushed {
+		if !strings.HasPrefix(pushedPath, relPath+"/") {
+			continue
+		}
+		if conflict, err := s.conflicted(ctx, pushedPath); err != nil || conflict {
+			return conflict, err
+		}
+	}
+	return false, nil
+}
+
+// conflicted 判断 box 中的文件是否在上次推送后被修改过
+func (s *boxSyncer) conflicted(ctx context.Context, relPath string) (bool, error) {
+	stat, exists, err := s.box.StatPath(ctx, path.Join(s.dst, relPath))
+	if err != nil {
+		return false, err
+	}
+	if !exists || stat.Mode.IsDir() {
+		return false, nil
+	}
+	pushedAt, ok := s.pushed[relPath]
+	if !ok {
+		// box 中存在一个从未由同步写入的文件
+		return true, nil
+	}
+	return !stat.Mtime.Truncate(time.Second).Equal(pushedAt.Truncate(time.Second)), nil
+}
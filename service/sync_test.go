@@ -0,0 +1,197 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/123cdxcc/vbox/pkg/tools"
+	"github.com/moby/moby/api/types/container"
+)
+
+// fakeSyncBox 用主机上的临时目录模拟 box 的文件系统
+type fakeSyncBox struct {
+	root    string // box 中的 / 对应的主机目录
+	removed []string
+}
+
+func (b *fakeSyncBox) hostPath(p string) string {
+	return filepath.Join(b.root, filepath.FromSlash(p))
+}
+
+func (b *fakeSyncBox) MkdirAll(ctx context.Context, dir string) error {
+	return os.MkdirAll(b.hostPath(dir), 0755)
+}
+
+func (b *fakeSyncBox) CopyTo(ctx context.Context, dstDir string, content io.Reader) error {
+	return tools.ExtractTar(content, b.hostPath(dstDir), "", "", nil)
+}
+
+func (b *fakeSyncBox) Chown(ctx context.Context, user string, paths ...string) error {
+	return nil
+}
+
+func (b *fakeSyncBox) RemovePaths(ctx context.Context, paths ...string) error {
+	for _, p := range paths {
+		b.removed = append(b.removed, p)
+		if err := os.RemoveAll(b.hostPath(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *fakeSyncBox) StatPath(ctx context.Context, p string) (container.PathStat, bool, error) {
+	info, err := os.Lstat(b.hostPath(p))
+	if os.IsNotExist(err) {
+		return container.PathStat{}, false, nil
+	}
+	if err != nil {
+		return container.PathStat{}, false, err
+	}
+	return container.PathStat{Name: info.Name(), Size: info.Size(), Mode: info.Mode(), Mtime: info.ModTime()}, true, nil
+}
+
+// TestBoxSyncer 测试同步的初始复制、增量推送、冲突检测和删除
+func TestBoxSyncer(t *testing.T) {
+	hostDir := t.TempDir()
+	fake := &fakeSyncBox{root: t.TempDir()}
+	var out bytes.Buffer
+	ignore := &tools.IgnoreMatcher{}
+	ignore.Add("*.log")
+	syncer := &boxSyncer{
+		box:    fake,
+		user:   "vbox",
+		root:   hostDir,
+		dst:    "/workspace",
+		ignore: ignore,
+		pushed: make(map[string]time.Time),
+		out:    &out,
+	}
+	ctx := context.Background()
+
+	// 主机上的文件修改时间都设在过去，box 中的修改总是更新
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeHost := func(rel, content string) {
+		t.Helper()
+		p := filepath.Join(hostDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		past = past.Add(time.Second)
+		if err := os.Chtimes(p, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBox := func(rel, content string) {
+		t.Helper()
+		p := fake.hostPath("/workspace/" + rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readBox := func(rel string) string {
+		t.Helper()
+		data, err := os.ReadFile(fake.hostPath("/workspace/" + rel))
+		if os.IsNotExist(err) {
+			return "<不存在>"
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	flush := func(rels ...string) {
+		t.Helper()
+		pending := make(map[string]struct{})
+		for _, rel := range rels {
+			pending[rel] = struct{}{}
+		}
+		out.Reset()
+		if err := syncer.flush(ctx, pending); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeHost("main.go", "v1")
+	writeHost("pkg/a.go", "a1")
+	writeHost("pkg/b.go", "b1")
+	writeHost("debug.log", "log")
+	if err := syncer.initial(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if readBox("main.go") != "v1" || readBox("pkg/a.go") != "a1" || readBox("debug.log") != "<不存在>" {
+		t.Fatal("初始同步结果不符合预期")
+	}
+
+	// box 中没有修改时推送主机上的修改
+	writeHost("main.go", "v2")
+	flush("main.go")
+	if got := readBox("main.go"); got != "v2" {
+		t.Fatalf("main.go 应为 v2，实际 %s", got)
+	}
+
+	// box 中修改过的文件不被覆盖
+	writeBox("main.go", "box edit")
+	writeHost("main.go", "v3")
+	flush("main.go")
+	if got := readBox("main.go"); got != "box edit" || !strings.Contains(out.String(), "冲突: main.go") {
+		t.Fatalf("冲突的文件不应被覆盖: %s\n%s", got, out.String())
+	}
+
+	// box 中新建的同名文件也视为冲突
+	writeBox("new.go", "box only")
+	writeHost("new.go", "host")
+	flush("new.go")
+	if got := readBox("new.go"); got != "box only" {
+		t.Fatalf("box 中新建的文件不应被覆盖: %s", got)
+	}
+
+	// 主机上删除的文件在 box 中删除，box 中修改过的文件保留
+	os.Remove(filepath.Join(hostDir, "main.go"))
+	os.Remove(filepath.Join(hostDir, "pkg", "a.go"))
+	flush("main.go", "pkg/a.go")
+	if readBox("pkg/a.go") != "<不存在>" {
+		t.Fatal("主机上删除的文件应在 box 中删除")
+	}
+	if readBox("main.go") != "box edit" || !strings.Contains(out.String(), "不删除") {
+		t.Fatalf("box 中修改过的文件不应被删除:\n%s", out.String())
+	}
+	if _, ok := syncer.pushed["pkg/a.go"]; ok {
+		t.Fatal("删除后不应保留推送记录")
+	}
+
+	// 删除目录时检查其中推送过的文件
+	writeBox("pkg/b.go", "box edit")
+	os.RemoveAll(filepath.Join(hostDir, "pkg"))
+	flush("pkg")
+	if readBox("pkg/b.go") != "box edit" {
+		t.Fatal("目录中有 box 中修改过的文件时不应删除目录")
+	}
+
+	// --force 时覆盖并删除
+	syncer.force = true
+	writeHost("new.go", "forced")
+	flush("new.go", "main.go", "pkg")
+	if readBox("new.go") != "forced" || readBox("main.go") != "<不存在>" || readBox("pkg/b.go") != "<不存在>" {
+		t.Fatal("--force 时应覆盖和删除 box 中的文件")
+	}
+
+	// 没有变更时不删除任何路径
+	fake.removed = nil
+	flush()
+	if len(fake.removed) != 0 || out.Len() != 0 {
+		t.Fatalf("没有变更时不应有操作: %v %s", fake.removed, out.String())
+	}
+}
@@ -0,0 +1,615 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/123cdxcc/vbox/box"
+	"github.com/123cdxcc/vbox/config"
+	"github.com/123cdxcc/vbox/constant"
+	template "github.com/123cdxcc/vbox/env"
+	"github.com/123cdxcc/vbox/image"
+	"github.com/123cdxcc/vbox/pkg/tools"
+)
+
+// TemplateInitParams 包含初始化模板目录的参数
+type TemplateInitParams struct {
+	Force bool // 覆盖用户修改过的文件
+}
+
+// TemplateDiffParams 包含比较内置模板和模板目录的参数
+type TemplateDiffParams struct {
+	// 目前不需要额外参数，预留结构体
+}
+
+// TemplateUpgradeParams 包含升级模板目录的参数
+type TemplateUpgradeParams struct {
+	// 目前不需要额外参数，预留结构体
+}
+
+// TemplateListParams 包含列出环境模板的参数
+type TemplateListParams struct {
+	// 目前不需要额外参数，预留结构体
+}
+
+// TemplateShowParams 包含显示环境模板的参数
+type TemplateShowParams struct {
+	Name    string
+	Version string // 不为空时显示该版本使用的脚本内容
+}
+
+// TemplateNewParams 包含生成环境脚本骨架的参数
+type TemplateNewParams struct {
+	Name    string
+	Version string
+}
+
+// TemplateRmParams 包含删除环境模板的参数
+type TemplateRmParams struct {
+	Name    string
+	Version string // 为空时删除整个环境
+}
+
+// TemplateValidateParams 包含检查模板目录的参数
+type TemplateValidateParams struct {
+	// 目前不需要额外参数，预留结构体
+}
+
+// TemplateTestParams 包含测试环境模板的参数
+type TemplateTestParams struct {
+	Spec image.Spec
+	Base string // 基础镜像，为空时使用 debian
+}
+
+// TemplateSourceAddParams 包含添加模板来源的参数
+type TemplateSourceAddParams struct {
+	Name string
+	URL  string // git 地址、file:// 仓库或本地目录
+	Ref  string // 跟踪的分支或标签
+}
+
+// TemplateSourceUpdateParams 包含更新模板来源的参数
+type TemplateSourceUpdateParams struct {
+	Name string // 为空时更新全部来源
+}
+
+// TemplateSourceRemoveParams 包含删除模板来源的参数
+type TemplateSourceRemoveParams struct {
+	Name string
+}
+
+// TemplateSourceListParams 包含列出模板来源的参数
+type TemplateSourceListParams struct {
+	// 目前不需要额外参数，预留结构体
+}
+
+// TemplateService 提供环境模板相关的业务逻辑
+type TemplateService struct {
+	imageService *ImageService
+}
+
+// NewTemplateService 创建新的 TemplateService 实例
+func NewTemplateService() *TemplateService {
+	return &TemplateService{
+		imageService: NewImageService(),
+	}
+}
+
+// Init 安装内置模板，默认不覆盖用户修改过的文件
+func (s *TemplateService) Init(ctx context.Context, params TemplateInitParams) error {
+	targetDir := config.GlobalConfig.TemplatesDirPath
+	fmt.Printf("正在初始化模板到目录: %s\n", targetDir)
+
+	report, err := template.Install(targetDir, template.InstallOptions{Force: params.Force})
+	if err != nil {
+		return fmt.Errorf("初始化模板失败: %v", err)
+	}
+
+	for _, file := range report.Written {
+		fmt.Printf("写入 %s\n", file)
+	}
+	for _, file := range report.Skipped {
+		fmt.Printf("跳过 %s (已被修改)\n", file)
+	}
+	if len(report.Skipped) > 0 {
+		fmt.Println("使用 vbox template diff 查看差异，vbox template upgrade 获取新版本，或 --force 覆盖")
+	}
+	fmt.Printf("模板初始化完成！\n")
+	return nil
+}
+
+// Diff 显示内置模板与模板目录中文件的差异
+func (s *TemplateService) Diff(ctx context.Context, params TemplateDiffParams) error {
+	states, err := template.Statuses(config.GlobalConfig.TemplatesDirPath)
+	if err != nil {
+		return fmt.Errorf("比较模板失败: %v", err)
+	}
+
+	changed := 0
+	for _, fs := range states {
+		if fs.Status == template.StatusUpToDate {
+			continue
+		}
+		changed++
+		fmt.Printf("# %s (%s)\n", fs.RelPath, fs.Status)
+		fmt.Print(tools.UnifiedDiff("embedded/"+fs.RelPath, "installed/"+fs.RelPath, fs.Embedded, fs.Installed))
+	}
+
+	if changed == 0 {
+		fmt.Println("模板目录与内置模板一致")
+	}
+	return nil
+}
+
+// Upgrade 更新未修改过的文件，为修改过的文件写入 .new 文件
+func (s *TemplateService) Upgrade(ctx context.Context, params TemplateUpgradeParams) error {
+	report, err := template.Install(config.GlobalConfig.TemplatesDirPath, template.InstallOptions{WriteNew: true})
+	if err != nil {
+		return fmt.Errorf("升级模板失败: %v", err)
+	}
+
+	for _, file := range report.Written {
+		fmt.Printf("更新 %s\n", file)
+	}
+	for _, file := range report.NewFiles {
+		fmt.Printf("写入 %s (原文件已被修改，请手动合并)\n", file)
+	}
+	if len(report.Written) == 0 && len(report.NewFiles) == 0 {
+		fmt.Println("模板已是最新")
+	}
+	return nil
+}
+
+// List 列出内置模板、模板目录和外部来源中的模板，标记构建时实际使用的一层
+func (s *TemplateService) List(ctx context.Context, params TemplateListParams) error {
+	entries, err := template.List(config.GlobalConfig.TemplatesDirPath)
+	if err != nil {
+		return fmt.Errorf("获取模板列表失败: %v", err)
+	}
+
+	layers, err := templateLayers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if layer.Kind != template.LayerSource {
+			continue
+		}
+		sourceEntries, err := template.ListSource(layer)
+		if err != nil {
+			return fmt.Errorf("读取模板来源 %s 失败: %v", layer.Name, err)
+		}
+		entries = append(entries, sourceEntries...)
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("未找到任何环境模板")
+		return nil
+	}
+
+	// 每个环境实际使用的模板层
+	active := make(map[string]string)
+	for _, entry := range entries {
+		if _, ok := active[entry.Name]; ok {
+			continue
+		}
+		if _, layer, err := template.FindEnv(layers, entry.Name); err == nil {
+			active[entry.Name] = layer.String()
+		}
+	}
+
+	slices.SortStableFunc(entries, func(a, b template.Entry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	// 使用 tabwriter 格式化输出
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tSCRIPT\tORIGIN\tACTIVE")
+	for _, entry := range entries {
+		if entry.Script == template.ManifestFileName {
+			continue
+		}
+		version := entry.Version
+		if entry.Generic() {
+			version = "*"
+		}
+		origin := string(entry.Origin)
+		if entry.Origin == template.OriginSource {
+			origin = entry.Layer()
+		}
+		mark := ""
+		if active[entry.Name] == entry.Layer() {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Name, version, entry.Script, origin, mark)
+	}
+	w.Flush()
+	return nil
+}
+
+// Show 显示环境模板的描述文件和可用脚本，指定版本时显示该版本使用的脚本
+func (s *TemplateService) Show(ctx context.Context, params TemplateShowParams) error {
+	layers, err := templateLayers()
+	if err != nil {
+		return err
+	}
+
+	envDir, layer, err := template.FindEnv(layers, params.Name)
+	if err != nil {
+		// 内置模板尚未安装时显示内置内容
+		return s.showEmbedded(params)
+	}
+
+	if params.Version != "" {
+		script, err := template.ResolveScript(layers, params.Name, params.Version)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(script.Path)
+		if err != nil {
+			return fmt.Errorf("读取脚本失败: %v", err)
+		}
+		fmt.Printf("# %s:%s -> %s [%s]\n", params.Name, params.Version, script.Path, script.Layer)
+		fmt.Print(string(data))
+		return nil
+	}
+
+	files, err := os.ReadDir(envDir)
+	if err != nil {
+		return fmt.Errorf("读取环境模板失败: %v", err)
+	}
+
+	fmt.Printf("名称: %s\n", params.Name)
+	fmt.Printf("来源: %s\n", layer)
+	fmt.Printf("目录: %s\n", envDir)
+	fmt.Println("文件:")
+	for _, file := range files {
+		if !file.IsDir() {
+			fmt.Printf("  %s\n", file.Name())
+		}
+	}
+
+	m, err := template.LoadManifest(envDir)
+	if err != nil {
+		return err
+	}
+	s.printManifest(m)
+	return nil
+}
+
+// showEmbedded 显示尚未安装的内置模板
+func (s *TemplateService) showEmbedded(params TemplateShowParams) error {
+	entries, err := template.List(config.GlobalConfig.TemplatesDirPath)
+	if err != nil {
+		return fmt.Errorf("获取模板列表失败: %v", err)
+	}
+	entries = slices.DeleteFunc(entries, func(e template.Entry) bool { return e.Name != params.Name })
+	if len(entries) == 0 {
+		return fmt.Errorf("环境模板 %s 不存在", params.Name)
+	}
+	fmt.Println("# 内置模板尚未安装，执行 vbox template init 后才能构建")
+
+	if params.Version != "" {
+		// 与构建时的查找顺序一致：<version>.sh、install.sh、install.sh.tmpl
+		for _, script := range []string{params.Version + ".sh", template.GenericScriptName, template.GenericTemplateName} {
+			if !slices.ContainsFunc(entries, func(e template.Entry) bool { return e.Script == script }) {
+				continue
+			}
+			data, origin, err := template.ReadScript(config.GlobalConfig.TemplatesDirPath, params.Name, script)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("# %s:%s -> %s (%s)\n", params.Name, params.Version, script, origin)
+			fmt.Print(string(data))
+			return nil
+		}
+		return fmt.Errorf("环境 %s 没有版本 %s 的脚本", params.Name, params.Version)
+	}
+
+	fmt.Printf("名称: %s\n", params.Name)
+	fmt.Println("文件:")
+	var m *template.Manifest
+	for _, entry := range entries {
+		fmt.Printf("  %s (%s)\n", entry.Script, entry.Origin)
+		if entry.Script == template.ManifestFileName {
+			data, _, err := template.ReadScript(config.GlobalConfig.TemplatesDirPath, entry.Name, entry.Script)
+			if err != nil {
+				return err
+			}
+			if m, err = template.ParseManifest(data); err != nil {
+				return fmt.Errorf("环境 %s: %v", params.Name, err)
+			}
+		}
+	}
+	s.printManifest(m)
+	return nil
+}
+
+// printManifest 显示 template.yaml 的内容
+func (s *TemplateService) printManifest(m *template.Manifest) {
+	if m == nil {
+		fmt.Printf("未找到 %s\n", template.ManifestFileName)
+		return
+	}
+
+	if m.Description != "" {
+		fmt.Printf("描述: %s\n", m.Description)
+	}
+	if len(m.Versions) > 0 {
+		fmt.Printf("版本: %s\n", strings.Join(m.Versions, ", "))
+	}
+	if len(m.Aliases) > 0 {
+		fmt.Println("别名:")
+		for _, alias := range slices.Sorted(maps.Keys(m.Aliases)) {
+			fmt.Printf("  %s -> %s\n", alias, m.Aliases[alias])
+		}
+	}
+	if !m.Packages.Empty() {
+		fmt.Printf("软件包: %s\n", m.Packages)
+	}
+	if len(m.Env) > 0 {
+		fmt.Println("环境变量:")
+		for _, key := range slices.Sorted(maps.Keys(m.Env)) {
+			fmt.Printf("  %s=%s\n", key, m.Env[key])
+		}
+	}
+	if len(m.Ports) > 0 {
+		ports := make([]string, len(m.Ports))
+		for i, port := range m.Ports {
+			ports[i] = fmt.Sprintf("%d", port)
+		}
+		fmt.Printf("端口: %s\n", strings.Join(ports, ", "))
+	}
+	if len(m.Verify) > 0 {
+		fmt.Println("验证命令:")
+		for _, cmd := range m.Verify {
+			fmt.Printf("  %s\n", cmd)
+		}
+	}
+}
+
+// New 为 name:version 生成脚本骨架
+func (s *TemplateService) New(ctx context.Context, params TemplateNewParams) error {
+	scriptPath, err := template.New(config.GlobalConfig.TemplatesDirPath, params.Name, params.Version)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("已生成环境脚本: %s\n", scriptPath)
+	return nil
+}
+
+// Rm 删除环境脚本或整个环境
+func (s *TemplateService) Rm(ctx context.Context, params TemplateRmParams) error {
+	if err := template.Remove(config.GlobalConfig.TemplatesDirPath, params.Name, params.Version); err != nil {
+		return err
+	}
+	if params.Version == "" {
+		fmt.Printf("已删除环境模板: %s\n", params.Name)
+	} else {
+		fmt.Printf("已删除环境脚本: %s:%s\n", params.Name, params.Version)
+	}
+	return nil
+}
+
+// Validate 检查模板目录，存在错误时返回 error
+func (s *TemplateService) Validate(ctx context.Context, params TemplateValidateParams) error {
+	problems := template.Validate(config.GlobalConfig.TemplatesDirPath)
+
+	errors := 0
+	for _, problem := range problems {
+		if problem.Warning {
+			fmt.Printf("⚠ %s\n", problem)
+			continue
+		}
+		errors++
+		fmt.Printf("✗ %s\n", problem)
+	}
+
+	if errors > 0 {
+		return fmt.Errorf("发现 %d 个错误", errors)
+	}
+	fmt.Printf("✓ 模板目录检查通过: %s\n", config.GlobalConfig.TemplatesDirPath)
+	return nil
+}
+
+// Test 构建镜像，在临时 box 中执行各环境 template.yaml 中的 verify 命令，结束后删除 box
+func (s *TemplateService) Test(ctx context.Context, params TemplateTestParams) error {
+	base, err := template.ParseBase(params.Base)
+	if err != nil {
+		return err
+	}
+	spec, manifests, err := s.imageService.resolveSpec(ctx, params.Spec, base)
+	if err != nil {
+		return err
+	}
+
+	type verifyCmd struct {
+		env string
+		cmd string
+	}
+	var cmds []verifyCmd
+	for i, m := range manifests {
+		if m == nil {
+			continue
+		}
+		for _, cmd := range m.Verify {
+			cmds = append(cmds, verifyCmd{env: spec[i].Name, cmd: cmd})
+		}
+	}
+	if len(cmds) == 0 {
+		return fmt.Errorf("%s 没有声明 verify 命令", spec)
+	}
+
+	if _, err := s.imageService.BuildImage(ctx, ImageBuildParams{Spec: spec, Base: params.Base}); err != nil {
+		return err
+	}
+
+	cli := config.GlobalConfig.GetDockerClient()
+	imageLabels, err := tools.ImageLabels(ctx, cli, spec.BaseTag(base.ID()))
+	if err != nil {
+		return fmt.Errorf("获取镜像信息失败: %v", err)
+	}
+	boxUser := box.UserFromLabels(imageLabels)
+
+	// setup.sh 要求存在 authorized_keys，临时 box 使用一次性的公钥
+	publicKey, _, err := config.GenSSHKeys()
+	if err != nil {
+		return fmt.Errorf("生成SSH密钥失败: %v", err)
+	}
+	keyFile, err := os.CreateTemp("", "vbox-template-test-*.pub")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败: %v", err)
+	}
+	defer os.Remove(keyFile.Name())
+	if _, err := keyFile.WriteString(publicKey); err != nil {
+		keyFile.Close()
+		return fmt.Errorf("写入临时文件失败: %v", err)
+	}
+	keyFile.Close()
+
+	name := fmt.Sprintf("template-test-%d", time.Now().UnixNano())
+	fmt.Printf("\n创建临时 box: %s\n", name)
+	boxContainer, err := box.Create(ctx, box.CreateOption{
+		Name:         name,
+		ImageName:    spec.ImageName(),
+		ImageVersion: spec.BaseVersion(base.ID()),
+		PublicKey:    keyFile.Name(),
+		Detached:     true,
+		User:         boxUser,
+	})
+	if err != nil {
+		return fmt.Errorf("创建临时 box 失败: %v", err)
+	}
+	defer func() {
+		// 即使 ctx 已取消也要清理临时 box
+		if err := box.Delete(context.WithoutCancel(ctx), boxContainer.ID, true); err != nil {
+			fmt.Printf("删除临时 box 失败: %v\n", err)
+		}
+	}()
+
+	if err := box.WaitSSHReady(ctx, boxContainer.ID, constant.DefaultSSHWaitTimeout*time.Second); err != nil {
+		return fmt.Errorf("临时 box 未能启动: %v", err)
+	}
+
+	failed := 0
+	for _, c := range cmds {
+		// 使用登录 shell 执行，加载 /etc/profile.d 中的环境变量
+		result, err := box.Exec(ctx, boxContainer.ID, boxUser.Name, []string{"bash", "-lc", c.cmd})
+		if err != nil {
+			return err
+		}
+		if result.ExitCode == 0 {
+			fmt.Printf("✓ [%s] %s\n", c.env, c.cmd)
+			if out := strings.TrimSpace(result.Stdout); out != "" {
+				fmt.Printf("    %s\n", strings.ReplaceAll(out, "\n", "\n    "))
+			}
+			continue
+		}
+		failed++
+		fmt.Printf("✗ [%s] %s (退出码 %d)\n", c.env, c.cmd, result.ExitCode)
+		if out := strings.TrimSpace(result.Stdout + result.Stderr); out != "" {
+			fmt.Printf("    %s\n", strings.ReplaceAll(out, "\n", "\n    "))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d/%d 个验证命令失败", failed, len(cmds))
+	}
+	fmt.Printf("\n%s 的 %d 个验证命令全部通过\n", spec, len(cmds))
+	return nil
+}
+
+// shortCommit 截短提交哈希以便显示
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+// SourceAdd 添加模板来源
+func (s *TemplateService) SourceAdd(ctx context.Context, params TemplateSourceAddParams) error {
+	source, err := template.AddSource(ctx, config.GlobalConfig.SourcesDirPath, params.Name, params.URL, params.Ref)
+	if err != nil {
+		return fmt.Errorf("添加模板来源失败: %v", err)
+	}
+
+	if source.Kind == template.SourceGit {
+		fmt.Printf("已添加模板来源 %s: %s @ %s\n", source.Name, source.URL, shortCommit(source.Commit))
+	} else {
+		fmt.Printf("已添加模板来源 %s: %s (本地目录)\n", source.Name, source.URL)
+	}
+	return nil
+}
+
+// SourceUpdate 更新模板来源并固定到最新提交
+func (s *TemplateService) SourceUpdate(ctx context.Context, params TemplateSourceUpdateParams) error {
+	names := []string{params.Name}
+	if params.Name == "" {
+		sources, err := template.LoadSources(config.GlobalConfig.SourcesDirPath)
+		if err != nil {
+			return fmt.Errorf("读取模板来源失败: %v", err)
+		}
+		if len(sources) == 0 {
+			fmt.Println("没有任何模板来源")
+			return nil
+		}
+		names = names[:0]
+		for _, source := range sources {
+			names = append(names, source.Name)
+		}
+	}
+
+	for _, name := range names {
+		source, oldCommit, err := template.UpdateSource(ctx, config.GlobalConfig.SourcesDirPath, name)
+		if err != nil {
+			return fmt.Errorf("更新模板来源 %s 失败: %v", name, err)
+		}
+		switch {
+		case source.Kind == template.SourceDir:
+			fmt.Printf("%s: 本地目录，无需更新\n", name)
+		case oldCommit == source.Commit:
+			fmt.Printf("%s: 已是最新 (%s)\n", name, shortCommit(source.Commit))
+		default:
+			fmt.Printf("%s: %s -> %s\n", name, shortCommit(oldCommit), shortCommit(source.Commit))
+		}
+	}
+	return nil
+}
+
+// SourceRemove 删除模板来源
+func (s *TemplateService) SourceRemove(ctx context.Context, params TemplateSourceRemoveParams) error {
+	if err := template.RemoveSource(config.GlobalConfig.SourcesDirPath, params.Name); err != nil {
+		return fmt.Errorf("删除模板来源失败: %v", err)
+	}
+	fmt.Printf("已删除模板来源: %s\n", params.Name)
+	return nil
+}
+
+// SourceList 按优先级列出模板来源
+func (s *TemplateService) SourceList(ctx context.Context, params TemplateSourceListParams) error {
+	sources, err := template.LoadSources(config.GlobalConfig.SourcesDirPath)
+	if err != nil {
+		return fmt.Errorf("读取模板来源失败: %v", err)
+	}
+	if len(sources) == 0 {
+		fmt.Println("没有任何模板来源")
+		return nil
+	}
+
+	// 使用 tabwriter 格式化输出
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKIND\tURL\tREF\tCOMMIT\tUPDATED")
+	for _, source := range sources {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			source.Name, source.Kind, source.URL, source.Ref, shortCommit(source.Commit), source.UpdatedAt.Format(time.DateTime))
+	}
+	w.Flush()
+	return nil
+}